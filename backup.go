@@ -0,0 +1,328 @@
+package bitcask
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// backupFile is a file of a backup, a data file cut at the size it had
+// when the backup started or a hint file generated for it.
+type backupFile struct {
+	name string
+	// size is the size of the file once it's opened.
+	size int64
+	open func() (io.ReadCloser, int64, error)
+}
+
+// Backup writes a tar stream of the datastore to w. The backup holds the
+// data files as they were when Backup was called, along with hint files
+// generated from the keydir at that point, so it's consistent even
+// though reads and writes carry on while it's written. Pending writes
+// are synced first. Merges wait until the backup is done.
+// The backup can be unpacked with Restore, and a restored backup can be
+// opened as a follower of the bitcask, see ServeReplica.
+func (bc *BitCask) Backup(w io.Writer) error {
+	tw := tar.NewWriter(w)
+	modTime := time.Now()
+
+	err := bc.backup(func(file backupFile, r io.Reader) error {
+		header := &tar.Header{
+			Name:    file.name,
+			Mode:    int64(UserReadWrite),
+			Size:    file.size,
+			ModTime: modTime,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := io.Copy(tw, r)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// BackupTo writes a backup of the datastore into the directory at
+// directoryPath, which must not exist or be empty. The directory is a
+// ready to open datastore once BackupTo returns, see Backup. The
+// directory is in the file system of the bitcask.
+// returns err == ErrRestoreDirNotEmpty if the directory isn't empty.
+func (bc *BitCask) BackupTo(directoryPath string) error {
+	if err := makeRestoreDir(bc.fs, directoryPath); err != nil {
+		return err
+	}
+
+	err := bc.backup(func(file backupFile, r io.Reader) error {
+		return copyToFile(bc.fs, path.Join(directoryPath, file.name), r)
+	})
+	if err != nil {
+		return err
+	}
+
+	return finishRestore(bc.fs, directoryPath)
+}
+
+// Restore unpacks a backup written by Backup from r into the directory
+// at directoryPath, which must not exist or be empty. It checks every
+// item of the restored data files and builds the keydir file. If the
+// backup is invalid, the restored files are removed.
+// returns err == ErrRestoreDirNotEmpty if the directory isn't empty
+// err wrapping ErrInvalidBackup if the backup is invalid.
+func Restore(r io.Reader, directoryPath string) error {
+	return restore(OSFS, r, directoryPath)
+}
+
+// restore restores a backup into directoryPath of fsys, see Restore.
+func restore(fsys FS, r io.Reader, directoryPath string) error {
+	if err := makeRestoreDir(fsys, directoryPath); err != nil {
+		return err
+	}
+
+	err := unpackBackup(fsys, r, directoryPath)
+	if err == nil {
+		err = finishRestore(fsys, directoryPath)
+	}
+	if err != nil {
+		fsys.RemoveAll(directoryPath)
+		return err
+	}
+
+	return nil
+}
+
+// backup calls fn with every file of a backup of the datastore.
+func (bc *BitCask) backup(fn func(file backupFile, r io.Reader) error) error {
+	bc.mergeMu.Lock()
+	defer bc.mergeMu.Unlock()
+
+	files, err := bc.backupFiles()
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		r, size, err := file.open()
+		if err != nil {
+			return err
+		}
+		file.size = size
+		err = fn(file, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// backupFiles lists the files of a backup of the datastore as it is now.
+// Data files are only appended to, so a data file cut at its current size
+// stays the same until merge deletes it, which the caller prevents by
+// holding the merge lock. A torn item at the end of a data file, left
+// by a failed write or a crash, is cut off too.
+func (bc *BitCask) backupFiles() ([]backupFile, error) {
+	bc.mu.Lock()
+	defer bc.unlock()
+
+	bc.sync()
+
+	hints := make(map[string][]byte)
+	bc.keydir.each(func(key string, record Record) {
+		fileId := bc.files.path(record.file)
+		hints[fileId] = appendHint(hints[fileId], key, record)
+	})
+
+	var fileIds []string
+	for fileId := range bc.fileStats {
+		fileIds = append(fileIds, fileId)
+	}
+	sort.Strings(fileIds)
+
+	var files []backupFile
+	for _, fileId := range fileIds {
+		var size int64
+		if bc.activeFile != nil && fileId == bc.activeFile.Name() {
+			size = bc.cursor
+		} else {
+			info, err := bc.fs.Stat(fileId)
+			if err != nil {
+				return nil, err
+			}
+			size = info.Size()
+		}
+		if size == 0 {
+			continue
+		}
+
+		fileId := fileId
+		files = append(files, backupFile{
+			name: path.Base(fileId),
+			open: func() (io.ReadCloser, int64, error) {
+				file, err := openFile(bc.fs, fileId)
+				if err != nil {
+					return nil, 0, err
+				}
+				end, err := completeItemsEnd(file, size)
+				if err != nil {
+					file.Close()
+					return nil, 0, err
+				}
+				return sectionReadCloser{io.NewSectionReader(file, 0, end), file}, end, nil
+			},
+		})
+
+		hintName := hintFileName(fileId)
+		files = append(files, dataBackupFile(path.Base(hintName), bc.cipher.sealData(hintName, hints[fileId])))
+		if isMerged(bc.fs, fileId) {
+			files = append(files, dataBackupFile(path.Base(mergedFileName(fileId)), nil))
+		}
+	}
+
+	// the replication position lets a restored backup follow the
+	// bitcask, or the leader of a follower, from where it was taken.
+	pos := bc.replicationPos
+	if !bc.config.follower && bc.activeFile != nil {
+		pos = ReplicationPosition{File: path.Base(bc.activeFile.Name()), Offset: bc.cursor}
+	}
+	if pos.File != "" {
+		files = append(files, dataBackupFile(replicationPosFileName, positionFileData(pos)))
+	}
+
+	return files, nil
+}
+
+// dataBackupFile returns a backup file named name holding data.
+func dataBackupFile(name string, data []byte) backupFile {
+	return backupFile{
+		name: name,
+		open: func() (io.ReadCloser, int64, error) {
+			return io.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+		},
+	}
+}
+
+// completeItemsEnd returns the end of the last complete item among the
+// first size bytes of file. Only the item headers are read, the crc of
+// the items is checked by restore.
+func completeItemsEnd(file io.ReaderAt, size int64) (int64, error) {
+	header := make([]byte, itemHeaderSize)
+	var offset int64
+	for offset+itemHeaderSize <= size {
+		if _, err := file.ReadAt(header, offset); err != nil {
+			return 0, err
+		}
+		keySize := int64(binary.BigEndian.Uint32(header[12:]))
+		valueSize := int64(binary.BigEndian.Uint32(header[16:]) &^ valueSizeFlags)
+		end := offset + itemHeaderSize + keySize + valueSize
+		if end > size {
+			break
+		}
+		offset = end
+	}
+
+	return offset, nil
+}
+
+// sectionReadCloser reads a section of a file and closes the file.
+type sectionReadCloser struct {
+	*io.SectionReader
+	io.Closer
+}
+
+// unpackBackup writes the files of a backup tar stream into directoryPath.
+func unpackBackup(fsys FS, r io.Reader, directoryPath string) error {
+	tr := tar.NewReader(r)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+		}
+
+		name := header.Name
+		if header.Typeflag != tar.TypeReg || name != path.Base(name) ||
+			!(isDataFile(name) || path.Ext(name) == HintFileExtension || path.Ext(name) == MergedFileExtension || name == replicationPosFileName) {
+			return fmt.Errorf("%w: unexpected file %q", ErrInvalidBackup, name)
+		}
+
+		if err := copyToFile(fsys, path.Join(directoryPath, name), tr); err != nil {
+			return err
+		}
+	}
+}
+
+// finishRestore builds the keydir file of a restored datastore and
+// checks every item of its data files. The keydir of an encrypted
+// datastore is recovered from its hint files once it's opened instead.
+func finishRestore(fsys FS, directoryPath string) error {
+	files, keydir := newFileTable(), newKeyIndex(false)
+	if _, err := recoverKeydir(fsys, nil, directoryPath, files, keydir); err == nil {
+		writeKeydirFile(fsys, nil, directoryPath, files, keydir)
+	}
+
+	report, err := check(fsys, directoryPath)
+	if err != nil {
+		return err
+	}
+	if !report.OK() {
+		return fmt.Errorf("%w: restored datastore failed the check", ErrInvalidBackup)
+	}
+
+	return nil
+}
+
+// makeRestoreDir creates the directory at directoryPath if it doesn't
+// exist and makes sure it's empty.
+func makeRestoreDir(fsys FS, directoryPath string) error {
+	if err := fsys.MkdirAll(directoryPath, os.ModeDir|UserReadWriteExec); err != nil {
+		return err
+	}
+
+	entries, err := fsys.ReadDir(directoryPath)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return ErrRestoreDirNotEmpty
+	}
+
+	return nil
+}
+
+// copyToFile creates a new file at filePath with the content of r
+// and syncs it to disk.
+func copyToFile(fsys FS, filePath string, r io.Reader) error {
+	file, err := fsys.OpenFile(filePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, UserReadWrite)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("%w: duplicate file %q", ErrInvalidBackup, path.Base(filePath))
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
@@ -0,0 +1,135 @@
+package bitcask
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBackup(t *testing.T) {
+	t.Run("backup while writing and restore", func(t *testing.T) {
+		fsys := NewMemFS()
+		bc, _ := Open(testBitcaskBackupPath, RWConfig.WithFS(fsys))
+		for i := 0; i < 100; i++ {
+			bc.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte("value"+fmt.Sprintf("%d", i)))
+		}
+		bc.Delete([]byte("key0"))
+
+		var backup bytes.Buffer
+		done := make(chan error)
+		go func() {
+			done <- bc.Backup(&backup)
+		}()
+		for i := 1; i < 100; i++ {
+			bc.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte("new"))
+		}
+		err := <-done
+		bc.Close()
+		if err != nil {
+			t.Fatalf("unexpected backup error: %v", err)
+		}
+
+		if err := restore(fsys, &backup, testBitcaskRestorePath); err != nil {
+			t.Fatalf("unexpected restore error: %v", err)
+		}
+		restored, _ := Open(testBitcaskRestorePath, DefaultConfig.WithFS(fsys))
+		defer restored.Close()
+		_, err = restored.Get([]byte("key0"))
+		assertErrorMsg(t, err, BitCaskError("\"key0\": key doesn't exist"))
+		for i := 1; i < 100; i++ {
+			got, _ := restored.Get([]byte("key" + fmt.Sprintf("%d", i)))
+			if string(got) != "value"+fmt.Sprintf("%d", i) && string(got) != "new" {
+				t.Errorf("got %q for key%d", got, i)
+			}
+		}
+	})
+
+	t.Run("backup to a directory", func(t *testing.T) {
+		fsys := NewMemFS()
+		bc, _ := Open(testBitcaskBackupPath, RWConfig.WithFS(fsys))
+		for i := 0; i < 100; i++ {
+			bc.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte("value"+fmt.Sprintf("%d", i)))
+		}
+
+		err := bc.BackupTo(testBitcaskRestorePath)
+		bc.Put([]byte("key1"), []byte("after backup"))
+		bc.Close()
+		if err != nil {
+			t.Fatalf("unexpected backup error: %v", err)
+		}
+
+		restored, _ := Open(testBitcaskRestorePath, DefaultConfig.WithFS(fsys))
+		defer restored.Close()
+		got, _ := restored.Get([]byte("key1"))
+		assertEqualStrings(t, string(got), "value1")
+		if len(restored.ListKeys()) != 100 {
+			t.Errorf("got %d keys, want 100", len(restored.ListKeys()))
+		}
+	})
+
+	t.Run("torn items at the end of data files aren't backed up", func(t *testing.T) {
+		fsys := NewMemFS()
+		bc, _ := Open(testBitcaskBackupPath, RWsyncConfig.WithFS(fsys))
+		bc.Put([]byte("key"), []byte("value"))
+		torn := bc.makeItem([]byte("torn"), []byte("value"), time.Now())
+		bc.activeFile.Write(torn[:len(torn)-2])
+		bc.Close()
+
+		bc, _ = Open(testBitcaskBackupPath, DefaultConfig.WithFS(fsys))
+		defer bc.Close()
+		var backup bytes.Buffer
+		if err := bc.Backup(&backup); err != nil {
+			t.Fatalf("unexpected backup error: %v", err)
+		}
+		if err := restore(fsys, &backup, testBitcaskRestorePath); err != nil {
+			t.Fatalf("unexpected restore error: %v", err)
+		}
+		restored, _ := Open(testBitcaskRestorePath, DefaultConfig.WithFS(fsys))
+		defer restored.Close()
+		got, _ := restored.Get([]byte("key"))
+		assertEqualStrings(t, string(got), "value")
+	})
+
+	t.Run("restore needs an empty directory", func(t *testing.T) {
+		fsys := NewMemFS()
+		fsys.MkdirAll(testBitcaskRestorePath, os.ModeDir|UserReadWriteExec)
+		writeFile(fsys, testBitcaskRestorePath+"/file", []byte("data"), UserReadWrite)
+
+		err := restore(fsys, &bytes.Buffer{}, testBitcaskRestorePath)
+		assertErrorMsg(t, err, ErrRestoreDirNotEmpty)
+	})
+
+	t.Run("corrupted backup is rejected", func(t *testing.T) {
+		fsys := NewMemFS()
+		bc, _ := Open(testBitcaskBackupPath, RWConfig.WithFS(fsys))
+		bc.Put([]byte("key"), []byte("value"))
+		var backup bytes.Buffer
+		bc.Backup(&backup)
+		bc.Close()
+
+		data := bytes.Replace(backup.Bytes(), []byte("value"), []byte("VALUE"), 1)
+		err := restore(fsys, bytes.NewReader(data), testBitcaskRestorePath)
+		if !errors.Is(err, ErrInvalidBackup) {
+			t.Errorf("got %v, want %v", err, ErrInvalidBackup)
+		}
+		if _, err := fsys.Stat(testBitcaskRestorePath); !os.IsNotExist(err) {
+			t.Errorf("expected restored files to be removed")
+		}
+	})
+
+	t.Run("files outside the restore directory are rejected", func(t *testing.T) {
+		var backup bytes.Buffer
+		tw := tar.NewWriter(&backup)
+		tw.WriteHeader(&tar.Header{Name: "../1.cask", Mode: 0600, Size: 0})
+		tw.Close()
+
+		err := restore(NewMemFS(), &backup, testBitcaskRestorePath)
+		if !errors.Is(err, ErrInvalidBackup) {
+			t.Errorf("got %v, want %v", err, ErrInvalidBackup)
+		}
+	})
+}
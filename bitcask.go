@@ -7,6 +7,7 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -16,11 +17,14 @@ type processAccess int
 
 type Keydir map[string] Record
 
+// Record points at the newest item of a key. It takes 24 bytes: the
+// data file is the id the fileTable gives it and the timestamp is in
+// microseconds since the Unix epoch, like in the item header.
 type Record struct {
-	fileId string
-	valueSize int
+	file uint32
+	valueSize uint32
 	valuePosition int64
-	timeStamp time.Time
+	timeStamp int64
 }
 
 // Config contains the data for configuration options that the
@@ -28,18 +32,50 @@ type Record struct {
 type Config struct {
 	writePermission bool
 	syncOnPut bool
+	autoMerge bool
+	mergePolicy MergePolicy
+	follower bool
+	fs FS
+	maxOpenFiles int
+	mmap bool
+	compactKeydir bool
+	compression bool
+	keyProvider KeyProvider
+	lazyKeydir bool
 }
 
 // Bitcask contains the data needed to manipulate the bitcask datastore.
 // user creates an object of it to use the bitcask.
 type BitCask struct {
-	activeFile *os.File
+	mu sync.RWMutex
+	activeFile File
 	lock string
 	cursor int64
 	dirName string
-	keydir Keydir
+	fs FS
+	readFiles *filePool
+	keydir *keyIndex
+	files *fileTable
+	cipher *itemCipher
+	buckets map[string]bucketRef
+	bucketsMu sync.Mutex
+	lastBucketId uint32
 	config Config
 	pendingWrites map[string][]byte
+	fileStats map[string]*fileStat
+	stopMerge chan void
+	mergeWg sync.WaitGroup
+	mergeMu sync.Mutex
+	lastTimeStamp time.Time
+	lastMerge time.Time
+	lastMergeDuration time.Duration
+	appended chan void
+	closed chan void
+	replicationPos ReplicationPosition
+	logTruncatedAt ReplicationPosition
+	watchers []*Watcher
+	events []Event
+	publishMu sync.Mutex
 }
 
 
@@ -47,10 +83,6 @@ type BitCask struct {
 // these files into in-memory structure keydir. if the directory
 // doesn't exist at this path, it creates a new directory. 
 func Open(directoryPath string, config ...Config) (*BitCask, error) {
-	if err := os.MkdirAll(directoryPath, os.ModeDir | UserReadWriteExec); err != nil {
-		return nil, err
-	}
-
 	var opts Config
 	var lock string
 	if config == nil {
@@ -58,8 +90,13 @@ func Open(directoryPath string, config ...Config) (*BitCask, error) {
 	} else {
 		opts = config[0]
 	}
+	fsys := opts.fileSystem()
+
+	if err := fsys.MkdirAll(directoryPath, os.ModeDir | UserReadWriteExec); err != nil {
+		return nil, err
+	}
 
-	lockType := checkLock(directoryPath)
+	lockType := checkLock(fsys, directoryPath)
 	if  lockType == writer {
 		return nil, ErrBitCaskIsLocked
 	} else if lockType == reader {
@@ -73,11 +110,23 @@ func Open(directoryPath string, config ...Config) (*BitCask, error) {
 			lock = writeLock + strconv.Itoa(int(time.Now().UnixMicro()))
 		}
 
-		lockFile, _ := os.OpenFile(path.Join(directoryPath, lock), os.O_CREATE, 0600)
-		lockFile.Close()
+		if lockFile, err := fsys.OpenFile(path.Join(directoryPath, lock), os.O_CREATE, 0600); err == nil {
+			lockFile.Close()
+		}
 	}
 	// build bitcask
-	bc := new(directoryPath, opts, lock)
+	bc, err := new(directoryPath, opts, lock)
+	if err != nil {
+		if lock != "" {
+			fsys.Remove(path.Join(directoryPath, lock))
+		}
+		return nil, err
+	}
+
+	if opts.writePermission && opts.autoMerge {
+		bc.mergeWg.Add(1)
+		go bc.autoMerge()
+	}
 
 	return bc, nil
 }
@@ -90,44 +139,135 @@ func (bc *BitCask) Get(key []byte) ([]byte, error) {
 	if key == nil {
 		return nil, ErrNullKeyOrValue
 	}
-	var data []byte
-	var n int
-	var record Record
 
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+
+	return bc.get(namespaceKey(defaultBucket, key))
+}
+
+// get retrieves a value by key without taking the bitcask lock.
+func (bc *BitCask) get(key []byte) ([]byte, error) {
 	if value, ok := bc.pendingWrites[string(key)]; ok {
 		return value, nil
 
 	} else if err := bc.isExist(key); err != nil {
 		return nil, err
 	} else {
-		record = bc.keydir[string(key)]
-		data = make([]byte, record.valueSize)
-		file, err := os.Open(record.fileId)
-		if err != nil {
-			return nil, fmt.Errorf("can't open file: " + record.fileId)
-		}
-		
-		n, err = file.ReadAt(data, record.valuePosition)
-		if err != nil {
-			return nil, fmt.Errorf("read only " + fmt.Sprintf("%d", n) + " bytes out of " +
-							fmt.Sprintf("%d", record.valueSize))
+		record, _ := bc.keydir.get(string(key))
+		return bc.readValue(record)
+	}
+}
+
+// GetView calls fn with the value of key, sliced from the mapping of its
+// data file without copying it when the file is mapped, see Config.WithMmap.
+// Compressed or encrypted values are decoded into a new buffer.
+// The value is only valid until fn returns and must not be modified.
+// fn is called without holding the bitcask lock, so it may use the bitcask.
+// It returns the same errors as Get, or the error returned by fn.
+func (bc *BitCask) GetView(key []byte, fn func(value []byte) error) error {
+	if key == nil {
+		return ErrNullKeyOrValue
+	}
+	key = namespaceKey(defaultBucket, key)
+
+	bc.mu.RLock()
+	if value, ok := bc.pendingWrites[string(key)]; ok {
+		bc.mu.RUnlock()
+		return fn(value)
+	}
+	if err := bc.isExist(key); err != nil {
+		bc.mu.RUnlock()
+		return err
+	}
+	record, _ := bc.keydir.get(string(key))
+	fileId := bc.files.path(record.file)
+	// the file stays open and mapped until it's released, even if a
+	// merge deletes it in the meantime.
+	pf, err := bc.readFiles.get(fileId)
+	bc.mu.RUnlock()
+	if err != nil {
+		return fmt.Errorf("can't open file: " + fileId)
+	}
+	defer bc.readFiles.release(pf)
+
+	if view, ok := pf.view(record.valuePosition, record.size()); ok && !record.compressed() && !record.encrypted() {
+		return fn(view)
+	}
+	data, err := bc.readValueFrom(pf, record)
+	if err != nil {
+		return err
+	}
+	return fn(data)
+}
+
+// readValue reads the value record points at from its data file.
+func (bc *BitCask) readValue(record Record) ([]byte, error) {
+	fileId := bc.files.path(record.file)
+	pf, err := bc.readFiles.get(fileId)
+	if err != nil {
+		return nil, fmt.Errorf("can't open file: " + fileId)
+	}
+	defer bc.readFiles.release(pf)
+
+	return bc.readValueFrom(pf, record)
+}
+
+// readValueFrom reads the value record points at from the open file pf,
+// then decrypts and decompresses it if needed.
+func (bc *BitCask) readValueFrom(pf *pooledFile, record Record) ([]byte, error) {
+	var data []byte
+	var err error
+	if view, ok := pf.view(record.valuePosition, record.size()); ok {
+		data = view
+		if !record.compressed() && !record.encrypted() {
+			data = append([]byte{}, view...)
 		}
-		file.Close()
-		return data, nil
+	} else if data, err = readAt(pf, record); err != nil {
+		return nil, err
 	}
+
+	if data, err = bc.cipher.openValue(record, data); err != nil {
+		return nil, err
+	}
+	if record.compressed() {
+		return decompressValue(data)
+	}
+	return data, nil
+}
+
+// readAt reads the value record points at from the open file pf.
+func readAt(pf *pooledFile, record Record) ([]byte, error) {
+	data := make([]byte, record.size())
+	n, err := pf.file.ReadAt(data, record.valuePosition)
+	if err != nil {
+		return nil, fmt.Errorf("read only " + fmt.Sprintf("%d", n) + " bytes out of " +
+						fmt.Sprintf("%d", record.size()))
+	}
+	return data, nil
 }
 
 // Put store a key and value in a bitcask datastore
 // 		sync the write if sync_on_put option is enabled.
+// returns err != nil if the synced write fails, the key keeps its old value then.
 func (bc *BitCask) Put(key, value []byte) error {
 	if key == nil || value == nil {
 		return ErrNullKeyOrValue
 	}
 
-	if !bc.config.writePermission {
-		return ErrHasNoWritePerms
+	if err := bc.checkWritable(); err != nil {
+		return err
 	}
 
+	bc.mu.Lock()
+	defer bc.unlock()
+
+	return bc.put(namespaceKey(defaultBucket, key), value)
+}
+
+// put stores value at the keydir key key, see namespaceKey, without
+// taking the bitcask lock.
+func (bc *BitCask) put(key, value []byte) error {
 	var err error
 	if !bc.config.syncOnPut {
 		if _, ok := bc.pendingWrites[string(key)]; ok {
@@ -136,11 +276,10 @@ func (bc *BitCask) Put(key, value []byte) error {
 		} else {
 			bc.loadToPendingWrites(key, value)
 		}
+		bc.recordEvent(OpPut, key, value, time.Time{})
 
-	} else {
-		item := bc.makeItem(key, value, bc.keydir[string(key)].timeStamp)
-		bc.updateKeydirRecord(key, value, bc.activeFile.Name(), int64(bc.cursor), time.Now())
-		bc.appendItemToFile(item, &bc.cursor, &bc.activeFile)
+	} else if _, err = bc.writeKeyValue(key, value); err == nil {
+		err = bc.syncActiveFile()
 	}
 	
 	return err
@@ -149,45 +288,239 @@ func (bc *BitCask) Put(key, value []byte) error {
 // Delete appends a special TombStone value, which will be removed
 // on the next merge. The key is deleted from keydir.
 // returns err == ErrNullKeyOrValue if passed nil key
-// err == ErrHasNoWritePerms if calling process has no write perms.
+// err == ErrHasNoWritePerms if calling process has no write perms
+// err == ErrFollowerIsReadOnly if the bitcask is a follower.
 func (bc *BitCask) Delete(key []byte) error {
 	if key == nil {
 		return ErrNullKeyOrValue
 	}
 
-	if !bc.config.writePermission {
-		return ErrHasNoWritePerms
+	if err := bc.checkWritable(); err != nil {
+		return err
 	}
 
-	delete(bc.pendingWrites, string(key))
+	bc.mu.Lock()
+	defer bc.unlock()
 
-	delete(bc.keydir, string(key))
+	return bc.delete(namespaceKey(defaultBucket, key))
+}
 
-	item := bc.makeItem(key, []byte(TombStone), bc.keydir[string(key)].timeStamp)
-	bc.appendItemToFile(item, &bc.cursor, &bc.activeFile)
+// delete deletes the keydir key key, see namespaceKey, without taking
+// the bitcask lock.
+func (bc *BitCask) delete(key []byte) error {
+	delete(bc.pendingWrites, string(key))
+	if err := bc.writeTombstone(key); err != nil {
+		return err
+	}
+	if bc.config.syncOnPut {
+		return bc.syncActiveFile()
+	}
 
 	return nil
 }
 
-// ListKeys lists all the keys in a Bitcask store.
-func (bc *BitCask) ListKeys() [][]byte {
-	var result [][]byte
+// GetWithTimeStamp retrieves a value by key along with the timestamp of
+// its write, which changes with every write of the key. A pending write
+// of the key is synced first so that it has a timestamp.
+// It returns the same errors as Get.
+func (bc *BitCask) GetWithTimeStamp(key []byte) ([]byte, time.Time, error) {
+	if key == nil {
+		return nil, time.Time{}, ErrNullKeyOrValue
+	}
+	key = namespaceKey(defaultBucket, key)
+
+	bc.mu.RLock()
+	if _, ok := bc.pendingWrites[string(key)]; !ok {
+		defer bc.mu.RUnlock()
+		value, err := bc.get(key)
+		record, _ := bc.keydir.get(string(key))
+		return value, record.time(), err
+	}
+	bc.mu.RUnlock()
 
-	bc.Sync()
+	bc.mu.Lock()
+	defer bc.unlock()
 
-	for key := range bc.keydir {
-		result = append(result, []byte(key))
+	bc.sync()
+	value, err := bc.get(key)
+	record, _ := bc.keydir.get(string(key))
+	return value, record.time(), err
+}
+
+// KeyInfo describes the value of a key as the keydir records it.
+type KeyInfo struct {
+	// Size is the size of the value in its data file, compressed or
+	// encrypted if the value is.
+	Size      int64
+	TimeStamp time.Time
+	// Expiry is always zero, keys don't expire.
+	Expiry time.Time
+	// File is the name of the data file holding the value and Offset
+	// the position of the value in the file.
+	File       string
+	Offset     int64
+	Compressed bool
+	Encrypted  bool
+	// Pending tells if the value is a pending write, which has no
+	// timestamp or file yet, Size is the size of the value then.
+	Pending bool
+}
+
+// Has checks if key exists, without reading its value.
+func (bc *BitCask) Has(key []byte) bool {
+	_, err := bc.Stat(key)
+	return err == nil
+}
+
+// Stat returns the description of the value of key from the keydir,
+// without reading the value. Only a lazy keydir, see Config.WithLazyKeydir,
+// reads the hint files to find the key.
+// returns err == ErrNullKeyOrValue if key is nil
+// err == ErrKeyNotExist if key doesn't exist.
+func (bc *BitCask) Stat(key []byte) (KeyInfo, error) {
+	if key == nil {
+		return KeyInfo{}, ErrNullKeyOrValue
 	}
 
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+
+	return bc.stat(namespaceKey(defaultBucket, key))
+}
+
+// stat describes the value of the keydir key key, see namespaceKey,
+// without taking the bitcask lock.
+func (bc *BitCask) stat(key []byte) (KeyInfo, error) {
+	if value, ok := bc.pendingWrites[string(key)]; ok {
+		return KeyInfo{Size: int64(len(value)), Pending: true}, nil
+	}
+
+	record, ok := bc.keydir.get(string(key))
+	if !ok {
+		return KeyInfo{}, errKeyNotExist(key)
+	}
+	return KeyInfo{
+		Size:       int64(record.size()),
+		TimeStamp:  record.time(),
+		File:       path.Base(bc.files.path(record.file)),
+		Offset:     record.valuePosition,
+		Compressed: record.compressed(),
+		Encrypted:  record.encrypted(),
+	}, nil
+}
+
+// CompareAndSwap stores value at key only if the timestamp of the key's
+// current value equals timeStamp, or if the key doesn't exist when
+// timeStamp is zero. The write is synced to disk and its timestamp is returned.
+// returns err == ErrTimeStampMismatch if the key was changed.
+func (bc *BitCask) CompareAndSwap(key, value []byte, timeStamp time.Time) (time.Time, error) {
+	if key == nil || value == nil {
+		return time.Time{}, ErrNullKeyOrValue
+	}
+	key = namespaceKey(defaultBucket, key)
+
+	if err := bc.checkWritable(); err != nil {
+		return time.Time{}, err
+	}
+
+	bc.mu.Lock()
+	defer bc.unlock()
+
+	if err := bc.sync(); err != nil {
+		return time.Time{}, err
+	}
+	if !bc.matchTimeStamp(key, timeStamp) {
+		return time.Time{}, ErrTimeStampMismatch
+	}
+
+	tStamp, err := bc.writeKeyValue(key, value)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return tStamp, bc.syncActiveFile()
+}
+
+// CompareAndDelete deletes key only if the timestamp of its current
+// value equals timeStamp.
+// returns err == ErrTimeStampMismatch if the key was changed or doesn't exist.
+func (bc *BitCask) CompareAndDelete(key []byte, timeStamp time.Time) error {
+	if key == nil {
+		return ErrNullKeyOrValue
+	}
+	key = namespaceKey(defaultBucket, key)
+
+	if err := bc.checkWritable(); err != nil {
+		return err
+	}
+
+	bc.mu.Lock()
+	defer bc.unlock()
+
+	if err := bc.sync(); err != nil {
+		return err
+	}
+	if timeStamp.IsZero() || !bc.matchTimeStamp(key, timeStamp) {
+		return ErrTimeStampMismatch
+	}
+	if err := bc.writeTombstone(key); err != nil {
+		return err
+	}
+
+	return bc.syncActiveFile()
+}
+
+// ListKeys lists all the keys in a Bitcask store, the keys of the
+// buckets aren't listed.
+func (bc *BitCask) ListKeys() [][]byte {
+	bc.mu.Lock()
+	defer bc.unlock()
+
+	bc.sync()
+
+	return bc.listKeys(defaultBucket)
+}
+
+// listKeys lists the keys of bucket without taking the bitcask lock.
+func (bc *BitCask) listKeys(bucket uint32) [][]byte {
+	var result [][]byte
+	bc.keydir.each(func(key string, record Record) {
+		if b, k := splitNamespaceKey(key); b == bucket {
+			result = append(result, []byte(k))
+		}
+	})
+
 	return result
 }
 
-// Fold folds over all key/value pairs in a bitcask datastore.
+// Fold folds over all key/value pairs in a bitcask datastore, the
+// pairs of the buckets aren't folded.
 // fn is expected to be closure in the form: F(K, V, Acc) -> Acc
+// fn is called without holding the bitcask lock, so it may use the bitcask.
 func (bc *BitCask) Fold(fn func([]byte, []byte, any) any, acc any) any {
-	for key := range bc.keydir {
-		value, _ := bc.Get([]byte(key))
-		acc = fn([]byte(key), value, acc)
+	return bc.fold(defaultBucket, fn, acc)
+}
+
+// fold folds over the key/value pairs of bucket like Fold.
+func (bc *BitCask) fold(bucket uint32, fn func([]byte, []byte, any) any, acc any) any {
+	bc.mu.RLock()
+	keys := make([]string, 0, bc.keydir.len())
+	bc.keydir.each(func(key string, record Record) {
+		if b, _ := splitNamespaceKey(key); b == bucket {
+			keys = append(keys, key)
+		}
+	})
+	bc.mu.RUnlock()
+
+	for _, key := range keys {
+		bc.mu.RLock()
+		value, err := bc.get([]byte(key))
+		bc.mu.RUnlock()
+		if err != nil {
+			continue
+		}
+		_, k := splitNamespaceKey(key)
+		acc = fn([]byte(k), value, acc)
 	}
 
 	return acc
@@ -195,50 +528,37 @@ func (bc *BitCask) Fold(fn func([]byte, []byte, any) any, acc any) any {
 
 // Merge merges several data files within a Bitcask datastore into
 // a more compact form and deletes old files.
+// Items keep their original timestamps. Tombstones are dropped unless
+// a file left out of the merge could still hold an older value of the key.
 // All pending writes are synced to disk before merge happens.
+// Only the immutable files picked by the merge policy are merged, see
+// MergePolicy. Merge works on the files picked when it starts, so
+// reads and writes carry on while the merged files are written. Keydir
+// entries are only moved to the merged files if they weren't updated
+// in the meantime.
 // returns err == ErrHasNoWritePerms if the calling process has no
 // write permissions.
 func (bc *BitCask) Merge() error {
 	if !bc.config.writePermission {
 		return ErrHasNoWritePerms
 	}
-	
-	var currentCursorPos int64 = 0
-	newFilesSet := make(map[string]void)
-	mergeFile := newFile(bc.dirName)
-	var newKeydir Keydir = make(Keydir)
-
-	bc.Sync()
-
-	for key, record := range bc.keydir {
-		if record.fileId != bc.activeFile.Name() {
-			tStamp := time.Now()
-			value, _ := bc.Get([]byte(key))
-			
-			fileItem := bc.makeItem([]byte(key), value, tStamp)
-			itemBegin := bc.appendItemToFile(fileItem, &currentCursorPos, &mergeFile)
-			newFilesSet[mergeFile.Name()] = member
-			newKeydir[key] = Record {
-				fileId: mergeFile.Name(),
-				valueSize: len(value),
-				valuePosition: int64(itemBegin + int64(16) + int64(len(key))),
-				timeStamp: tStamp,
-			}
-		} else {
-			newKeydir[key] = bc.keydir[key]
-			newFilesSet[record.fileId] = member
-		}
-	}
-	bc.keydir = newKeydir
 
-	bc.deleteOldFiles(newFilesSet)
+	bc.mergeMu.Lock()
+	defer bc.mergeMu.Unlock()
 
-	return nil
+	start := time.Now()
+	bc.mu.Lock()
+	bc.sync()
+	set := bc.freezeFiles(bc.selectMergeFiles(bc.config.policy()))
+	bc.unlock()
+
+	return bc.merge(set, start)
 }
 
 // Sync forces any pending writes to sync to disk.
 // It returns err ==  ErrHasNoWritePerms if the calling process
-// has no write permissions.
+// has no write permissions, or the error of writing to disk. The
+// pending writes that couldn't be written are kept to be synced again.
 // After the append completes, an in-memory structure called
 // ”keydir” is updated.
 // When the active file meets a size threshold MaxFileSize,
@@ -248,10 +568,28 @@ func (bc *BitCask) Sync() error {
 		return ErrHasNoWritePerms
 	}
 
+	bc.mu.Lock()
+	defer bc.unlock()
+
+	if err := bc.sync(); err != nil {
+		return err
+	}
+
+	return bc.syncActiveFile()
+}
+
+// sync writes pending writes to the active file without taking the
+// bitcask lock.
+func (bc *BitCask) sync() error {
+	if !bc.config.writePermission {
+		return ErrHasNoWritePerms
+	}
+
+	// the events of the pending writes were sent by Put.
 	for key := range bc.pendingWrites {
-		item := bc.makeItem([]byte(key), bc.pendingWrites[key], bc.keydir[string(key)].timeStamp)
-		bc.updateKeydirRecord([]byte(key), bc.pendingWrites[key], bc.activeFile.Name(), int64(bc.cursor), time.Now())
-		bc.appendItemToFile(item, &bc.cursor, &bc.activeFile)
+		if err := bc.appendItem([]byte(key), bc.pendingWrites[key], bc.now()); err != nil {
+			return err
+		}
 		delete(bc.pendingWrites, key)
 	}
 
@@ -259,14 +597,37 @@ func (bc *BitCask) Sync() error {
 }
 
 // Close flushes all pending writes into disk, merges old files,
-// removes read/write locks, builds keydir file and closes the bitcask datastore.
+// removes read/write locks, builds keydir file, closes the watchers
+// and closes the bitcask datastore.
+// If the background merger is enabled, it is stopped and old files
+// are left for it to merge on the next run.
 func (bc *BitCask) Close() {
+	if bc.config.autoMerge && bc.config.writePermission {
+		close(bc.stopMerge)
+		bc.mergeWg.Wait()
+	}
+
 	if bc.config.writePermission {
 		bc.Sync()
+		if !bc.config.autoMerge {
+			bc.Merge()
+		}
+
+	}
+
+	bc.mu.Lock()
+	if bc.config.writePermission {
+		bc.syncActiveFile()
 		bc.activeFile.Close()
-		bc.Merge()
 		bc.buildKeydirFile()
 	}
+	if bc.config.follower {
+		bc.saveReplicationPosition()
+	}
+	close(bc.closed)
+	bc.unlock()
+	bc.closeWatchers()
+	bc.readFiles.close()
 
-	os.Remove(path.Join(bc.dirName, bc.lock))
+	bc.fs.Remove(path.Join(bc.dirName, bc.lock))
 }
\ No newline at end of file
@@ -2,9 +2,11 @@ package bitcask
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"hash/crc32"
+	"io"
 	"os"
 	"path"
 	"strconv"
@@ -14,21 +16,44 @@ import (
 
 
 // new creates a new bitcask object.
-func new(directoryPath string, config Config, lock string) *BitCask {
-	var file *os.File
-	var keydir Keydir
+// returns err == ErrEncrypted or err == ErrDecryptionFailed if the
+// bitcask is encrypted with another key than the config's.
+func new(directoryPath string, config Config, lock string) (*BitCask, error) {
+	var file File
 	var keydirData []byte
+	fsys := config.fileSystem()
+	keydir := newKeyIndex(config.compactKeydir)
+	files := newFileTable()
 
-	if config.writePermission {
-		file = newFile(directoryPath)
+	itemCipher, err := newItemCipher(config.keyProvider)
+	if err != nil {
+		return nil, err
 	}
-	
 
-	keydirData, err := os.ReadFile(path.Join(directoryPath, keydirFileName))
+	var oldest map[string]time.Time
+	keydirPath := path.Join(directoryPath, keydirFileName)
+	if config.lazyKeydir && !config.writePermission {
+		keydir.lazy, err = openLazyKeydir(fsys, itemCipher, directoryPath, files)
+	} else if keydirData, err = readFile(fsys, keydirPath); err != nil {
+		oldest, err = recoverKeydir(fsys, itemCipher, directoryPath, files, keydir)
+	} else if keydirData, err = itemCipher.openData(keydirPath, keydirData); err == nil {
+		parseKeydirData(string(keydirData), files, keydir)
+	}
 	if err != nil {
-		keydir = Keydir{}
-	} else {
-		keydir = parseKeydirData(string(keydirData))
+		return nil, err
+	}
+
+	if config.writePermission {
+		if file = newFile(fsys, directoryPath); file == nil {
+			return nil, fmt.Errorf("can't create data file in %s", directoryPath)
+		}
+	}
+
+	// the keydir file goes stale with the first write, so a writer
+	// removes it and writes it again on Close. if the writer crashes
+	// the next process recovers the keydir from the data files.
+	if config.writePermission {
+		fsys.Remove(path.Join(directoryPath, keydirFileName))
 	}
 
 	bc := &BitCask{
@@ -36,33 +61,63 @@ func new(directoryPath string, config Config, lock string) *BitCask {
 		lock: lock,
 		cursor: 0,
 		dirName: directoryPath,
+		fs: fsys,
+		readFiles: newFilePool(fsys, config.openFiles(), config.mmap),
 		keydir: keydir,
+		files: files,
+		cipher: itemCipher,
+		buckets: make(map[string]bucketRef),
 		config: config,
 		pendingWrites: make(map[string][]byte),
+		stopMerge: make(chan void),
+		appended: make(chan void),
+		closed: make(chan void),
+		logTruncatedAt: loadLogTruncation(fsys, directoryPath),
+	}
+	// the keys of dropped buckets are dead, the file stats count them so.
+	if keydir.lazy == nil {
+		bc.forgetDroppedBuckets()
+	}
+	bc.loadFileStats()
+	for fileId, timeStamp := range oldest {
+		bc.statOf(fileId).oldest = timeStamp
+	}
+	if config.follower {
+		bc.replicationPos = loadReplicationPosition(fsys, directoryPath)
 	}
 
-	return bc
+	return bc, nil
 }
 
 // buildKeydirFile builds the keydir file format from the process's keydir records.
 // coming processes after this process finish writing will parse this file to build
 // keydir object in memory.
 func (bc *BitCask) buildKeydirFile() {
-	keyDirFile, _ := os.Create(path.Join(bc.dirName, keydirFileName))
+	writeKeydirFile(bc.fs, bc.cipher, bc.dirName, bc.files, bc.keydir)
+}
 
-	for key, record := range bc.keydir {
-		valueSize := strconv.Itoa(record.valueSize)
+// writeKeydirFile writes the keydir records into the keydir file at directoryPath,
+// encrypted with itemCipher. The file is replaced at once, so a crash never
+// leaves half of it behind.
+func writeKeydirFile(fsys FS, itemCipher *itemCipher, directoryPath string, files *fileTable, keydir *keyIndex) {
+	var keyDirFile bytes.Buffer
+
+	keydir.each(func(key string, record Record) {
+		valueSize := strconv.Itoa(int(record.valueSize))
 		valuePos := strconv.Itoa(int(record.valuePosition))
-		t := record.timeStamp.Format(time.RFC3339)
+		t := record.time().Format(time.RFC3339Nano)
 
-		line := key + " " + record.fileId + " " + valueSize + " " + valuePos + " " + t
-		fmt.Fprintln(keyDirFile, line)
-	}
+		line := key + " " + files.path(record.file) + " " + valueSize + " " + valuePos + " " + t
+		fmt.Fprintln(&keyDirFile, line)
+	})
+
+	keydirPath := path.Join(directoryPath, keydirFileName)
+	replaceFile(fsys, keydirPath, itemCipher.sealData(keydirPath, keyDirFile.Bytes()))
 }
 
-// parseKeydirData parses keydir file to build keydir object
-func parseKeydirData(keydirData string) Keydir {
-	var keydir Keydir = Keydir{}
+// parseKeydirData parses keydir file into keydir, giving its data files
+// ids from files.
+func parseKeydirData(keydirData string, files *fileTable, keydir *keyIndex) {
 	var vSz int
 	var vPos int
 	var t time.Time
@@ -78,56 +133,97 @@ func parseKeydirData(keydirData string) Keydir {
 		vPos, _ = strconv.Atoi(keyAndValue[3])
 		t, _ = time.Parse(time.RFC3339, keyAndValue[4])
 		
-		keydir[key] = Record{
-			fileId: fileId,
-			valueSize: vSz,
+		keydir.set(key, Record{
+			file: files.id(fileId),
+			valueSize: uint32(vSz),
 			valuePosition: int64(vPos),
-			timeStamp: t,
-		}
+			timeStamp: t.UnixMicro(),
+		})
 	}
-
-	return keydir
 }
 
 // newFile creates new file to be used as active or merge file.
-// the name of the file is specified by the time.Now().UnixMicro() function.
-func newFile(directoryPath string) (*os.File){
-	var file *os.File
-	filename := fmt.Sprintf("%d" + BitCaskFileExtension, time.Now().UnixMicro())
-
-	file, _ = os.OpenFile(path.Join(directoryPath, filename), 
-							os.O_CREATE | os.O_RDWR, 
-							UserReadWrite)
+// the name of the file is specified by the time.Now().UnixMicro() function,
+// moved forward if a file with this name already exists.
+func newFile(fsys FS, directoryPath string) (File){
+	var file File
+	var err error
+	id := time.Now().UnixMicro()
+
+	for {
+		filename := fmt.Sprintf("%d" + BitCaskFileExtension, id)
+		file, err = fsys.OpenFile(path.Join(directoryPath, filename),
+								os.O_CREATE | os.O_EXCL | os.O_RDWR,
+								UserReadWrite)
+		if !os.IsExist(err) {
+			break
+		}
+		id++
+	}
 
 	return file
 }
 
 
-// isExist checks if the key exist in keydir
+// now returns the current time, moved past the last timestamp it
+// returned so that later writes always get later timestamps.
+func (bc *BitCask) now() time.Time {
+	t := time.Now().Truncate(time.Microsecond)
+	if !t.After(bc.lastTimeStamp) {
+		t = bc.lastTimeStamp.Add(time.Microsecond)
+	}
+	bc.lastTimeStamp = t
+
+	return t
+}
+
+// isExist checks if the key exist in keydir, the returned error
+// wraps ErrKeyNotExist.
 func (bc *BitCask) isExist(key []byte) error {
-	if _, ok := bc.keydir[string(key)]; !ok {
-		return BitCaskError(fmt.Sprintf("%q: %s", string(key), ErrKeyNotExist.Error()))
+	if _, ok := bc.keydir.get(string(key)); !ok {
+		return errKeyNotExist(key)
 	}
 	return nil
 }
 
+// errKeyNotExist returns the error of the missing keydir key key, which
+// names the key of its namespace.
+func errKeyNotExist(key []byte) error {
+	_, k := splitNamespaceKey(string(key))
+	return fmt.Errorf("%q: %w", k, ErrKeyNotExist)
+}
+
 // loadToPendingWrites load key and value to pending wirtes memory
 func (bc *BitCask) loadToPendingWrites(key, value []byte) {
 	
 	bc.pendingWrites[string(key)] = value
 }
 
-// makeItem creates an bitcask file item 
+// makeItem creates an bitcask file item, its value is compressed if
+// the config asks for it and that makes it smaller, then its key and
+// value are encrypted if the bitcask is encrypted.
 func (bc *BitCask) makeItem(key, value []byte, timeStamp time.Time) []byte {
-	tStamp := uint32(timeStamp.UnixMicro())
+	tStamp := uint64(timeStamp.UnixMicro())
+	var flags uint32
+
+	if bc.config.compression && string(value) != TombStone {
+		if compressed, ok := compressValue(value); ok {
+			value = compressed
+			flags |= compressedValueFlag
+		}
+	}
+	if bc.cipher != nil {
+		key, value = bc.cipher.sealItem(key, value, int64(tStamp))
+		flags |= encryptedValueFlag
+	}
 	keySize := uint32(len(key))
 	valueSize := uint32(len(value))
 
-	item := make([]byte, 16, 16+keySize+valueSize)
+	item := make([]byte, itemHeaderSize, itemHeaderSize+keySize+valueSize)
 
-	binary.BigEndian.PutUint32(item[4:], tStamp)
-	binary.BigEndian.PutUint32(item[8:], keySize)
-	binary.BigEndian.PutUint32(item[12:], valueSize)
+	binary.BigEndian.PutUint64(item[4:], tStamp)
+	binary.BigEndian.PutUint32(item[12:], keySize)
+	binary.BigEndian.PutUint32(item[16:], valueSize|flags)
 
 	item = append(item, key...)
 	item = append(item, value...)
@@ -138,47 +234,309 @@ func (bc *BitCask) makeItem(key, value []byte, timeStamp time.Time) []byte {
 	return item
 }
 
-// updateKeydirRecord updates keydir at specific key
-func (bc *BitCask) updateKeydirRecord (key, value []byte, fileName string, currentCursorPos int64, tStamp time.Time) {
-	bc.keydir[string(key)] = Record {
-		fileId: fileName,
-		valueSize: len(value),
-		valuePosition: int64(currentCursorPos + 16 + int64(len(key))),
-		timeStamp: tStamp,
+// fileItem is a decoded item of a bitcask data file.
+type fileItem struct {
+	raw []byte
+	timeStamp time.Time
+	key []byte
+	value []byte
+	compressed bool
+	// encrypted tells if the item is encrypted, its key and value are
+	// only decrypted by scanItems.
+	encrypted bool
+}
+
+// isTombstone checks if the item marks its key as deleted.
+func (item fileItem) isTombstone() bool {
+	return !item.compressed && string(item.value) == TombStone
+}
+
+// validCRC checks if the crc stored in the item matches its content.
+func (item fileItem) validCRC() bool {
+	return crc32.ChecksumIEEE(item.raw[4:]) == binary.BigEndian.Uint32(item.raw)
+}
+
+// valuePosition returns the position of the value of the item read at
+// offset, the key before it may be stored encrypted.
+func (item fileItem) valuePosition(offset int64) int64 {
+	return offset + int64(len(item.raw)) - int64(item.valueSizeField()&^valueSizeFlags)
+}
+
+// decodeItem reads the next item from r without checking its crc.
+// returns err == io.EOF if there are no more items
+// err == ErrCorruptItem if the item is truncated.
+func decodeItem(r io.Reader) (fileItem, error) {
+	header := make([]byte, itemHeaderSize)
+	if n, err := io.ReadFull(r, header); err != nil {
+		if n == 0 && err == io.EOF {
+			return fileItem{}, io.EOF
+		}
+		return fileItem{}, ErrCorruptItem
+	}
+
+	keySize := int64(binary.BigEndian.Uint32(header[12:]))
+	valueSizeField := binary.BigEndian.Uint32(header[16:])
+	valueSize := int64(valueSizeField &^ valueSizeFlags)
+
+	// the buffer grows as data arrives, so corrupted sizes can't
+	// make it allocate more than what's left in r.
+	buf := bytes.NewBuffer(header)
+	if n, _ := io.CopyN(buf, r, keySize+valueSize); n != keySize+valueSize {
+		return fileItem{}, ErrCorruptItem
+	}
+	raw := buf.Bytes()
+
+	return fileItem{
+		raw: raw,
+		timeStamp: time.UnixMicro(int64(binary.BigEndian.Uint64(raw[4:]))),
+		key: raw[itemHeaderSize : itemHeaderSize+keySize],
+		value: raw[itemHeaderSize+keySize:],
+		compressed: valueSizeField&compressedValueFlag != 0,
+		encrypted: valueSizeField&encryptedValueFlag != 0,
+	}, nil
+}
+
+// readItem reads the next item from r and checks its crc.
+// returns err == io.EOF if there are no more items
+// err == ErrCorruptItem if the item is truncated or its crc doesn't match.
+func readItem(r io.Reader) (fileItem, error) {
+	item, err := decodeItem(r)
+	if err == nil && !item.validCRC() {
+		return fileItem{}, ErrCorruptItem
+	}
+
+	return item, err
+}
+
+// scanItems calls fn for every item of the data file fileId with
+// the offset the item begins at, decrypted with itemCipher.
+func scanItems(fsys FS, itemCipher *itemCipher, fileId string, fn func(item fileItem, offset int64) error) error {
+	file, err := openFile(fsys, fileId)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+
+	for {
+		item, err := readItem(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err == nil {
+			err = itemCipher.openItem(&item)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := fn(item, offset); err != nil {
+			return err
+		}
+		offset += int64(len(item.raw))
+	}
+}
+
+// writeKeyValue appends an item of key and value to the active file,
+// points keydir at it and returns the item's timestamp.
+func (bc *BitCask) writeKeyValue(key, value []byte) (time.Time, error) {
+	tStamp := bc.now()
+	return tStamp, bc.writeItem(key, value, tStamp)
+}
+
+// writeItem appends an item of key and value written at tStamp to the
+// active file and points keydir at it. keydir is left untouched if the
+// item can't be written.
+func (bc *BitCask) writeItem(key, value []byte, tStamp time.Time) error {
+	if err := bc.appendItem(key, value, tStamp); err != nil {
+		return err
+	}
+	bc.recordEvent(OpPut, key, value, tStamp)
+
+	return nil
+}
+
+// appendItem is writeItem without the event of the write.
+func (bc *BitCask) appendItem(key, value []byte, tStamp time.Time) error {
+	item := bc.makeItem(key, value, tStamp)
+	itemPos, err := bc.appendToActiveFile(item)
+	if err != nil {
+		return err
+	}
+	valueSize := binary.BigEndian.Uint32(item[16:])
+	valuePos := itemPos + int64(len(item)) - int64(valueSize&^valueSizeFlags)
+	bc.updateKeydirRecord(key, valueSize, bc.activeFile.Name(), valuePos, tStamp)
+	bc.signalAppend()
+
+	return nil
+}
+
+// writeTombstone appends a tombstone of key to the active file and
+// removes the key from keydir.
+func (bc *BitCask) writeTombstone(key []byte) error {
+	return bc.writeTombstoneAt(key, bc.now())
+}
+
+// writeTombstoneAt appends a tombstone of key written at tStamp to the
+// active file and removes the key from keydir. keydir is left untouched
+// if the tombstone can't be written.
+func (bc *BitCask) writeTombstoneAt(key []byte, tStamp time.Time) error {
+	item := bc.makeItem(key, []byte(TombStone), tStamp)
+	if _, err := bc.appendToActiveFile(item); err != nil {
+		return err
+	}
+
+	if record, ok := bc.keydir.get(string(key)); ok {
+		bc.markDead(string(key), record)
 	}
+	bc.keydir.remove(string(key))
+
+	// the tombstone itself is never live
+	stat := bc.statOf(bc.activeFile.Name())
+	stat.addTimestamp(tStamp)
+	stat.deadBytes += int64(len(item))
+	bc.signalAppend()
+	bc.recordEvent(OpDelete, key, nil, tStamp)
+
+	return nil
+}
+
+// signalAppend wakes up the replica servers waiting for new items.
+func (bc *BitCask) signalAppend() {
+	close(bc.appended)
+	bc.appended = make(chan void)
 }
 
-// appendItemToFile appends item to bitcask file
-func (bc *BitCask) appendItemToFile(item []byte, currentCursorPos *int64, file **os.File) int64 {
+// checkWritable checks if the calling process may write key/value
+// pairs to the bitcask.
+func (bc *BitCask) checkWritable() error {
+	if !bc.config.writePermission {
+		return ErrHasNoWritePerms
+	}
+	if bc.config.follower {
+		return ErrFollowerIsReadOnly
+	}
+
+	return nil
+}
+
+// matchTimeStamp checks if the current value of key was written at
+// timeStamp, a zero timeStamp matches a key that doesn't exist.
+func (bc *BitCask) matchTimeStamp(key []byte, timeStamp time.Time) bool {
+	record, ok := bc.keydir.get(string(key))
+	if timeStamp.IsZero() {
+		return !ok
+	}
+
+	return ok && record.time().Equal(timeStamp)
+}
+
+// updateKeydirRecord updates keydir at specific key and moves the
+// replaced item, if any, to the dead bytes of its file. valueSize is
+// the value size field of the item header.
+func (bc *BitCask) updateKeydirRecord (key []byte, valueSize uint32, fileName string, valuePos int64, tStamp time.Time) {
+	if old, ok := bc.keydir.get(string(key)); ok {
+		bc.markDead(string(key), old)
+	}
+	bc.statOf(fileName).addTimestamp(tStamp)
+
+	record := Record {
+		file: bc.files.id(fileName),
+		valueSize: valueSize,
+		valuePosition: valuePos,
+		timeStamp: tStamp.UnixMicro(),
+	}
+	bc.keydir.set(string(key), record)
+	bc.markLive(string(key), record)
+}
+
+// appendItemToFile appends item to bitcask file. A full file is synced
+// to disk before it's closed, since it's never written again.
+// returns err != nil if the item couldn't be written completely.
+func (bc *BitCask) appendItemToFile(item []byte, currentCursorPos *int64, file *File) (int64, error) {
 	if int64(len(item)) + (*currentCursorPos) > MaxFileSize {
+		if err := (*file).Sync(); err != nil {
+			return 0, err
+		}
+		next := newFile(bc.fs, bc.dirName)
+		if next == nil {
+			return 0, fmt.Errorf("can't create data file in %s", bc.dirName)
+		}
 		(*file).Close()
 
-		*file = newFile(bc.dirName)
+		*file = next
 		*currentCursorPos = 0
 	}
 	valuePosition := *currentCursorPos
-	n, _ := (*file).Write(item)
+	n, err := (*file).Write(item)
 	*currentCursorPos += int64(n)
 
-	return valuePosition
+	return valuePosition, err
 }
 
-// deleteOldFiles delete unneeded files remains after merge process
-func (bc *BitCask) deleteOldFiles(newFilesSet map[string] void) {
-	bitcaskDirectory, _ := os.Open(bc.dirName)
-	files, _ := bitcaskDirectory.Readdir(0)
-
-	for _, fileInfo := range files {
-		if _, ok := newFilesSet[bc.dirName+"/"+fileInfo.Name()]; !ok {
-			os.Remove(bc.dirName+"/"+fileInfo.Name())
+// appendToActiveFile appends item to the active file. If the item can't
+// be written completely, the active file is replaced by a new one, so
+// that the items written later don't follow a torn item.
+func (bc *BitCask) appendToActiveFile(item []byte) (int64, error) {
+	previous := bc.activeFile.Name()
+	itemPos, err := bc.appendItemToFile(item, &bc.cursor, &bc.activeFile)
+	if err != nil && bc.cursor > itemPos {
+		if next := newFile(bc.fs, bc.dirName); next != nil {
+			bc.activeFile.Close()
+			bc.activeFile = next
+			bc.cursor = 0
 		}
 	}
+	// the full file is opened again by the next read, to map all of it.
+	if bc.activeFile.Name() != previous {
+		bc.readFiles.remove(previous)
+	}
+
+	return itemPos, err
+}
+
+// startActiveFile replaces the active file by a new one, leaving the
+// previous one immutable.
+func (bc *BitCask) startActiveFile() error {
+	next := newFile(bc.fs, bc.dirName)
+	if next == nil {
+		return fmt.Errorf("can't create data file in %s", bc.dirName)
+	}
+	previous := bc.activeFile.Name()
+	bc.activeFile.Close()
+	bc.activeFile = next
+	bc.cursor = 0
+	bc.readFiles.remove(previous)
+
+	return nil
+}
+
+// syncActiveFile flushes the active file to disk.
+func (bc *BitCask) syncActiveFile() error {
+	if bc.activeFile == nil {
+		return nil
+	}
+	return bc.activeFile.Sync()
+}
+
+// deleteOldFiles deletes the data files that remain after merge process
+// along with their hint, bloom and merge output marker files.
+func (bc *BitCask) deleteOldFiles(oldFiles []string) {
+	for _, fileId := range oldFiles {
+		bc.readFiles.remove(fileId)
+		bc.files.forget(fileId)
+		bc.fs.Remove(fileId)
+		bc.fs.Remove(hintFileName(fileId))
+		bc.fs.Remove(bloomFileName(fileId))
+		bc.fs.Remove(mergedFileName(fileId))
+	}
 }
 
 // checkLock checks the existance of read/write lock
-func checkLock(dirName string) processAccess {
-	bitcaskDirectory, _ := os.Open(dirName)
-	files, _ := bitcaskDirectory.Readdir(0)
+func checkLock(fsys FS, dirName string) processAccess {
+	files, _ := fsys.ReadDir(dirName)
 
 	for _, fileInfo := range files {
 		if strings.HasPrefix(fileInfo.Name(), readLock) {
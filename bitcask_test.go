@@ -3,6 +3,7 @@ package bitcask
 import (
 	"fmt"
 	"os"
+	"path"
 	"reflect"
 	"strconv"
 	"testing"
@@ -159,7 +160,7 @@ func TestGet(t *testing.T) {
 
 	t.Run("data in pending writes", func(t *testing.T) {
         bc, _ := Open(testBitcaskPath, syncConfig)
-        bc.keydir["name"] = Record{}
+        bc.keydir.set("name", Record{})
         bc.pendingWrites["name"] = []byte("salah")
         got, _ := bc.Get([]byte("name"))
         want := "salah"
@@ -177,12 +178,12 @@ func TestGet(t *testing.T) {
         file.Write(bc.makeItem([]byte("key"), []byte("value"), time.Now()))
 
 
-        bc.keydir["key"] = Record {
-            fileId:  testFilePath,
-            valueSize: len("value"),
-            valuePosition:  int64(16 + len("key")),
-            timeStamp:  time.Now(),
-        }
+        bc.keydir.set("key", Record {
+            file:  bc.files.id(testFilePath),
+            valueSize: uint32(len("value")),
+            valuePosition:  int64(itemHeaderSize + len("key")),
+            timeStamp:  time.Now().UnixMicro(),
+        })
 
         got, _ := bc.Get([]byte("key"))
         want := "value"
@@ -199,12 +200,12 @@ func TestGet(t *testing.T) {
         file.Write(bc.makeItem([]byte("key"), []byte("value"), time.Now()))
 
 
-        bc.keydir["key"] = Record {
-            fileId:  testFilePath,
+        bc.keydir.set("key", Record {
+            file:  bc.files.id(testFilePath),
             valueSize: 8,   // invalid value size
-            valuePosition:  int64(16 + len("key")),
-            timeStamp:  time.Now(),
-        }
+            valuePosition:  int64(itemHeaderSize + len("key")),
+            timeStamp:  time.Now().UnixMicro(),
+        })
 
         _, err := bc.Get([]byte("key"))
         want := fmt.Errorf("read only 5 bytes out of 8")
@@ -221,12 +222,12 @@ func TestGet(t *testing.T) {
         file.Write(bc.makeItem([]byte("key"), []byte("value"), time.Now()))
 
 
-        bc.keydir["key"] = Record {
-            fileId:  "invalid file id",
-            valueSize: len("value"),
-            valuePosition:  int64(16 + len("key")),
-            timeStamp:  time.Now(),
-        }
+        bc.keydir.set("key", Record {
+            file:  bc.files.id("invalid file id"),
+            valueSize: uint32(len("value")),
+            valuePosition:  int64(itemHeaderSize + len("key")),
+            timeStamp:  time.Now().UnixMicro(),
+        })
 
         _, err := bc.Get([]byte("key"))
         want := BitCaskError("can't open file: invalid file id")
@@ -469,6 +470,170 @@ func TestSync(t *testing.T) {
 
 
 
+func TestCompareAndSwap(t *testing.T) {
+	t.Run("has no write permissions", func(t *testing.T) {
+		bc, _ := Open(testBitcaskPath)
+		_, err := bc.CompareAndSwap([]byte("key"), []byte("value"), time.Time{})
+
+		assertErrorMsg(t, err, ErrHasNoWritePerms)
+		os.RemoveAll(testBitcaskPath)
+	})
+
+	t.Run("swap with current timestamp", func(t *testing.T) {
+		bc, _ := Open(testBitcaskPath, RWConfig)
+		bc.Put([]byte("name"), []byte("salah"))
+		_, tStamp, _ := bc.GetWithTimeStamp([]byte("name"))
+
+		newTStamp, err := bc.CompareAndSwap([]byte("name"), []byte("ahmed"), tStamp)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		got, gotTStamp, _ := bc.GetWithTimeStamp([]byte("name"))
+
+		assertEqualStrings(t, string(got), "ahmed")
+		if !gotTStamp.Equal(newTStamp) || !newTStamp.After(tStamp) {
+			t.Errorf("got timestamp %v, want %v after %v", gotTStamp, newTStamp, tStamp)
+		}
+		os.RemoveAll(testBitcaskPath)
+	})
+
+	t.Run("swap with old timestamp", func(t *testing.T) {
+		bc, _ := Open(testBitcaskPath, RWsyncConfig)
+		bc.Put([]byte("name"), []byte("salah"))
+		_, tStamp, _ := bc.GetWithTimeStamp([]byte("name"))
+		bc.Put([]byte("name"), []byte("ahmed"))
+
+		_, err := bc.CompareAndSwap([]byte("name"), []byte("mohamed"), tStamp)
+		got, _ := bc.Get([]byte("name"))
+
+		assertErrorMsg(t, err, ErrTimeStampMismatch)
+		assertEqualStrings(t, string(got), "ahmed")
+		os.RemoveAll(testBitcaskPath)
+	})
+
+	t.Run("zero timestamp only creates keys", func(t *testing.T) {
+		bc, _ := Open(testBitcaskPath, RWsyncConfig)
+		_, err := bc.CompareAndSwap([]byte("name"), []byte("salah"), time.Time{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		_, err = bc.CompareAndSwap([]byte("name"), []byte("ahmed"), time.Time{})
+		assertErrorMsg(t, err, ErrTimeStampMismatch)
+		os.RemoveAll(testBitcaskPath)
+	})
+
+	t.Run("compare and delete", func(t *testing.T) {
+		bc, _ := Open(testBitcaskPath, RWsyncConfig)
+		bc.Put([]byte("name"), []byte("salah"))
+		_, tStamp, _ := bc.GetWithTimeStamp([]byte("name"))
+
+		assertErrorMsg(t, bc.CompareAndDelete([]byte("name"), tStamp.Add(-time.Second)), ErrTimeStampMismatch)
+		if err := bc.CompareAndDelete([]byte("name"), tStamp); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		_, err := bc.Get([]byte("name"))
+		assertErrorMsg(t, err, BitCaskError("\"name\": key doesn't exist"))
+		os.RemoveAll(testBitcaskPath)
+	})
+}
+
+func TestHasAndStat(t *testing.T) {
+	t.Run("missing and nil keys", func(t *testing.T) {
+		bc, _ := Open(testBitcaskPath, RWsyncConfig)
+		if bc.Has([]byte("name")) {
+			t.Error("has a key that was never written")
+		}
+
+		_, err := bc.Stat([]byte("name"))
+		assertErrorMsg(t, err, BitCaskError("\"name\": key doesn't exist"))
+		_, err = bc.Stat(nil)
+		assertErrorMsg(t, err, ErrNullKeyOrValue)
+
+		bc.Put([]byte("name"), []byte("salah"))
+		bc.Delete([]byte("name"))
+		if bc.Has([]byte("name")) {
+			t.Error("has a deleted key")
+		}
+		os.RemoveAll(testBitcaskPath)
+	})
+
+	t.Run("missing bucket key", func(t *testing.T) {
+		bc, _ := Open(testBitcaskPath, RWsyncConfig.WithFS(NewMemFS()))
+		defer bc.Close()
+		bc.Bucket("users").Put([]byte("name"), []byte("salah"))
+
+		_, err := bc.Bucket("users").Stat([]byte("age"))
+		assertErrorMsg(t, err, BitCaskError("\"age\": key doesn't exist"))
+	})
+
+	t.Run("pending write", func(t *testing.T) {
+		bc, _ := Open(testBitcaskPath, RWConfig)
+		bc.Put([]byte("name"), []byte("salah"))
+
+		info, err := bc.Stat([]byte("name"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !info.Pending || info.Size != 5 || info.File != "" {
+			t.Errorf("got %+v, want a pending value of 5 bytes", info)
+		}
+		os.RemoveAll(testBitcaskPath)
+	})
+
+	t.Run("stat matches the stored item", func(t *testing.T) {
+		bc, _ := Open(testBitcaskPath, RWsyncConfig)
+		bc.Put([]byte("name"), []byte("salah"))
+		_, tStamp, _ := bc.GetWithTimeStamp([]byte("name"))
+
+		info, err := bc.Stat([]byte("name"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if info.Pending || info.Size != 5 || !info.TimeStamp.Equal(tStamp) || !info.Expiry.IsZero() {
+			t.Errorf("got %+v, want 5 bytes written at %v", info, tStamp)
+		}
+
+		data, _ := os.ReadFile(path.Join(testBitcaskPath, info.File))
+		assertEqualStrings(t, string(data[info.Offset:info.Offset+info.Size]), "salah")
+		os.RemoveAll(testBitcaskPath)
+	})
+
+	t.Run("compressed and encrypted values", func(t *testing.T) {
+		bc, _ := Open(testBitcaskPath, RWsyncConfig.WithCompression().WithEncryption(testEncryptionKey))
+		value := jsonValue(1)
+		bc.Put([]byte("name"), []byte(value))
+
+		info, _ := bc.Stat([]byte("name"))
+		if !info.Compressed || !info.Encrypted || info.Size >= int64(len(value)) {
+			t.Errorf("got %+v, want a compressed and encrypted value under %d bytes", info, len(value))
+		}
+		os.RemoveAll(testBitcaskPath)
+	})
+
+	t.Run("no disk reads", func(t *testing.T) {
+		fsys := NewMemFS()
+		bc, _ := Open(testBitcaskPath, RWsyncConfig.WithFS(fsys))
+		bc.Put([]byte("name"), []byte("salah"))
+		info, _ := bc.Stat([]byte("name"))
+		bucket := bc.Bucket("users")
+		bucket.Put([]byte("name"), []byte("ahmed"))
+		if !bucket.Has([]byte("name")) || bucket.Has([]byte("age")) || bc.Bucket("other").Has([]byte("name")) {
+			t.Error("bucket keys don't match their buckets")
+		}
+		fsys.Remove(path.Join(testBitcaskPath, info.File))
+
+		if !bc.Has([]byte("name")) {
+			t.Error("Has read the removed data file")
+		}
+		if got, err := bc.Stat([]byte("name")); err != nil || got != info {
+			t.Errorf("got %+v, %v, want %+v", got, err, info)
+		}
+
+	})
+}
+
 func assertEqualStrings(t testing.TB, got, want string) {
 	t.Helper()
 	if (got != want) {
@@ -0,0 +1,142 @@
+package bitcask
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// bloomFilter tells if a key may be among the keys of a hint file. It
+// has no false negatives, and about 1% false positives with
+// bloomBitsPerKey bits and bloomHashes hashes per key.
+type bloomFilter struct {
+	hashes int
+	// keys and bucketKeys are the number of keys of the default namespace
+	// and of the buckets in the hint file that aren't tombstones.
+	keys       int
+	bucketKeys int
+	bits       []byte
+}
+
+// newBloomFilter returns an empty filter sized for keys keys.
+func newBloomFilter(keys int) *bloomFilter {
+	size := (keys*bloomBitsPerKey + 7) / 8
+	if size < 8 {
+		size = 8
+	}
+	return &bloomFilter{hashes: bloomHashes, bits: make([]byte, size)}
+}
+
+// bloomHash returns the two hashes of key whose combinations give the
+// bits of the key, from the 64 bit FNV-1a hash.
+func bloomHash(key string) (uint32, uint32) {
+	hash := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint64(key[i])
+		hash *= 1099511628211
+	}
+	return uint32(hash), uint32(hash>>32) | 1
+}
+
+// add adds key to the filter.
+func (f *bloomFilter) add(key string) {
+	h1, h2 := bloomHash(key)
+	m := uint32(len(f.bits) * 8)
+	for i := 0; i < f.hashes; i++ {
+		bit := (h1 + uint32(i)*h2) % m
+		f.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// mayContain checks if key may have been added to the filter.
+func (f *bloomFilter) mayContain(key string) bool {
+	h1, h2 := bloomHash(key)
+	m := uint32(len(f.bits) * 8)
+	for i := 0; i < f.hashes; i++ {
+		bit := (h1 + uint32(i)*h2) % m
+		if f.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// marshal returns the content of the bloom file of the filter: the
+// number of hashes, keys and bucket keys followed by the bits.
+func (f *bloomFilter) marshal() []byte {
+	data := make([]byte, 12, 12+len(f.bits))
+	binary.BigEndian.PutUint32(data, uint32(f.hashes))
+	binary.BigEndian.PutUint32(data[4:], uint32(f.keys))
+	binary.BigEndian.PutUint32(data[8:], uint32(f.bucketKeys))
+	return append(data, f.bits...)
+}
+
+// parseBloomFilter parses the content of a bloom file.
+// returns ok == false if it isn't a valid filter.
+func parseBloomFilter(data []byte) (*bloomFilter, bool) {
+	if len(data) <= 12 {
+		return nil, false
+	}
+	hashes := binary.BigEndian.Uint32(data)
+	if hashes == 0 || hashes > 32 {
+		return nil, false
+	}
+	return &bloomFilter{
+		hashes:     int(hashes),
+		keys:       int(binary.BigEndian.Uint32(data[4:])),
+		bucketKeys: int(binary.BigEndian.Uint32(data[8:])),
+		bits:       data[12:],
+	}, true
+}
+
+// hintsBloomFilter returns the filter of the keys of hints, tombstones
+// included.
+func hintsBloomFilter(hints []byte) *bloomFilter {
+	entries := 0
+	parseHints(hints, func(key string, record Record) {
+		entries++
+	})
+	filter := newBloomFilter(entries)
+	filter.keys, filter.bucketKeys = countHintKeys(hints)
+	parseHints(hints, func(key string, record Record) {
+		filter.add(key)
+	})
+	return filter
+}
+
+// countHintKeys counts the keys of hints that aren't tombstones, see
+// countKey.
+func countHintKeys(hints []byte) (keys, bucketKeys int) {
+	parseHints(hints, func(key string, record Record) {
+		if record.valuePosition != tombstoneHintPosition {
+			k, b := countKey(key)
+			keys, bucketKeys = keys+k, bucketKeys+b
+		}
+	})
+	return keys, bucketKeys
+}
+
+// writeBloomFile writes the bloom file of the keys of hints, the hint
+// entries of the data file fileId, encrypted with itemCipher.
+func writeBloomFile(fsys FS, itemCipher *itemCipher, fileId string, hints []byte) error {
+	name := bloomFileName(fileId)
+	return replaceFile(fsys, name, itemCipher.sealData(name, hintsBloomFilter(hints).marshal()))
+}
+
+// readBloomFile reads the bloom file of the data file fileId, falling
+// back to a filter of hints if it's missing or broken.
+func readBloomFile(fsys FS, itemCipher *itemCipher, fileId string, hints []byte) *bloomFilter {
+	name := bloomFileName(fileId)
+	if data, err := readFile(fsys, name); err == nil {
+		if data, err = itemCipher.openData(name, data); err == nil {
+			if filter, ok := parseBloomFilter(data); ok {
+				return filter
+			}
+		}
+	}
+	return hintsBloomFilter(hints)
+}
+
+// bloomFileName returns the name of the bloom file of the data file fileId.
+func bloomFileName(fileId string) string {
+	return strings.TrimSuffix(fileId, BitCaskFileExtension) + BloomFileExtension
+}
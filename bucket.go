@@ -0,0 +1,422 @@
+package bitcask
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+const (
+	// defaultBucket is the namespace of the keys of the bitcask API.
+	defaultBucket uint32 = 0
+	// catalogBucket holds the id of every bucket under its name.
+	catalogBucket uint32 = math.MaxUint32
+	// metaBucket holds lastBucketIdKey, the highest bucket id ever given,
+	// so that the ids of dropped buckets are never given again.
+	metaBucket      uint32 = math.MaxUint32 - 1
+	lastBucketIdKey        = "last_bucket_id"
+
+	// bucketKeyPrefix begins the keys of the buckets, followed by the
+	// bucket id in hex.
+	bucketKeyPrefix = "\x00\x01"
+	// escapedKeyPrefix is put before the keys of the default namespace
+	// that begin with bucketKeyPrefix or escapedKeyPrefix.
+	escapedKeyPrefix = "\x00\x00"
+	bucketIdSize     = 8
+)
+
+// Bucket is a namespace of keys stored in the same data files as the
+// other keys of the bitcask, see BitCask.Bucket. Writing to a bucket
+// never touches the keys of the bitcask or of other buckets.
+// Watchers don't see the writes of buckets.
+type Bucket struct {
+	bc   *BitCask
+	name string
+}
+
+// bucketRef is the id of a bucket along with the catalog record it was
+// read from, the id is read again once the record changes.
+type bucketRef struct {
+	record Record
+	id     uint32
+}
+
+// namespaceKey returns the key that the keydir and the items hold key
+// of bucket under. The keys of the default namespace are kept as they
+// are unless they begin with one of the prefixes.
+func namespaceKey(bucket uint32, key []byte) []byte {
+	if bucket == defaultBucket {
+		if bytes.HasPrefix(key, []byte(bucketKeyPrefix)) || bytes.HasPrefix(key, []byte(escapedKeyPrefix)) {
+			return append([]byte(escapedKeyPrefix), key...)
+		}
+		return key
+	}
+
+	namespaced := make([]byte, 0, len(bucketKeyPrefix)+bucketIdSize+len(key))
+	namespaced = append(namespaced, bucketKeyPrefix...)
+	namespaced = append(namespaced, fmt.Sprintf("%08x", bucket)...)
+	return append(namespaced, key...)
+}
+
+// splitNamespaceKey returns the bucket and the key of a key built by
+// namespaceKey.
+func splitNamespaceKey(key string) (uint32, string) {
+	if len(key) < len(bucketKeyPrefix) || key[0] != 0 {
+		return defaultBucket, key
+	}
+	switch key[:len(bucketKeyPrefix)] {
+	case escapedKeyPrefix:
+		return defaultBucket, key[len(escapedKeyPrefix):]
+	case bucketKeyPrefix:
+		end := len(bucketKeyPrefix) + bucketIdSize
+		if len(key) >= end {
+			if id, err := strconv.ParseUint(key[len(bucketKeyPrefix):end], 16, 32); err == nil {
+				return uint32(id), key[end:]
+			}
+		}
+	}
+
+	return defaultBucket, key
+}
+
+// Bucket returns the bucket called name, it's created by its first write.
+// Writes to a bucket with an empty name fail with ErrEmptyBucketName.
+func (bc *BitCask) Bucket(name string) *Bucket {
+	return &Bucket{bc: bc, name: name}
+}
+
+// Name returns the name of the bucket.
+func (b *Bucket) Name() string {
+	return b.name
+}
+
+// Get retrieves a value by key from the bucket.
+// It returns the same errors as BitCask.Get.
+func (b *Bucket) Get(key []byte) ([]byte, error) {
+	if key == nil {
+		return nil, ErrNullKeyOrValue
+	}
+
+	b.bc.mu.RLock()
+	defer b.bc.mu.RUnlock()
+
+	id, err := b.bc.bucketId(b.name)
+	if err != nil {
+		return nil, err
+	}
+	if id == defaultBucket {
+		return nil, fmt.Errorf("%q: %w", string(key), ErrKeyNotExist)
+	}
+	return b.bc.get(namespaceKey(id, key))
+}
+
+// Has checks if key exists in the bucket, without reading its value.
+func (b *Bucket) Has(key []byte) bool {
+	_, err := b.Stat(key)
+	return err == nil
+}
+
+// Stat returns the description of the value of key in the bucket like
+// BitCask.Stat.
+func (b *Bucket) Stat(key []byte) (KeyInfo, error) {
+	if key == nil {
+		return KeyInfo{}, ErrNullKeyOrValue
+	}
+
+	b.bc.mu.RLock()
+	defer b.bc.mu.RUnlock()
+
+	id, err := b.bc.bucketId(b.name)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+	if id == defaultBucket {
+		return KeyInfo{}, fmt.Errorf("%q: %w", string(key), ErrKeyNotExist)
+	}
+	return b.bc.stat(namespaceKey(id, key))
+}
+
+// Put stores a key and value in the bucket, creating the bucket if needed.
+// It returns the same errors as BitCask.Put.
+func (b *Bucket) Put(key, value []byte) error {
+	if key == nil || value == nil {
+		return ErrNullKeyOrValue
+	}
+
+	if err := b.bc.checkWritable(); err != nil {
+		return err
+	}
+
+	b.bc.mu.Lock()
+	defer b.bc.unlock()
+
+	id, err := b.bc.createBucket(b.name)
+	if err != nil {
+		return err
+	}
+	return b.bc.put(namespaceKey(id, key), value)
+}
+
+// Delete deletes key from the bucket.
+// It returns the same errors as BitCask.Delete.
+func (b *Bucket) Delete(key []byte) error {
+	if key == nil {
+		return ErrNullKeyOrValue
+	}
+
+	if err := b.bc.checkWritable(); err != nil {
+		return err
+	}
+
+	b.bc.mu.Lock()
+	defer b.bc.unlock()
+
+	id, err := b.bc.bucketId(b.name)
+	if err != nil || id == defaultBucket {
+		return err
+	}
+	return b.bc.delete(namespaceKey(id, key))
+}
+
+// ListKeys lists all the keys of the bucket.
+func (b *Bucket) ListKeys() [][]byte {
+	b.bc.mu.Lock()
+	defer b.bc.unlock()
+
+	b.bc.sync()
+
+	id, err := b.bc.bucketId(b.name)
+	if err != nil || id == defaultBucket {
+		return nil
+	}
+	return b.bc.listKeys(id)
+}
+
+// Fold folds over all key/value pairs of the bucket like BitCask.Fold.
+func (b *Bucket) Fold(fn func([]byte, []byte, any) any, acc any) any {
+	b.bc.mu.RLock()
+	id, err := b.bc.bucketId(b.name)
+	b.bc.mu.RUnlock()
+	if err != nil || id == defaultBucket {
+		return acc
+	}
+
+	return b.bc.fold(id, fn, acc)
+}
+
+// DropBucket deletes the bucket called name with all its keys at once,
+// by deleting it from the catalog, so readers see either all of them or
+// none. The keys of a bucket missing from the catalog are dead, their
+// items are dropped by later merges. A bucket with the same name created
+// later starts empty, since bucket ids are never given again.
+// returns err == ErrHasNoWritePerms if calling process has no write perms
+// err == ErrFollowerIsReadOnly if the bitcask is a follower.
+func (bc *BitCask) DropBucket(name string) error {
+	if err := bc.checkWritable(); err != nil {
+		return err
+	}
+
+	bc.mu.Lock()
+	defer bc.unlock()
+
+	if err := bc.sync(); err != nil {
+		return err
+	}
+	id, err := bc.bucketId(name)
+	if err != nil || id == defaultBucket {
+		return err
+	}
+
+	if err := bc.writeTombstone(namespaceKey(catalogBucket, []byte(name))); err != nil {
+		return err
+	}
+	err = bc.syncActiveFile()
+	bc.forgetBucket(name, id)
+
+	return err
+}
+
+// forgetBucket removes the keys of the dropped bucket id, called name,
+// from the keydir. The caller holds the bitcask write lock.
+func (bc *BitCask) forgetBucket(name string, id uint32) {
+	for _, key := range bc.listKeys(id) {
+		namespaced := string(namespaceKey(id, key))
+		if record, ok := bc.keydir.get(namespaced); ok {
+			bc.markDead(namespaced, record)
+		}
+		bc.keydir.remove(namespaced)
+	}
+
+	bc.bucketsMu.Lock()
+	delete(bc.buckets, name)
+	bc.bucketsMu.Unlock()
+}
+
+// forgetDroppedBuckets removes the keys of the buckets missing from the
+// catalog from the keydir, those of the buckets dropped since their
+// items were last merged. Nothing is removed if the catalog can't be read.
+func (bc *BitCask) forgetDroppedBuckets() {
+	ids, err := bc.catalog()
+	if err != nil {
+		return
+	}
+
+	var dropped []string
+	bc.keydir.each(func(key string, record Record) {
+		bucket, _ := splitNamespaceKey(key)
+		if bucket == defaultBucket || bucket == catalogBucket || bucket == metaBucket {
+			return
+		}
+		if _, ok := ids[bucket]; !ok {
+			dropped = append(dropped, key)
+		}
+	})
+	for _, key := range dropped {
+		bc.keydir.remove(key)
+	}
+}
+
+// countKeys returns the number of keys of the default namespace and of
+// the buckets in keydir, the catalog and meta keys aren't counted.
+func (bc *BitCask) countKeys() (keys, bucketKeys int) {
+	if bc.keydir.lazy != nil {
+		return bc.keydir.lazy.countKeys()
+	}
+
+	bc.keydir.each(func(key string, record Record) {
+		k, b := countKey(key)
+		keys, bucketKeys = keys+k, bucketKeys+b
+	})
+	return keys, bucketKeys
+}
+
+// countKey counts the keydir key key as a key of the default namespace
+// or of a bucket, the catalog and meta keys count as neither.
+func countKey(key string) (keys, bucketKeys int) {
+	switch bucket, _ := splitNamespaceKey(key); bucket {
+	case defaultBucket:
+		return 1, 0
+	case catalogBucket, metaBucket:
+		return 0, 0
+	}
+	return 0, 1
+}
+
+// catalog returns the names of the buckets of the catalog by id.
+func (bc *BitCask) catalog() (map[uint32]string, error) {
+	var names []string
+	bc.keydir.each(func(key string, record Record) {
+		if bucket, name := splitNamespaceKey(key); bucket == catalogBucket {
+			names = append(names, name)
+		}
+	})
+
+	ids := make(map[uint32]string)
+	for _, name := range names {
+		id, err := bc.bucketId(name)
+		if err != nil {
+			return nil, err
+		}
+		ids[id] = name
+	}
+	return ids, nil
+}
+
+// bucketId returns the id of the bucket called name, defaultBucket if
+// it doesn't exist. The caller holds the bitcask lock.
+func (bc *BitCask) bucketId(name string) (uint32, error) {
+	key := namespaceKey(catalogBucket, []byte(name))
+	record, ok := bc.keydir.get(string(key))
+	if !ok {
+		return defaultBucket, nil
+	}
+
+	bc.bucketsMu.Lock()
+	ref, ok := bc.buckets[name]
+	bc.bucketsMu.Unlock()
+	if ok && ref.record == record {
+		return ref.id, nil
+	}
+
+	value, err := bc.readValue(record)
+	if err != nil {
+		return defaultBucket, err
+	}
+	if len(value) != 4 {
+		return defaultBucket, fmt.Errorf("bucket %q: %w", name, ErrCorruptItem)
+	}
+	id := binary.BigEndian.Uint32(value)
+
+	bc.bucketsMu.Lock()
+	bc.buckets[name] = bucketRef{record: record, id: id}
+	bc.bucketsMu.Unlock()
+
+	return id, nil
+}
+
+// createBucket returns the id of the bucket called name, creating the
+// bucket if it doesn't exist. The caller holds the bitcask write lock.
+func (bc *BitCask) createBucket(name string) (uint32, error) {
+	if name == "" {
+		return defaultBucket, ErrEmptyBucketName
+	}
+	id, err := bc.bucketId(name)
+	if err != nil || id != defaultBucket {
+		return id, err
+	}
+
+	if bc.lastBucketId == defaultBucket {
+		if err := bc.loadLastBucketId(); err != nil {
+			return defaultBucket, err
+		}
+	}
+	if bc.lastBucketId == metaBucket-1 {
+		return defaultBucket, ErrTooManyBuckets
+	}
+
+	id = bc.lastBucketId + 1
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, id)
+	// the highest id and the bucket id are written at once, so that the
+	// keys of the bucket are never synced before them.
+	if _, err := bc.writeKeyValue(namespaceKey(metaBucket, []byte(lastBucketIdKey)), value); err != nil {
+		return defaultBucket, err
+	}
+	if _, err := bc.writeKeyValue(namespaceKey(catalogBucket, []byte(name)), value); err != nil {
+		return defaultBucket, err
+	}
+	if err := bc.syncActiveFile(); err != nil {
+		return defaultBucket, err
+	}
+	bc.lastBucketId = id
+
+	return id, nil
+}
+
+// loadLastBucketId loads the highest bucket id ever given. The catalog
+// of a datastore written before it was recorded may hold a higher one.
+func (bc *BitCask) loadLastBucketId() error {
+	if record, ok := bc.keydir.get(string(namespaceKey(metaBucket, []byte(lastBucketIdKey)))); ok {
+		value, err := bc.readValue(record)
+		if err != nil {
+			return err
+		}
+		if len(value) != 4 {
+			return fmt.Errorf("last bucket id: %w", ErrCorruptItem)
+		}
+		bc.lastBucketId = binary.BigEndian.Uint32(value)
+	}
+
+	ids, err := bc.catalog()
+	if err != nil {
+		return err
+	}
+	for id := range ids {
+		if id > bc.lastBucketId {
+			bc.lastBucketId = id
+		}
+	}
+	return nil
+}
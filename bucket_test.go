@@ -0,0 +1,232 @@
+package bitcask
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// sortedKeys returns keys as sorted strings.
+func sortedKeys(keys [][]byte) []string {
+	result := make([]string, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, string(key))
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestBucket(t *testing.T) {
+	t.Run("buckets don't share keys", func(t *testing.T) {
+		bc, _ := Open(testBitcaskPath, RWConfig.WithFS(NewMemFS()))
+		users, orders := bc.Bucket("users"), bc.Bucket("orders")
+		bc.Put([]byte("key"), []byte("root"))
+		users.Put([]byte("key"), []byte("user"))
+		users.Put([]byte("user2"), []byte("user"))
+		orders.Put([]byte("key"), []byte("order"))
+
+		got, _ := bc.Get([]byte("key"))
+		assertEqualStrings(t, string(got), "root")
+		got, _ = users.Get([]byte("key"))
+		assertEqualStrings(t, string(got), "user")
+		got, _ = orders.Get([]byte("key"))
+		assertEqualStrings(t, string(got), "order")
+		_, err := orders.Get([]byte("user2"))
+		assertErrorMsg(t, err, BitCaskError("\"user2\": key doesn't exist"))
+		if _, err := bc.Bucket("none").Get([]byte("key")); !errors.Is(err, ErrKeyNotExist) {
+			t.Errorf("got %v, want ErrKeyNotExist", err)
+		}
+		assertErrorMsg(t, bc.Bucket("").Put([]byte("key"), []byte("value")), ErrEmptyBucketName)
+
+		assertEqualStrings(t, fmt.Sprint(sortedKeys(bc.ListKeys())), "[key]")
+		assertEqualStrings(t, fmt.Sprint(sortedKeys(users.ListKeys())), "[key user2]")
+		count := users.Fold(func(key, value []byte, acc any) any {
+			assertEqualStrings(t, string(value), "user")
+			return acc.(int) + 1
+		}, 0)
+		if count != 2 {
+			t.Errorf("got %v pairs, want 2", count)
+		}
+
+		users.Delete([]byte("key"))
+		if _, err := users.Get([]byte("key")); !errors.Is(err, ErrKeyNotExist) {
+			t.Errorf("got %v, want ErrKeyNotExist", err)
+		}
+		got, _ = bc.Get([]byte("key"))
+		assertEqualStrings(t, string(got), "root")
+		bc.Close()
+	})
+
+	t.Run("default keys that look like bucket keys", func(t *testing.T) {
+		bc, _ := Open(testBitcaskPath, RWsyncConfig.WithFS(NewMemFS()))
+		users := bc.Bucket("users")
+		users.Put([]byte("key"), []byte("user"))
+		bucketKey := string(namespaceKey(1, []byte("key")))
+		bc.Put([]byte(bucketKey), []byte("root"))
+		bc.Put([]byte(escapedKeyPrefix), []byte("escaped"))
+
+		got, _ := users.Get([]byte("key"))
+		assertEqualStrings(t, string(got), "user")
+		got, _ = bc.Get([]byte(bucketKey))
+		assertEqualStrings(t, string(got), "root")
+		got, _ = bc.Get([]byte(escapedKeyPrefix))
+		assertEqualStrings(t, string(got), "escaped")
+		assertEqualStrings(t, fmt.Sprintf("%q", sortedKeys(bc.ListKeys())), fmt.Sprintf("%q", []string{escapedKeyPrefix, bucketKey}))
+		_, err := bc.Get([]byte(escapedKeyPrefix + "none"))
+		assertErrorMsg(t, err, BitCaskError(fmt.Sprintf("%q: key doesn't exist", escapedKeyPrefix+"none")))
+		bc.Close()
+	})
+
+	t.Run("buckets are read back after merge and recovery", func(t *testing.T) {
+		os.RemoveAll(testBitcaskPath)
+		bc, _ := Open(testBitcaskPath, RWsyncConfig)
+		for i := 0; i < 30; i++ {
+			bucket := bc.Bucket(fmt.Sprintf("bucket%d", i%3))
+			bucket.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)))
+		}
+		bc.Close()
+
+		bc, _ = Open(testBitcaskPath, RWsyncConfig)
+		bc.Merge()
+		bc.Bucket("bucket3").Put([]byte("key"), []byte("value"))
+		crash(bc)
+
+		bc, _ = Open(testBitcaskPath, RWsyncConfig)
+		for i := 0; i < 30; i++ {
+			got, _ := bc.Bucket(fmt.Sprintf("bucket%d", i%3)).Get([]byte(fmt.Sprintf("key%d", i)))
+			assertEqualStrings(t, string(got), fmt.Sprintf("value%d", i))
+		}
+		got, _ := bc.Bucket("bucket3").Get([]byte("key"))
+		assertEqualStrings(t, string(got), "value")
+		if keys := bc.ListKeys(); len(keys) != 0 {
+			t.Errorf("got default keys %q, want none", keys)
+		}
+		bc.Close()
+		os.RemoveAll(testBitcaskPath)
+	})
+
+	t.Run("drop bucket", func(t *testing.T) {
+		os.RemoveAll(testBitcaskPath)
+		bc, _ := Open(testBitcaskPath, RWConfig)
+		users, orders := bc.Bucket("users"), bc.Bucket("orders")
+		for i := 0; i < 20; i++ {
+			users.Put([]byte(fmt.Sprintf("key%d", i)), []byte("user"))
+			orders.Put([]byte(fmt.Sprintf("key%d", i)), []byte("order"))
+		}
+		if err := bc.DropBucket("users"); err != nil {
+			t.Fatal(err)
+		}
+		if keys := users.ListKeys(); len(keys) != 0 {
+			t.Errorf("got keys %q, want none", keys)
+		}
+		if err := bc.DropBucket("none"); err != nil {
+			t.Fatal(err)
+		}
+
+		// a bucket created again starts empty
+		users.Put([]byte("key0"), []byte("new"))
+		bc.Sync()
+		crash(bc)
+
+		bc, _ = Open(testBitcaskPath, RWConfig)
+		users, orders = bc.Bucket("users"), bc.Bucket("orders")
+		assertEqualStrings(t, strings.Join(sortedKeys(users.ListKeys()), " "), "key0")
+		got, _ := users.Get([]byte("key0"))
+		assertEqualStrings(t, string(got), "new")
+		if keys := orders.ListKeys(); len(keys) != 20 {
+			t.Errorf("got %d keys, want 20", len(keys))
+		}
+		bc.Close()
+		os.RemoveAll(testBitcaskPath)
+	})
+
+	t.Run("dropped bucket keys are forgotten and merged away", func(t *testing.T) {
+		fsys := NewMemFS()
+		config := RWsyncConfig.WithFS(fsys).WithMergePolicy(MergePolicy{FragThreshold: 1})
+		bc, _ := Open(testBitcaskPath, config)
+		for i := 0; i < 50; i++ {
+			bc.Bucket("users").Put([]byte(fmt.Sprintf("key%d", i)), []byte("user"))
+		}
+		bc.Put([]byte("name"), []byte("salah"))
+		usersId, _ := bc.bucketId("users")
+
+		// bucketItems counts the items and tombstones of the bucket id.
+		bucketItems := func(id uint32) (items, tombstones int) {
+			for _, fileId := range dataFiles(fsys, testBitcaskPath) {
+				scanItems(fsys, nil, fileId, func(item fileItem, offset int64) error {
+					if bucket, _ := splitNamespaceKey(string(item.key)); bucket == id && item.isTombstone() {
+						tombstones++
+					} else if bucket == id {
+						items++
+					}
+					return nil
+				})
+			}
+			return items, tombstones
+		}
+
+		if err := bc.DropBucket("users"); err != nil {
+			t.Fatal(err)
+		}
+		if _, tombstones := bucketItems(usersId); tombstones != 0 {
+			t.Errorf("got %d tombstones of bucket keys, want none", tombstones)
+		}
+		if _, tombstones := bucketItems(catalogBucket); tombstones != 1 {
+			t.Errorf("got %d catalog tombstones, want 1", tombstones)
+		}
+		crash(bc)
+
+		bc, _ = Open(testBitcaskPath, config)
+		defer bc.Close()
+		if keys := bc.listKeys(usersId); len(keys) != 0 {
+			t.Errorf("got %d keys of the dropped bucket, want none", len(keys))
+		}
+		bc.Bucket("users").Put([]byte("key1"), []byte("new"))
+		if id, _ := bc.bucketId("users"); id <= usersId {
+			t.Errorf("got bucket id %d, want more than %d", id, usersId)
+		}
+		assertEqualStrings(t, strings.Join(sortedKeys(bc.Bucket("users").ListKeys()), " "), "key1")
+
+		bc.Merge()
+		if items, _ := bucketItems(usersId); items != 0 {
+			t.Errorf("got %d items of the dropped bucket after merge, want none", items)
+		}
+		got, _ := bc.Get([]byte("name"))
+		assertEqualStrings(t, string(got), "salah")
+	})
+
+	t.Run("read only bucket", func(t *testing.T) {
+		fsys := NewMemFS()
+		bc, _ := Open(testBitcaskPath, RWConfig.WithFS(fsys))
+		bc.Bucket("users").Put([]byte("key"), []byte("user"))
+		bc.Close()
+
+		bc, _ = Open(testBitcaskPath, DefaultConfig.WithFS(fsys))
+		got, _ := bc.Bucket("users").Get([]byte("key"))
+		assertEqualStrings(t, string(got), "user")
+		assertErrorMsg(t, bc.Bucket("users").Put([]byte("key"), []byte("value")), ErrHasNoWritePerms)
+		assertErrorMsg(t, bc.DropBucket("users"), ErrHasNoWritePerms)
+		bc.Close()
+	})
+}
+
+func TestNamespaceKey(t *testing.T) {
+	keys := []string{"", "key", "\x00", "\x00\x00", "\x00\x01", "\x00\x0100000001key", "\x00\x00key"}
+	seen := make(map[string]string)
+	for _, bucket := range []uint32{defaultBucket, 1, 255, catalogBucket} {
+		for _, key := range keys {
+			namespaced := string(namespaceKey(bucket, []byte(key)))
+			gotBucket, gotKey := splitNamespaceKey(namespaced)
+			if gotBucket != bucket || gotKey != key {
+				t.Errorf("got %d %q back from %q, want %d %q", gotBucket, gotKey, namespaced, bucket, key)
+			}
+			if other, ok := seen[namespaced]; ok {
+				t.Errorf("%q is the key of both %s and %d %q", namespaced, other, bucket, key)
+			}
+			seen[namespaced] = fmt.Sprintf("%d %q", bucket, key)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Command bitcask-server serves a bitcask datastore over the redis
+// serialization protocol on a local tcp or unix socket, and optionally
+// over http.
+//
+// usage: bitcask-server [-dir path] [-network tcp|unix] [-addr address] [-http address]
+package main
+
+import (
+	"bitcask"
+	"bitcask/server"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"syscall"
+)
+
+func main() {
+	dir := flag.String("dir", path.Join("bitcask"), "path of the bitcask directory")
+	network := flag.String("network", "tcp", "network to listen on, tcp or unix")
+	addr := flag.String("addr", "127.0.0.1:6380", "address to listen on")
+	httpAddr := flag.String("http", "", "address to serve http on, disabled if empty")
+	flag.Parse()
+
+	bc, err := bitcask.Open(*dir, bitcask.RWsyncConfig)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	srv := server.New(bc)
+	httpSrv := &http.Server{Addr: *httpAddr, Handler: server.NewHTTPHandler(bc)}
+	if *httpAddr != "" {
+		go func() {
+			if err := httpSrv.ListenAndServe(); err != http.ErrServerClosed {
+				fmt.Fprintln(os.Stderr, err)
+				srv.Close()
+			}
+		}()
+	}
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		srv.Close()
+	}()
+
+	err = srv.ListenAndServe(*network, *addr)
+	httpSrv.Close()
+	bc.Close()
+	if err != server.ErrServerClosed {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
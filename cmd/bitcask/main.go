@@ -0,0 +1,365 @@
+// Command bitcask inspects and operates a bitcask datastore.
+//
+// usage: bitcask [-dir path] <command> [args]
+//
+// commands:
+//
+//	get <key>                  print the value of key
+//	put <key> <value>          store value at key
+//	delete <key>               delete key
+//	keys                       list all keys
+//	scan [prefix]              print all key/value pairs whose key starts with prefix
+//	stats                      print datastore statistics
+//	merge                      merge the data files
+//	dump <file>                decode every item of a data file
+//	verify                     check every item of the datastore and the keydir file
+//	repair                     rebuild the datastore from its valid items
+//	export [-format f] [file]  write all key/value pairs to file or stdout
+//	import [-format f] [file]  read key/value pairs from file or stdin
+//
+// export and import formats are jsonl, csv and binary, jsonl by default.
+package main
+
+import (
+	"bitcask"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+var errUsage = errors.New("usage: bitcask [-dir path] get|put|delete|keys|scan|stats|merge|dump|verify|repair|export|import [args]")
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// run executes the command given in args and writes its output to out.
+func run(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("bitcask", flag.ContinueOnError)
+	dir := flags.String("dir", path.Join("bitcask"), "path of the bitcask directory")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	args = flags.Args()
+	if len(args) == 0 {
+		return errUsage
+	}
+	command, args := args[0], args[1:]
+
+	switch command {
+	case "get":
+		return get(*dir, args, out)
+	case "put":
+		return put(*dir, args)
+	case "delete":
+		return del(*dir, args)
+	case "keys":
+		return keys(*dir, out)
+	case "scan":
+		return scan(*dir, args, out)
+	case "stats":
+		return stats(*dir, out)
+	case "merge":
+		return merge(*dir)
+	case "dump":
+		return dump(args, out)
+	case "verify":
+		return verify(*dir, out)
+	case "repair":
+		return repair(*dir, out)
+	case "export":
+		return export(*dir, args, out)
+	case "import":
+		return importPairs(*dir, args)
+	}
+
+	return errUsage
+}
+
+func get(dir string, args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	bc, err := bitcask.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer bc.Close()
+
+	value, err := bc.Get([]byte(args[0]))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, string(value))
+
+	return nil
+}
+
+func put(dir string, args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+
+	bc, err := bitcask.Open(dir, bitcask.RWsyncConfig)
+	if err != nil {
+		return err
+	}
+	defer bc.Close()
+
+	return bc.Put([]byte(args[0]), []byte(args[1]))
+}
+
+func del(dir string, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	bc, err := bitcask.Open(dir, bitcask.RWsyncConfig)
+	if err != nil {
+		return err
+	}
+	defer bc.Close()
+
+	return bc.Delete([]byte(args[0]))
+}
+
+func keys(dir string, out io.Writer) error {
+	bc, err := bitcask.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer bc.Close()
+
+	var result []string
+	for _, key := range bc.ListKeys() {
+		result = append(result, string(key))
+	}
+	sort.Strings(result)
+
+	for _, key := range result {
+		fmt.Fprintln(out, key)
+	}
+
+	return nil
+}
+
+func scan(dir string, args []string, out io.Writer) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	prefix := ""
+	if len(args) == 1 {
+		prefix = args[0]
+	}
+
+	bc, err := bitcask.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer bc.Close()
+
+	pairs := bc.Fold(func(key, value []byte, acc any) any {
+		if strings.HasPrefix(string(key), prefix) {
+			acc = append(acc.([]string), string(key)+" "+string(value))
+		}
+		return acc
+	}, []string{}).([]string)
+	sort.Strings(pairs)
+
+	for _, pair := range pairs {
+		fmt.Fprintln(out, pair)
+	}
+
+	return nil
+}
+
+func stats(dir string, out io.Writer) error {
+	bc, err := bitcask.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer bc.Close()
+
+	stats := bc.Stats()
+	fmt.Fprintf(out, "keys: %d\n", stats.Keys)
+	fmt.Fprintf(out, "data files: %d\n", stats.DataFiles)
+	fmt.Fprintf(out, "live bytes: %d\n", stats.LiveBytes)
+	fmt.Fprintf(out, "dead bytes: %d\n", stats.DeadBytes)
+	fmt.Fprintf(out, "keydir memory: %d\n", stats.KeydirMemory)
+
+	var files []string
+	for file := range stats.Files {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		fmt.Fprintf(out, "%s: %d live, %d dead\n", file, stats.Files[file].LiveBytes, stats.Files[file].DeadBytes)
+	}
+
+	return nil
+}
+
+func merge(dir string) error {
+	bc, err := bitcask.Open(dir, bitcask.RWsyncConfig)
+	if err != nil {
+		return err
+	}
+	defer bc.Close()
+
+	return bc.Merge()
+}
+
+func dump(args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	return bitcask.ScanDataFile(args[0], func(item bitcask.ItemInfo) error {
+		crc := "ok"
+		if !item.ValidCRC {
+			crc = "bad"
+		}
+		value := fmt.Sprintf("%q", item.Value)
+		if item.Compressed {
+			value += " compressed"
+		}
+		if item.Encrypted {
+			value = fmt.Sprintf("<encrypted with key %d>", item.KeyId)
+		}
+		if item.Tombstone {
+			value = "<tombstone>"
+		}
+
+		fmt.Fprintf(out, "offset=%d size=%d crc=%s time=%s key=%q value=%s\n",
+			item.Offset, item.Size, crc, item.TimeStamp.Format("2006-01-02T15:04:05.000000Z07:00"), item.Key, value)
+		return nil
+	})
+}
+
+func verify(dir string, out io.Writer) error {
+	report, err := bitcask.Check(dir)
+	if err != nil {
+		return err
+	}
+	printCheckReport(report, out)
+
+	if !report.OK() {
+		return errors.New("datastore is corrupted, run repair to fix it")
+	}
+	fmt.Fprintln(out, "ok")
+
+	return nil
+}
+
+func repair(dir string, out io.Writer) error {
+	report, err := bitcask.Repair(dir)
+	if err != nil {
+		return err
+	}
+	printCheckReport(report.Check, out)
+
+	for _, file := range report.Quarantined {
+		fmt.Fprintf(out, "quarantined %s\n", file)
+	}
+	for _, key := range report.LostKeys {
+		fmt.Fprintf(out, "lost key %q\n", key)
+	}
+
+	return nil
+}
+
+func printCheckReport(report *bitcask.CheckReport, out io.Writer) {
+	for _, file := range report.Files {
+		for _, r := range file.CorruptRanges {
+			fmt.Fprintf(out, "%s: corrupted bytes %d-%d\n", file.File, r.Start, r.End)
+		}
+	}
+	for _, problem := range report.KeydirProblems {
+		fmt.Fprintf(out, "keydir: %s\n", problem)
+	}
+	if report.Encrypted {
+		fmt.Fprintln(out, "keydir: not checked, the datastore is encrypted")
+	}
+}
+
+func export(dir string, args []string, out io.Writer) error {
+	format, file, err := parseTransferArgs("export", args)
+	if err != nil {
+		return err
+	}
+
+	bc, err := bitcask.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer bc.Close()
+
+	if file == "" {
+		return bc.Export(out, format)
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := bc.Export(f, format); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func importPairs(dir string, args []string) error {
+	format, file, err := parseTransferArgs("import", args)
+	if err != nil {
+		return err
+	}
+
+	in := io.Reader(os.Stdin)
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	bc, err := bitcask.Open(dir, bitcask.RWConfig)
+	if err != nil {
+		return err
+	}
+	defer bc.Close()
+
+	return bc.Import(in, format)
+}
+
+// parseTransferArgs parses the format flag and file argument of export and import.
+func parseTransferArgs(command string, args []string) (bitcask.Format, string, error) {
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	formatName := flags.String("format", "jsonl", "format of the data, jsonl, csv or binary")
+	if err := flags.Parse(args); err != nil {
+		return 0, "", err
+	}
+	if flags.NArg() > 1 {
+		return 0, "", errUsage
+	}
+
+	format, err := bitcask.ParseFormat(*formatName)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return format, flags.Arg(0), nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bitcask"
+	"bytes"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testBitcaskPath = path.Join("bitcask")
+
+func TestRun(t *testing.T) {
+	defer os.RemoveAll(testBitcaskPath)
+
+	mustRun(t, "put", "name", "salah")
+	mustRun(t, "put", "nick", "ahmed")
+	mustRun(t, "put", "age", "22")
+	mustRun(t, "delete", "age")
+
+	assertOutput(t, mustRun(t, "get", "name"), "salah\n")
+	assertOutput(t, mustRun(t, "keys"), "name\nnick\n")
+	assertOutput(t, mustRun(t, "scan", "na"), "name salah\n")
+	assertOutput(t, mustRun(t, "verify"), "ok\n")
+
+	if got := mustRun(t, "stats"); !strings.HasPrefix(got, "keys: 2\n") {
+		t.Errorf("got stats:\n%s", got)
+	}
+
+	files := bitcask.DataFiles(testBitcaskPath)
+	if len(files) == 0 {
+		t.Fatal("expected to find data files")
+	}
+	var dumped string
+	for _, file := range files {
+		dumped += mustRun(t, "dump", file)
+	}
+	if !strings.Contains(dumped, `key="name" value="salah"`) {
+		t.Errorf("expected dump to contain name, got:\n%s", dumped)
+	}
+
+	if err := run([]string{"-dir", testBitcaskPath, "unknown"}, &bytes.Buffer{}); err != errUsage {
+		t.Errorf("got %v, want usage error", err)
+	}
+}
+
+func TestVerifyCorruptedFile(t *testing.T) {
+	defer os.RemoveAll(testBitcaskPath)
+	mustRun(t, "put", "name", "salah")
+
+	file := bitcask.DataFiles(testBitcaskPath)[0]
+	data, _ := os.ReadFile(file)
+	data[len(data)-1] ^= 0xff
+	os.WriteFile(file, data, 0666)
+
+	out := &bytes.Buffer{}
+	if err := run([]string{"-dir", testBitcaskPath, "verify"}, out); err == nil {
+		t.Errorf("expected verify to fail, got output:\n%s", out)
+	}
+
+	if got := mustRun(t, "repair"); !strings.Contains(got, `lost key "name"`) {
+		t.Errorf("expected repair to report lost key, got:\n%s", got)
+	}
+	assertOutput(t, mustRun(t, "verify"), "ok\n")
+}
+
+func mustRun(t testing.TB, args ...string) string {
+	t.Helper()
+	out := &bytes.Buffer{}
+	if err := run(append([]string{"-dir", testBitcaskPath}, args...), out); err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+	return out.String()
+}
+
+func assertOutput(t testing.TB, got, want string) {
+	t.Helper()
+	if got != want {
+		t.Errorf("got:\n%q\nwant:\n%q", got, want)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	defer os.RemoveAll(testBitcaskPath)
+	exportFile := path.Join(os.TempDir(), "bitcask_export.csv")
+	defer os.Remove(exportFile)
+
+	mustRun(t, "put", "name", "salah")
+	mustRun(t, "put", "nick", "ahmed")
+	assertOutput(t, mustRun(t, "export", "-format", "csv"),
+		"key,value,encoding,timestamp,bucket\n"+exportLine(t, "name")+exportLine(t, "nick"))
+
+	mustRun(t, "export", "-format", "csv", exportFile)
+	os.RemoveAll(testBitcaskPath)
+	mustRun(t, "import", "-format", "csv", exportFile)
+	assertOutput(t, mustRun(t, "scan"), "name salah\nnick ahmed\n")
+
+	if err := run([]string{"-dir", testBitcaskPath, "export", "-format", "xml"}, &bytes.Buffer{}); !errors.Is(err, bitcask.ErrUnknownFormat) {
+		t.Errorf("got %v, want %v", err, bitcask.ErrUnknownFormat)
+	}
+}
+
+// exportLine returns the csv export line of key.
+func exportLine(t testing.TB, key string) string {
+	t.Helper()
+	bc, err := bitcask.Open(testBitcaskPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+
+	value, tStamp, _ := bc.GetWithTimeStamp([]byte(key))
+	return key + "," + string(value) + ",," + tStamp.Format(time.RFC3339Nano) + ",\n"
+}
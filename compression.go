@@ -0,0 +1,83 @@
+package bitcask
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// flateWriters holds the flate writers of compressValue, which are
+// expensive to allocate.
+var flateWriters = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// WithCompression returns a copy of the config that compresses the
+// values it writes with DEFLATE, keeping a compressed value only if it's
+// smaller. Every item records whether its value is compressed, so a
+// bitcask may mix both, and merge rewrites the values it copies with
+// the current setting.
+func (c Config) WithCompression() Config {
+	c.compression = true
+	return c
+}
+
+// compressValue compresses value, it returns false if the compressed
+// value isn't smaller.
+func compressValue(value []byte) ([]byte, bool) {
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+
+	w.Reset(&buf)
+	w.Write(value)
+	w.Close()
+
+	if buf.Len() >= len(value) {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// decompressValue decompresses a value compressed by compressValue.
+// returns err == ErrCorruptItem if it isn't a valid compressed value.
+func decompressValue(compressed []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(compressed))
+	defer r.Close()
+
+	value, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptItem, err)
+	}
+	return value, nil
+}
+
+// size returns the size of the value of record as it's stored on disk.
+func (r Record) size() int {
+	return int(r.valueSize &^ valueSizeFlags)
+}
+
+// compressed checks if the value of record is stored compressed.
+func (r Record) compressed() bool {
+	return r.valueSize&compressedValueFlag != 0
+}
+
+// valueSizeField returns the value size field of the item header, which
+// carries the flags of the value.
+func (item fileItem) valueSizeField() uint32 {
+	return binary.BigEndian.Uint32(item.raw[16:])
+}
+
+// decodedValue returns the value of the item, decompressed if needed.
+func (item fileItem) decodedValue() ([]byte, error) {
+	if !item.compressed {
+		return item.value, nil
+	}
+	return decompressValue(item.value)
+}
@@ -0,0 +1,122 @@
+package bitcask
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// jsonValue returns a value that compresses well.
+func jsonValue(i int) string {
+	return strings.Repeat(fmt.Sprintf(`{"id":%d,"name":"salah","tags":["a","b"]}`, i), 10)
+}
+
+// compressedItems counts the compressed and the other values of the data
+// files at directoryPath.
+func compressedItems(t testing.TB, directoryPath string) (compressed, raw int) {
+	t.Helper()
+	for _, file := range DataFiles(directoryPath) {
+		err := ScanDataFile(file, func(item ItemInfo) error {
+			if item.Tombstone {
+				return nil
+			}
+			if item.Compressed {
+				compressed++
+			} else {
+				raw++
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return compressed, raw
+}
+
+func TestCompression(t *testing.T) {
+	t.Run("values are compressed on disk and read back", func(t *testing.T) {
+		os.RemoveAll(testBitcaskPath)
+		bc, _ := Open(testBitcaskPath, RWsyncConfig.WithCompression())
+		bc.Put([]byte("doc"), []byte(jsonValue(1)))
+		bc.Put([]byte("small"), []byte("v"))
+
+		got, _ := bc.Get([]byte("doc"))
+		assertEqualStrings(t, string(got), jsonValue(1))
+		got, _ = bc.Get([]byte("small"))
+		assertEqualStrings(t, string(got), "v")
+		bc.Close()
+
+		if compressed, raw := compressedItems(t, testBitcaskPath); compressed != 1 || raw != 1 {
+			t.Errorf("got %d compressed and %d raw values, want 1 and 1", compressed, raw)
+		}
+		os.RemoveAll(testBitcaskPath)
+	})
+
+	t.Run("compressed and raw items are mixed", func(t *testing.T) {
+		os.RemoveAll(testBitcaskPath)
+		bc, _ := Open(testBitcaskPath, RWsyncConfig)
+		for i := 0; i < 10; i++ {
+			bc.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte(jsonValue(i)))
+		}
+		bc.Close()
+
+		bc, _ = Open(testBitcaskPath, RWsyncConfig.WithCompression())
+		for i := 10; i < 20; i++ {
+			bc.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte(jsonValue(i)))
+		}
+		crash(bc)
+
+		// the keydir is recovered from the data files
+		bc, _ = Open(testBitcaskPath)
+		for i := 0; i < 20; i++ {
+			got, _ := bc.Get([]byte("key" + fmt.Sprintf("%d", i)))
+			assertEqualStrings(t, string(got), jsonValue(i))
+		}
+		bc.Close()
+		os.RemoveAll(testBitcaskPath)
+	})
+
+	t.Run("merge rewrites values with the current setting", func(t *testing.T) {
+		os.RemoveAll(testBitcaskPath)
+		bc, _ := Open(testBitcaskPath, RWsyncConfig)
+		for i := 0; i < 20; i++ {
+			bc.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte(jsonValue(i)))
+		}
+		bc.Close()
+
+		bc, _ = Open(testBitcaskPath, RWsyncConfig.WithCompression())
+		bc.Merge()
+		bc.Close()
+		if compressed, raw := compressedItems(t, testBitcaskPath); compressed != 20 || raw != 0 {
+			t.Errorf("got %d compressed and %d raw values, want 20 and 0", compressed, raw)
+		}
+
+		bc, _ = Open(testBitcaskPath, RWsyncConfig)
+		bc.Merge()
+		for i := 0; i < 20; i++ {
+			got, _ := bc.Get([]byte("key" + fmt.Sprintf("%d", i)))
+			assertEqualStrings(t, string(got), jsonValue(i))
+		}
+		bc.Close()
+		if compressed, raw := compressedItems(t, testBitcaskPath); compressed != 0 || raw != 20 {
+			t.Errorf("got %d compressed and %d raw values, want 0 and 20", compressed, raw)
+		}
+		os.RemoveAll(testBitcaskPath)
+	})
+
+	t.Run("get view of a compressed value", func(t *testing.T) {
+		bc, _ := Open(testBitcaskPath, RWsyncConfig.WithFS(NewMemFS()).WithMmap().WithCompression())
+		bc.Put([]byte("doc"), []byte(jsonValue(1)))
+
+		err := bc.GetView([]byte("doc"), func(value []byte) error {
+			assertEqualStrings(t, string(value), jsonValue(1))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		bc.Close()
+	})
+}
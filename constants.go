@@ -3,6 +3,7 @@ package bitcask
 import (
 	"os"
 	"path"
+	"time"
 )
 
 const (
@@ -10,9 +11,54 @@ const (
 	keydirFileRecordSeprator = " "
 	keydirFileName           = "keydir.cask"
 	BitCaskFileExtension     = ".cask"
+	HintFileExtension        = ".hint"
+	BloomFileExtension       = ".bloom"
+	MergedFileExtension      = ".merged"
+	quarantineDirName        = "quarantine"
+	replicationPosFileName   = "replication.pos"
+	logTruncatedFileName     = "replication.truncated"
 	
 	MaxFileSize int64    = 1024
 
+	// itemHeaderSize is the size of crc, timestamp, key size and value size
+	// fields that precede the key and value of every file item.
+	itemHeaderSize = 20
+
+	// hintHeaderSize is the size of timestamp, key size, value size and
+	// value position fields that precede the key of every hint entry.
+	hintHeaderSize = 24
+
+	// compressedValueFlag is set in the value size field of the items,
+	// hint entries and keydir records whose value is compressed.
+	compressedValueFlag = 1 << 31
+
+	// encryptedValueFlag is set in the value size field of the items,
+	// hint entries and keydir records whose key and value are encrypted.
+	encryptedValueFlag = 1 << 30
+
+	// valueSizeFlags are the flags of the value size field.
+	valueSizeFlags = compressedValueFlag | encryptedValueFlag
+
+	// bloomBitsPerKey and bloomHashes size the bloom filters of the hint
+	// files for about 1% false positives.
+	bloomBitsPerKey = 10
+	bloomHashes     = 7
+
+	// lazyHintCacheSize is the number of parsed hint files a lazy keydir
+	// keeps for the lookups that hit their bloom filter.
+	lazyHintCacheSize = 8
+
+	// tombstoneHintPosition is the value position of tombstones in hint files.
+	tombstoneHintPosition = -1
+
+	// DefaultMaxOpenFiles is the number of data files kept open for
+	// reading unless the config sets it, see Config.WithMaxOpenFiles.
+	DefaultMaxOpenFiles = 64
+
+	// replicationHeaderSize is the size of the file name size and offset
+	// fields that precede the file name of a replication position.
+	replicationHeaderSize = 10
+
 	UserReadWrite      = os.FileMode(0666)
 	UserReadWriteExec = os.FileMode(0777)
 	NoPermissions     = os.FileMode(0000)
@@ -25,10 +71,28 @@ var (
 	RWsyncConfig  = Config {writePermission: true, syncOnPut: true}
 )
 
+// DefaultMergePolicy holds the default merge triggers and thresholds
+// from the Bitcask paper.
+var DefaultMergePolicy = MergePolicy{
+	FragMergeTrigger:      60,
+	DeadBytesMergeTrigger: 512 * 1024 * 1024,
+	FragThreshold:         40,
+	DeadBytesThreshold:    128 * 1024 * 1024,
+	SmallFileThreshold:    10 * 1024 * 1024,
+	CheckInterval:         3 * time.Minute,
+}
+
+// DefaultWatchOptions buffers 1024 events and drops the events that don't fit.
+var DefaultWatchOptions = WatchOptions{BufferSize: 1024}
+
 var (
 	testBitcaskPath   = path.Join("bitcask")
 	tetsListKeyBitcaskPath   = path.Join("bitcask_list")
 	testBitcaskMergePath   = path.Join("bitcask_merge")
+	testBitcaskAutoMergePath   = path.Join("bitcask_auto_merge")
+	testBitcaskBackupPath   = path.Join("bitcask_backup")
+	testBitcaskRestorePath   = path.Join("bitcask_restore")
+	testBitcaskFollowerPath   = path.Join("bitcask_follower")
 	testKeyDirPath    = path.Join("bitcask", "keydir.cask")
 	testFilePath      = path.Join("bitcask", "testfile.cask")
 )
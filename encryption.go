@@ -0,0 +1,405 @@
+package bitcask
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+)
+
+// encryptedFileMagic begins the hint and keydir files that are encrypted.
+// A plain hint file begins with a timestamp, which never has its top bit set.
+const encryptedFileMagic = "\xffBCE"
+
+// sealOverhead is the size the key id, the nonce and the tag add to
+// sealed data.
+const sealOverhead = 4 + 12 + 16
+
+// KeyProvider supplies the keys that encrypt a bitcask, see Config.WithEncryption.
+// Every item records the id of the key it's encrypted with, so a provider
+// keeps the keys of the items that weren't rekeyed yet.
+type KeyProvider interface {
+	// CurrentKey returns the id and the AES key of 16, 24 or 32 bytes
+	// the new items are encrypted with.
+	CurrentKey() (uint32, []byte, error)
+	// Key returns the key of id.
+	Key(id uint32) ([]byte, error)
+}
+
+// StaticKey is a KeyProvider that always returns the same key, with id 0.
+type StaticKey []byte
+
+// CurrentKey returns the key.
+func (k StaticKey) CurrentKey() (uint32, []byte, error) {
+	return 0, k, nil
+}
+
+// Key returns the key if id is 0.
+// returns err == ErrUnknownEncryptionKey otherwise.
+func (k StaticKey) Key(id uint32) ([]byte, error) {
+	if id != 0 {
+		return nil, ErrUnknownEncryptionKey
+	}
+	return k, nil
+}
+
+// KeyRing is a KeyProvider holding keys by id, the last added one is
+// the current key. It's safe to add keys while the bitcask is open.
+type KeyRing struct {
+	mu      sync.RWMutex
+	current uint32
+	keys    map[uint32][]byte
+}
+
+// NewKeyRing returns a key ring whose current key is key with id.
+func NewKeyRing(id uint32, key []byte) *KeyRing {
+	return &KeyRing{current: id, keys: map[uint32][]byte{id: key}}
+}
+
+// Add adds key with id and makes it the current key, the items written
+// before are encrypted with it once Rekey rewrites them.
+func (r *KeyRing) Add(id uint32, key []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.current = id
+	r.keys[id] = key
+}
+
+// CurrentKey returns the last added key.
+func (r *KeyRing) CurrentKey() (uint32, []byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.current, r.keys[r.current], nil
+}
+
+// Key returns the key of id.
+// returns err == ErrUnknownEncryptionKey if the ring has no such key.
+func (r *KeyRing) Key(id uint32) ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	key, ok := r.keys[id]
+	if !ok {
+		return nil, ErrUnknownEncryptionKey
+	}
+	return key, nil
+}
+
+// itemCipher encrypts the items, the hint files and the keydir file of
+// a bitcask with AES-GCM. A nil itemCipher leaves them in plain text.
+type itemCipher struct {
+	keys KeyProvider
+
+	mu        sync.RWMutex
+	currentId uint32
+	aeads     map[uint32]cipher.AEAD
+}
+
+// WithEncryption returns a copy of the config that encrypts the key and
+// the value of every item it writes, its hint files and its keydir file
+// with AES-GCM, using the current key of keys. Every item has a random
+// nonce, an authentication tag, checked on top of the crc when it's read,
+// and the id of its key. Items written before keep their format, and
+// merge rewrites the items it copies encrypted.
+func (c Config) WithEncryption(keys KeyProvider) Config {
+	c.keyProvider = keys
+	return c
+}
+
+// newItemCipher returns the cipher of the keys of keys, nil if keys is nil.
+func newItemCipher(keys KeyProvider) (*itemCipher, error) {
+	if keys == nil {
+		return nil, nil
+	}
+
+	c := &itemCipher{keys: keys, aeads: make(map[uint32]cipher.AEAD)}
+	if err := c.rotate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// newAEAD returns the AES-GCM cipher of key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEncryptionKey, err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEncryptionKey, err)
+	}
+	return aead, nil
+}
+
+// rotate makes the current key of the provider the key new data is
+// sealed with.
+func (c *itemCipher) rotate() error {
+	id, key, err := c.keys.CurrentKey()
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.currentId = id
+	c.aeads[id] = aead
+	return nil
+}
+
+// current returns the id and the cipher of the current key.
+func (c *itemCipher) current() (uint32, cipher.AEAD) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.currentId, c.aeads[c.currentId]
+}
+
+// aead returns the cipher of the key of id, asking the provider for
+// keys it hasn't seen yet.
+func (c *itemCipher) aead(id uint32) (cipher.AEAD, error) {
+	c.mu.RLock()
+	aead, ok := c.aeads[id]
+	c.mu.RUnlock()
+	if ok {
+		return aead, nil
+	}
+
+	key, err := c.keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	if aead, err = newAEAD(key); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.aeads[id] = aead
+	return aead, nil
+}
+
+// seal encrypts plaintext with the current key, it returns the key id
+// and a random nonce followed by the ciphertext and its tag.
+func (c *itemCipher) seal(plaintext, additionalData []byte) []byte {
+	id, aead := c.current()
+	nonceSize := aead.NonceSize()
+	sealed := make([]byte, 4+nonceSize, 4+nonceSize+len(plaintext)+aead.Overhead())
+	binary.BigEndian.PutUint32(sealed, id)
+	if _, err := rand.Read(sealed[4:]); err != nil {
+		panic(err)
+	}
+
+	return aead.Seal(sealed, sealed[4:], plaintext, additionalData)
+}
+
+// open decrypts data sealed by seal with the key of its key id.
+// returns err == ErrDecryptionFailed if the key or additionalData
+// don't match or the data was modified
+// err == ErrUnknownEncryptionKey if the provider doesn't have the key.
+func (c *itemCipher) open(sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < 4 {
+		return nil, ErrDecryptionFailed
+	}
+	aead, err := c.aead(sealedKeyId(sealed))
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := aead.NonceSize()
+	if len(sealed) < 4+nonceSize {
+		return nil, ErrDecryptionFailed
+	}
+	plaintext, err := aead.Open(nil, sealed[4:4+nonceSize], sealed[4+nonceSize:], additionalData)
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	return plaintext, nil
+}
+
+// sealedKeyId returns the id of the key sealed data is encrypted with.
+func sealedKeyId(sealed []byte) uint32 {
+	return binary.BigEndian.Uint32(sealed)
+}
+
+// itemData returns the additional data that binds the key or the value
+// of an item to the item's timestamp, part tells them apart.
+func itemData(timeStamp int64, part byte) []byte {
+	data := make([]byte, 9)
+	binary.BigEndian.PutUint64(data, uint64(timeStamp))
+	data[8] = part
+	return data
+}
+
+// sealItem encrypts the key and the value of an item written at timeStamp.
+func (c *itemCipher) sealItem(key, value []byte, timeStamp int64) ([]byte, []byte) {
+	return c.seal(key, itemData(timeStamp, 'k')), c.seal(value, itemData(timeStamp, 'v'))
+}
+
+// openItem decrypts the key and the value of item if it's encrypted.
+// returns err == ErrEncrypted if it's encrypted and c is nil.
+func (c *itemCipher) openItem(item *fileItem) error {
+	if !item.encrypted {
+		return nil
+	}
+	if c == nil {
+		return ErrEncrypted
+	}
+
+	timeStamp := item.timeStamp.UnixMicro()
+	key, err := c.open(item.key, itemData(timeStamp, 'k'))
+	if err != nil {
+		return err
+	}
+	value, err := c.open(item.value, itemData(timeStamp, 'v'))
+	if err != nil {
+		return err
+	}
+	item.key, item.value = key, value
+
+	return nil
+}
+
+// openValue decrypts the value of record if it's encrypted.
+func (c *itemCipher) openValue(record Record, value []byte) ([]byte, error) {
+	if !record.encrypted() {
+		return value, nil
+	}
+	if c == nil {
+		return nil, ErrEncrypted
+	}
+	return c.open(value, itemData(record.timeStamp, 'v'))
+}
+
+// sealData encrypts data, the content of the hint or keydir file name,
+// if c isn't nil.
+func (c *itemCipher) sealData(name string, data []byte) []byte {
+	if c == nil {
+		return data
+	}
+	sealed := c.seal(data, []byte(path.Base(name)))
+	return append([]byte(encryptedFileMagic), sealed...)
+}
+
+// openData decrypts data, the content of the hint or keydir file name,
+// if it's encrypted.
+// returns err == ErrEncrypted if it's encrypted and c is nil.
+func (c *itemCipher) openData(name string, data []byte) ([]byte, error) {
+	if !isEncryptedData(data) {
+		return data, nil
+	}
+	if c == nil {
+		return nil, ErrEncrypted
+	}
+	return c.open(data[len(encryptedFileMagic):], []byte(path.Base(name)))
+}
+
+// isEncryptedData checks if data, the content of a hint or keydir file,
+// is encrypted.
+func isEncryptedData(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptedFileMagic))
+}
+
+// encrypted checks if the value of record is stored encrypted.
+func (r Record) encrypted() bool {
+	return r.valueSize&encryptedValueFlag != 0
+}
+
+// keyId returns the id of the key the encrypted item is encrypted with.
+func (item fileItem) keyId() uint32 {
+	return sealedKeyId(item.raw[itemHeaderSize:])
+}
+
+// outdated checks if item isn't encrypted the way c encrypts new items,
+// that's with its current key, or not at all if c is nil.
+func (c *itemCipher) outdated(item fileItem) bool {
+	if c == nil || !item.encrypted {
+		return item.encrypted != (c != nil)
+	}
+	id, _ := c.current()
+	return item.keyId() != id
+}
+
+// RekeyProgress reports how far Rekey went.
+type RekeyProgress struct {
+	// FilesDone of the FilesTotal data files were rewritten.
+	FilesDone  int
+	FilesTotal int
+	// BytesDone of the BytesTotal bytes of these files were rewritten.
+	BytesDone  int64
+	BytesTotal int64
+}
+
+// Rekey makes the current key of the key provider the key new items are
+// encrypted with, then rewrites every data file the way Merge does, so
+// that all the items, hint files and the keydir file end up encrypted
+// with it and the older keys are no longer needed. progress, if not nil,
+// is called after every rewritten file. Reads and writes carry on while
+// the files are rewritten.
+// returns err == ErrHasNoWritePerms if the calling process has no
+// write permissions
+// err == ErrNotEncrypted if the bitcask isn't encrypted.
+func (bc *BitCask) Rekey(progress func(RekeyProgress)) error {
+	if !bc.config.writePermission {
+		return ErrHasNoWritePerms
+	}
+	if bc.cipher == nil {
+		return ErrNotEncrypted
+	}
+
+	bc.mergeMu.Lock()
+	defer bc.mergeMu.Unlock()
+
+	start := time.Now()
+	bc.mu.Lock()
+	bc.sync()
+	err := bc.cipher.rotate()
+	if err == nil && bc.cursor > 0 {
+		err = bc.startActiveFile()
+	}
+	var set *mergeSet
+	var sizes map[string]int64
+	if err == nil {
+		set, sizes = bc.freezeFiles(bc.immutableFiles()), make(map[string]int64)
+		for _, fileId := range set.files {
+			stat := bc.statOf(fileId)
+			sizes[fileId] = stat.liveBytes + stat.deadBytes
+		}
+	}
+	bc.unlock()
+	if err != nil {
+		return err
+	}
+
+	if progress != nil {
+		state := RekeyProgress{FilesTotal: len(set.files)}
+		for _, size := range sizes {
+			state.BytesTotal += size
+		}
+		set.fileMerged = func(fileId string) {
+			state.FilesDone++
+			state.BytesDone += sizes[fileId]
+			progress(state)
+		}
+	}
+
+	return bc.merge(set, start)
+}
+
+// immutableFiles returns the data files of the bitcask but the active one.
+func (bc *BitCask) immutableFiles() []string {
+	var files []string
+	for _, fileId := range dataFiles(bc.fs, bc.dirName) {
+		if fileId != bc.activeFile.Name() {
+			files = append(files, fileId)
+		}
+	}
+	return files
+}
@@ -0,0 +1,248 @@
+package bitcask
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path"
+	"testing"
+)
+
+var testEncryptionKey = StaticKey("0123456789abcdef0123456789abcdef")
+
+// assertNoPlaintext checks that no file of the bitcask at directoryPath
+// holds plaintext.
+func assertNoPlaintext(t testing.TB, directoryPath, plaintext string) {
+	t.Helper()
+	entries, _ := os.ReadDir(directoryPath)
+	for _, entry := range entries {
+		data, _ := os.ReadFile(path.Join(directoryPath, entry.Name()))
+		if bytes.Contains(data, []byte(plaintext)) {
+			t.Errorf("found %q in %s", plaintext, entry.Name())
+		}
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	config := RWsyncConfig.WithEncryption(testEncryptionKey)
+
+	t.Run("keys and values are encrypted on disk", func(t *testing.T) {
+		os.RemoveAll(testBitcaskPath)
+		bc, _ := Open(testBitcaskPath, config)
+		for i := 0; i < 50; i++ {
+			bc.Put([]byte("secretkey"+fmt.Sprintf("%d", i)), []byte("secretvalue"+fmt.Sprintf("%d", i)))
+		}
+		bc.Delete([]byte("secretkey3"))
+		bc.Merge()
+		got, _ := bc.Get([]byte("secretkey4"))
+		assertEqualStrings(t, string(got), "secretvalue4")
+		bc.Close()
+
+		assertNoPlaintext(t, testBitcaskPath, "secret")
+		os.RemoveAll(testBitcaskPath)
+	})
+
+	t.Run("keydir is read back from encrypted files", func(t *testing.T) {
+		os.RemoveAll(testBitcaskPath)
+		bc, _ := Open(testBitcaskPath, config.WithCompression())
+		for i := 0; i < 50; i++ {
+			bc.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte(jsonValue(i)))
+		}
+		bc.Delete([]byte("key3"))
+		bc.Close()
+
+		// from the keydir file
+		bc, _ = Open(testBitcaskPath, config)
+		got, _ := bc.Get([]byte("key7"))
+		assertEqualStrings(t, string(got), jsonValue(7))
+		bc.Merge()
+		bc.Put([]byte("key8"), []byte("updated"))
+		crash(bc)
+
+		// from the hint files and the data files
+		bc, _ = Open(testBitcaskPath, config.WithMmap())
+		for i := 0; i < 50; i++ {
+			got, err := bc.Get([]byte("key" + fmt.Sprintf("%d", i)))
+			switch i {
+			case 3:
+				if !errors.Is(err, ErrKeyNotExist) {
+					t.Errorf("got %v, want ErrKeyNotExist", err)
+				}
+			case 8:
+				assertEqualStrings(t, string(got), "updated")
+			default:
+				assertEqualStrings(t, string(got), jsonValue(i))
+			}
+		}
+		bc.Close()
+		os.RemoveAll(testBitcaskPath)
+	})
+
+	t.Run("open with a wrong or no key", func(t *testing.T) {
+		os.RemoveAll(testBitcaskPath)
+		bc, _ := Open(testBitcaskPath, config)
+		bc.Put([]byte("key"), []byte("value"))
+		bc.Close()
+
+		_, err := Open(testBitcaskPath, RWConfig)
+		assertErrorMsg(t, err, ErrEncrypted)
+		_, err = Open(testBitcaskPath, RWConfig.WithEncryption(StaticKey("fedcba9876543210fedcba9876543210")))
+		assertErrorMsg(t, err, ErrDecryptionFailed)
+		_, err = Open(testBitcaskPath, RWConfig.WithEncryption(StaticKey("short")))
+		if !errors.Is(err, ErrInvalidEncryptionKey) {
+			t.Errorf("got %v, want ErrInvalidEncryptionKey", err)
+		}
+
+		// the failed opens leave neither a lock nor a stale keydir behind
+		bc, err = Open(testBitcaskPath, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := bc.Get([]byte("key"))
+		assertEqualStrings(t, string(got), "value")
+		bc.Close()
+		os.RemoveAll(testBitcaskPath)
+	})
+
+	t.Run("modified item with a valid crc fails to decrypt", func(t *testing.T) {
+		os.RemoveAll(testBitcaskPath)
+		bc, _ := Open(testBitcaskPath, config)
+		bc.Put([]byte("key"), []byte("value"))
+
+		fileId := fileOf(bc, "key")
+		data, _ := os.ReadFile(fileId)
+		data[len(data)-1] ^= 0xff
+		binary.BigEndian.PutUint32(data, crc32.ChecksumIEEE(data[4:]))
+		os.WriteFile(fileId, data, UserReadWrite)
+		bc.readFiles.remove(fileId)
+
+		_, err := bc.Get([]byte("key"))
+		assertErrorMsg(t, err, ErrDecryptionFailed)
+		bc.Close()
+		os.RemoveAll(testBitcaskPath)
+	})
+
+	t.Run("merge encrypts the plain items", func(t *testing.T) {
+		os.RemoveAll(testBitcaskPath)
+		bc, _ := Open(testBitcaskPath, RWsyncConfig)
+		for i := 0; i < 60; i++ {
+			bc.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte("value"+fmt.Sprintf("%d", i)))
+		}
+		bc.Close()
+
+		bc, _ = Open(testBitcaskPath, config)
+		bc.Merge()
+		for i := 0; i < 60; i++ {
+			got, _ := bc.Get([]byte("key" + fmt.Sprintf("%d", i)))
+			assertEqualStrings(t, string(got), "value"+fmt.Sprintf("%d", i))
+		}
+		bc.Close()
+		assertNoPlaintext(t, testBitcaskPath, "value")
+		os.RemoveAll(testBitcaskPath)
+	})
+
+	t.Run("check, repair and restore of an encrypted store", func(t *testing.T) {
+		os.RemoveAll(testBitcaskPath)
+		os.RemoveAll(testBitcaskRestorePath)
+		bc, _ := Open(testBitcaskPath, config)
+		for i := 0; i < 20; i++ {
+			bc.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte("value"+fmt.Sprintf("%d", i)))
+		}
+		var backup bytes.Buffer
+		bc.Backup(&backup)
+		bc.Close()
+
+		report, _ := Check(testBitcaskPath)
+		if !report.OK() || !report.Encrypted {
+			t.Errorf("got report %+v, want an encrypted store without problems", report)
+		}
+		_, err := Repair(testBitcaskPath)
+		assertErrorMsg(t, err, ErrEncrypted)
+
+		if err := Restore(&backup, testBitcaskRestorePath); err != nil {
+			t.Fatal(err)
+		}
+		assertNoPlaintext(t, testBitcaskRestorePath, "value")
+		bc, _ = Open(testBitcaskRestorePath, config)
+		got, _ := bc.Get([]byte("key19"))
+		assertEqualStrings(t, string(got), "value19")
+		bc.Close()
+		os.RemoveAll(testBitcaskPath)
+		os.RemoveAll(testBitcaskRestorePath)
+	})
+
+	t.Run("rekey rewrites the items with the newest key", func(t *testing.T) {
+		os.RemoveAll(testBitcaskPath)
+		oldKey, newKey := []byte(testEncryptionKey), []byte("fedcba9876543210fedcba9876543210")
+		keys := NewKeyRing(1, oldKey)
+		bc, _ := Open(testBitcaskPath, RWsyncConfig.WithEncryption(keys))
+		for i := 0; i < 60; i++ {
+			bc.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte("value"+fmt.Sprintf("%d", i)))
+		}
+		bc.Delete([]byte("key3"))
+
+		// the items keep being read with the key of their id
+		keys.Add(2, newKey)
+		bc.Put([]byte("key8"), []byte("updated"))
+		got, _ := bc.Get([]byte("key7"))
+		assertEqualStrings(t, string(got), "value7")
+
+		var last RekeyProgress
+		calls := 0
+		err := bc.Rekey(func(progress RekeyProgress) {
+			calls++
+			last = progress
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if calls != last.FilesTotal || last.FilesDone != last.FilesTotal || last.BytesDone != last.BytesTotal || last.FilesTotal < 2 {
+			t.Errorf("got %d calls, last progress %+v, want every file done", calls, last)
+		}
+		crash(bc)
+
+		for _, file := range DataFiles(testBitcaskPath) {
+			ScanDataFile(file, func(item ItemInfo) error {
+				if item.KeyId != 2 {
+					t.Errorf("got key id %d in %s, want 2", item.KeyId, file)
+				}
+				return nil
+			})
+		}
+
+		// the old key is no longer needed
+		bc, err = Open(testBitcaskPath, RWsyncConfig.WithEncryption(NewKeyRing(2, newKey)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 60; i++ {
+			got, err := bc.Get([]byte("key" + fmt.Sprintf("%d", i)))
+			switch i {
+			case 3:
+				if !errors.Is(err, ErrKeyNotExist) {
+					t.Errorf("got %v, want ErrKeyNotExist", err)
+				}
+			case 8:
+				assertEqualStrings(t, string(got), "updated")
+			default:
+				assertEqualStrings(t, string(got), "value"+fmt.Sprintf("%d", i))
+			}
+		}
+		bc.Close()
+
+		_, err = Open(testBitcaskPath, RWsyncConfig.WithEncryption(NewKeyRing(1, oldKey)))
+		if !errors.Is(err, ErrUnknownEncryptionKey) {
+			t.Errorf("got %v, want ErrUnknownEncryptionKey", err)
+		}
+		os.RemoveAll(testBitcaskPath)
+	})
+
+	t.Run("rekey of a plain bitcask", func(t *testing.T) {
+		bc, _ := Open(testBitcaskPath, RWsyncConfig.WithFS(NewMemFS()))
+		assertErrorMsg(t, bc.Rekey(nil), ErrNotEncrypted)
+		bc.Close()
+	})
+}
@@ -5,6 +5,24 @@ var (
 	ErrHasNoWritePerms = BitCaskError("you don't have write permissions")
 	ErrKeyNotExist = BitCaskError("key doesn't exist")
 	ErrBitCaskIsLocked = BitCaskError("there is another process that locked this bitcask")
+	ErrCorruptItem = BitCaskError("data file has a corrupted item")
+	ErrTimeStampMismatch = BitCaskError("key was changed since the given timestamp")
+	ErrRestoreDirNotEmpty = BitCaskError("restore directory isn't empty")
+	ErrInvalidBackup = BitCaskError("invalid backup")
+	ErrUnknownFormat = BitCaskError("unknown export format")
+	ErrInvalidImport = BitCaskError("invalid import data")
+	ErrFollowerIsReadOnly = BitCaskError("followers only apply writes of their leader")
+	ErrNotFollower = BitCaskError("bitcask isn't opened as a follower")
+	ErrReplicationPositionLost = BitCaskError("leader no longer has the items after the replication position, seed the follower from a backup")
+	ErrInvalidReplicationStream = BitCaskError("invalid replication stream")
+	ErrBitCaskClosed = BitCaskError("bitcask is closed")
+	ErrInvalidEncryptionKey = BitCaskError("invalid encryption key")
+	ErrEncrypted = BitCaskError("bitcask is encrypted, open it with its key")
+	ErrDecryptionFailed = BitCaskError("can't decrypt, wrong encryption key or modified data")
+	ErrUnknownEncryptionKey = BitCaskError("key provider has no key with this id")
+	ErrNotEncrypted = BitCaskError("bitcask isn't encrypted")
+	ErrTooManyBuckets = BitCaskError("no bucket ids are left")
+	ErrEmptyBucketName = BitCaskError("bucket names can't be empty")
 )
 
 type BitCaskError string
@@ -0,0 +1,524 @@
+package bitcask
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+	"unicode/utf8"
+)
+
+// Format is a format of exported key/value data.
+type Format int
+
+const (
+	// JSONLines writes a json object per key with the key, the value,
+	// their encoding, the timestamp and the bucket of the key. Keys,
+	// values and buckets that aren't valid utf-8 are base64 encoded.
+	JSONLines Format = iota
+	// CSV writes a key,value,encoding,timestamp,bucket row per key after
+	// a header row.
+	CSV
+	// Binary writes a length prefixed timestamp, bucket, key and value per key.
+	Binary
+)
+
+// base64Encoding marks base64 encoded keys and values in JSONLines and CSV.
+const base64Encoding = "base64"
+
+// binaryExportMagic begins every export in the Binary format.
+// Exports made before buckets were exported begin with
+// binaryExportMagicV1 and their entries have no bucket.
+const (
+	binaryExportMagic   = "BCX2"
+	binaryExportMagicV1 = "BCX1"
+)
+
+// binaryEntryHeaderSize is the size of the timestamp, bucket size, key
+// size and value size fields that precede the bucket, key and value of
+// a Binary entry. The entries of binaryExportMagicV1 exports have no
+// bucket size field.
+const (
+	binaryEntryHeaderSize   = 20
+	binaryEntryHeaderSizeV1 = 16
+)
+
+var csvHeader = []string{"key", "value", "encoding", "timestamp", "bucket"}
+
+// csvHeaderV1 is the header of the CSV exports made before buckets
+// were exported.
+var csvHeaderV1 = csvHeader[:4]
+
+// ParseFormat returns the format named jsonl, csv or binary.
+func ParseFormat(name string) (Format, error) {
+	switch name {
+	case "jsonl":
+		return JSONLines, nil
+	case "csv":
+		return CSV, nil
+	case "binary":
+		return Binary, nil
+	}
+
+	return 0, fmt.Errorf("%q: %w", name, ErrUnknownFormat)
+}
+
+// String returns the name of the format as accepted by ParseFormat.
+func (f Format) String() string {
+	switch f {
+	case JSONLines:
+		return "jsonl"
+	case CSV:
+		return "csv"
+	case Binary:
+		return "binary"
+	}
+
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// exportEntry is a key/value pair of an export, bucket is the name of
+// the bucket of the key, empty for the default namespace.
+type exportEntry struct {
+	bucket    []byte
+	key       []byte
+	value     []byte
+	timeStamp time.Time
+}
+
+type entryEncoder interface {
+	encode(entry exportEntry) error
+	flush() error
+}
+
+type entryDecoder interface {
+	// decode returns io.EOF once there are no more entries.
+	decode() (exportEntry, error)
+}
+
+// Export writes every key/value pair of the datastore to w in format,
+// sorted by bucket and key, along with the timestamp of its last write.
+// The pairs are the ones in the datastore when Export is called, pending
+// writes are synced first. Merges wait until the export is done. The
+// pairs of the buckets are written with the name of their bucket, so
+// that Import brings the buckets back.
+// returns err wrapping ErrUnknownFormat if format is unknown.
+func (bc *BitCask) Export(w io.Writer, format Format) error {
+	enc, err := newEntryEncoder(w, format)
+	if err != nil {
+		return err
+	}
+
+	bc.mergeMu.Lock()
+	defer bc.mergeMu.Unlock()
+
+	bc.mu.Lock()
+	bc.sync()
+	names, err := bc.catalog()
+	if err != nil {
+		bc.unlock()
+		return err
+	}
+	var entries []exportEntry
+	var records []Record
+	bc.keydir.each(func(key string, record Record) {
+		id, userKey := splitNamespaceKey(key)
+		name, ok := names[id]
+		if id != defaultBucket && !ok {
+			// the catalog and meta keys, and the keys of dropped buckets.
+			return
+		}
+		entries = append(entries, exportEntry{bucket: []byte(name), key: []byte(userKey)})
+		records = append(records, record)
+	})
+	bc.unlock()
+
+	order := make([]int, len(entries))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		a, b := entries[order[i]], entries[order[j]]
+		if c := bytes.Compare(a.bucket, b.bucket); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(a.key, b.key) < 0
+	})
+
+	for _, i := range order {
+		entry := entries[i]
+		if entry.value, err = bc.readValue(records[i]); err != nil {
+			return err
+		}
+		entry.timeStamp = records[i].time()
+		if err := enc.encode(entry); err != nil {
+			return err
+		}
+	}
+
+	return enc.flush()
+}
+
+// Import reads key/value pairs in format from r and stores them.
+// If the datastore holds no items when Import starts, the pairs keep
+// their timestamps and a pair older than a pair of the same key already
+// imported is skipped. Otherwise the pairs are stored as new writes,
+// like Put, since the datastore may hold newer deletions of their keys.
+// Pairs without a timestamp are always stored as new writes.
+// The buckets of the pairs are created if they don't exist.
+// The bitcask lock is held until r is drained.
+// returns err == ErrHasNoWritePerms if the calling process has no write permissions
+// err == ErrFollowerIsReadOnly if the bitcask is a follower
+// err wrapping ErrUnknownFormat if format is unknown
+// err wrapping ErrInvalidImport if r isn't valid in format.
+func (bc *BitCask) Import(r io.Reader, format Format) error {
+	if err := bc.checkWritable(); err != nil {
+		return err
+	}
+
+	dec, err := newEntryDecoder(r, format)
+	if err != nil {
+		return err
+	}
+
+	bc.mu.Lock()
+	defer bc.unlock()
+
+	bc.sync()
+	err = bc.importEntries(dec, bc.isEmpty())
+	// the imported pairs are synced at once, like Put syncs its write.
+	if bc.config.syncOnPut {
+		if syncErr := bc.syncActiveFile(); err == nil {
+			err = syncErr
+		}
+	}
+
+	return err
+}
+
+// importEntries stores the pairs decoded by dec, with their timestamps
+// if keepTimeStamps is set, see Import. The caller holds the bitcask
+// write lock.
+func (bc *BitCask) importEntries(dec entryDecoder, keepTimeStamps bool) error {
+	ids := make(map[string]uint32)
+	for n := 1; ; n++ {
+		entry, err := dec.decode()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: entry %d: %v", ErrInvalidImport, n, err)
+		}
+
+		// the buckets get the ids of this datastore, the ones they had
+		// in the exported datastore aren't kept.
+		id := uint32(defaultBucket)
+		if len(entry.bucket) > 0 {
+			var ok bool
+			if id, ok = ids[string(entry.bucket)]; !ok {
+				if id, err = bc.createBucket(string(entry.bucket)); err != nil {
+					return err
+				}
+				ids[string(entry.bucket)] = id
+			}
+		}
+		key := namespaceKey(id, entry.key)
+
+		if !keepTimeStamps || entry.timeStamp.IsZero() {
+			if _, err := bc.writeKeyValue(key, entry.value); err != nil {
+				return err
+			}
+			continue
+		}
+
+		tStamp := entry.timeStamp.Truncate(time.Microsecond)
+		if record, ok := bc.keydir.get(string(key)); ok && record.timeStamp >= tStamp.UnixMicro() {
+			continue
+		}
+		if tStamp.After(bc.lastTimeStamp) {
+			bc.lastTimeStamp = tStamp
+		}
+		if err := bc.writeItem(key, entry.value, tStamp); err != nil {
+			return err
+		}
+	}
+}
+
+// isEmpty checks if no item was ever written to the data files.
+func (bc *BitCask) isEmpty() bool {
+	for _, stat := range bc.fileStats {
+		if stat.liveBytes+stat.deadBytes > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func newEntryEncoder(w io.Writer, format Format) (entryEncoder, error) {
+	buf := bufio.NewWriter(w)
+
+	switch format {
+	case JSONLines:
+		return &jsonEncoder{buf, json.NewEncoder(buf)}, nil
+	case CSV:
+		return &csvEncoder{writer: csv.NewWriter(buf), buf: buf}, nil
+	case Binary:
+		if _, err := buf.WriteString(binaryExportMagic); err != nil {
+			return nil, err
+		}
+		return &binaryEncoder{buf}, nil
+	}
+
+	return nil, fmt.Errorf("%v: %w", format, ErrUnknownFormat)
+}
+
+func newEntryDecoder(r io.Reader, format Format) (entryDecoder, error) {
+	buf := bufio.NewReader(r)
+
+	switch format {
+	case JSONLines:
+		return &jsonDecoder{json.NewDecoder(buf)}, nil
+	case CSV:
+		return &csvDecoder{reader: csv.NewReader(buf)}, nil
+	case Binary:
+		magic := make([]byte, len(binaryExportMagic))
+		if _, err := io.ReadFull(buf, magic); err != nil {
+			return nil, fmt.Errorf("%w: not a binary export", ErrInvalidImport)
+		}
+		switch string(magic) {
+		case binaryExportMagic:
+			return &binaryDecoder{buf, true}, nil
+		case binaryExportMagicV1:
+			return &binaryDecoder{buf, false}, nil
+		}
+		return nil, fmt.Errorf("%w: not a binary export", ErrInvalidImport)
+	}
+
+	return nil, fmt.Errorf("%v: %w", format, ErrUnknownFormat)
+}
+
+// encodeText returns bucket, key and value as text, base64 encoded if
+// any of them isn't valid utf-8, along with their encoding.
+func encodeText(bucket, key, value []byte) (string, string, string, string) {
+	if utf8.Valid(bucket) && utf8.Valid(key) && utf8.Valid(value) {
+		return string(bucket), string(key), string(value), ""
+	}
+
+	encode := base64.StdEncoding.EncodeToString
+	return encode(bucket), encode(key), encode(value), base64Encoding
+}
+
+// decodeText reverses encodeText.
+func decodeText(bucket, key, value, encoding string) ([]byte, []byte, []byte, error) {
+	switch encoding {
+	case "":
+		return []byte(bucket), []byte(key), []byte(value), nil
+	case base64Encoding:
+		b, err := base64.StdEncoding.DecodeString(bucket)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		k, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		v, err := base64.StdEncoding.DecodeString(value)
+		return b, k, v, err
+	}
+
+	return nil, nil, nil, fmt.Errorf("unknown encoding %q", encoding)
+}
+
+// parseTimeStamp parses an RFC 3339 timestamp, an empty one is zero.
+func parseTimeStamp(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+type jsonEntry struct {
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	Encoding  string `json:"encoding,omitempty"`
+	TimeStamp string `json:"timestamp,omitempty"`
+	Bucket    string `json:"bucket,omitempty"`
+}
+
+type jsonEncoder struct {
+	buf *bufio.Writer
+	enc *json.Encoder
+}
+
+func (e *jsonEncoder) encode(entry exportEntry) error {
+	bucket, key, value, encoding := encodeText(entry.bucket, entry.key, entry.value)
+	return e.enc.Encode(jsonEntry{key, value, encoding, entry.timeStamp.Format(time.RFC3339Nano), bucket})
+}
+
+func (e *jsonEncoder) flush() error {
+	return e.buf.Flush()
+}
+
+type jsonDecoder struct {
+	dec *json.Decoder
+}
+
+func (d *jsonDecoder) decode() (exportEntry, error) {
+	var entry jsonEntry
+	if err := d.dec.Decode(&entry); err != nil {
+		return exportEntry{}, err
+	}
+
+	bucket, key, value, err := decodeText(entry.Bucket, entry.Key, entry.Value, entry.Encoding)
+	if err != nil {
+		return exportEntry{}, err
+	}
+	tStamp, err := parseTimeStamp(entry.TimeStamp)
+
+	return exportEntry{bucket, key, value, tStamp}, err
+}
+
+type csvEncoder struct {
+	writer      *csv.Writer
+	buf         *bufio.Writer
+	wroteHeader bool
+}
+
+func (e *csvEncoder) encode(entry exportEntry) error {
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+
+	bucket, key, value, encoding := encodeText(entry.bucket, entry.key, entry.value)
+	return e.writer.Write([]string{key, value, encoding, entry.timeStamp.Format(time.RFC3339Nano), bucket})
+}
+
+func (e *csvEncoder) writeHeader() error {
+	if e.wroteHeader {
+		return nil
+	}
+	e.wroteHeader = true
+
+	return e.writer.Write(csvHeader)
+}
+
+func (e *csvEncoder) flush() error {
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+	e.writer.Flush()
+	if err := e.writer.Error(); err != nil {
+		return err
+	}
+
+	return e.buf.Flush()
+}
+
+type csvDecoder struct {
+	reader     *csv.Reader
+	readHeader bool
+}
+
+func (d *csvDecoder) decode() (exportEntry, error) {
+	if !d.readHeader {
+		d.readHeader = true
+		header, err := d.reader.Read()
+		if err != nil {
+			return exportEntry{}, err
+		}
+		if fmt.Sprint(header) != fmt.Sprint(csvHeader) && fmt.Sprint(header) != fmt.Sprint(csvHeaderV1) {
+			return exportEntry{}, fmt.Errorf("header isn't %v", csvHeader)
+		}
+	}
+
+	row, err := d.reader.Read()
+	if err != nil {
+		return exportEntry{}, err
+	}
+
+	var bucket string
+	if len(row) > len(csvHeaderV1) {
+		bucket = row[4]
+	}
+	b, key, value, err := decodeText(bucket, row[0], row[1], row[2])
+	if err != nil {
+		return exportEntry{}, err
+	}
+	tStamp, err := parseTimeStamp(row[3])
+
+	return exportEntry{b, key, value, tStamp}, err
+}
+
+type binaryEncoder struct {
+	buf *bufio.Writer
+}
+
+func (e *binaryEncoder) encode(entry exportEntry) error {
+	header := make([]byte, binaryEntryHeaderSize)
+	binary.BigEndian.PutUint64(header[0:], uint64(entry.timeStamp.UnixMicro()))
+	binary.BigEndian.PutUint32(header[8:], uint32(len(entry.bucket)))
+	binary.BigEndian.PutUint32(header[12:], uint32(len(entry.key)))
+	binary.BigEndian.PutUint32(header[16:], uint32(len(entry.value)))
+
+	e.buf.Write(header)
+	e.buf.Write(entry.bucket)
+	e.buf.Write(entry.key)
+	_, err := e.buf.Write(entry.value)
+	return err
+}
+
+func (e *binaryEncoder) flush() error {
+	return e.buf.Flush()
+}
+
+type binaryDecoder struct {
+	reader io.Reader
+	// buckets is set if the entries have a bucket, see binaryExportMagicV1.
+	buckets bool
+}
+
+func (d *binaryDecoder) decode() (exportEntry, error) {
+	headerSize := binaryEntryHeaderSizeV1
+	if d.buckets {
+		headerSize = binaryEntryHeaderSize
+	}
+	header := make([]byte, headerSize)
+	if n, err := io.ReadFull(d.reader, header); err != nil {
+		if n == 0 && err == io.EOF {
+			return exportEntry{}, io.EOF
+		}
+		return exportEntry{}, io.ErrUnexpectedEOF
+	}
+
+	var bucketSize int64
+	if d.buckets {
+		bucketSize = int64(binary.BigEndian.Uint32(header[8:]))
+	}
+	keySize := int64(binary.BigEndian.Uint32(header[headerSize-8:]))
+	valueSize := int64(binary.BigEndian.Uint32(header[headerSize-4:]))
+
+	var data bytes.Buffer
+	if n, _ := io.CopyN(&data, d.reader, bucketSize+keySize+valueSize); n != bucketSize+keySize+valueSize {
+		return exportEntry{}, io.ErrUnexpectedEOF
+	}
+
+	var tStamp time.Time
+	if micro := int64(binary.BigEndian.Uint64(header)); micro != 0 {
+		tStamp = time.UnixMicro(micro)
+	}
+
+	return exportEntry{
+		bucket:    data.Bytes()[:bucketSize],
+		key:       data.Bytes()[bucketSize : bucketSize+keySize],
+		value:     data.Bytes()[bucketSize+keySize:],
+		timeStamp: tStamp,
+	}, nil
+}
@@ -0,0 +1,161 @@
+package bitcask
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	for _, format := range []Format{JSONLines, CSV, Binary} {
+		t.Run(format.String()+" round trip keeps values and timestamps", func(t *testing.T) {
+			fsys := NewMemFS()
+			bc, _ := Open(testBitcaskBackupPath, RWConfig.WithFS(fsys))
+			defer bc.Close()
+			for i := 0; i < 50; i++ {
+				bc.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte("value,\"\n"+fmt.Sprintf("%d", i)))
+			}
+			bc.Put([]byte("binary"), []byte{0, 0xff, 0xfe})
+			bc.Delete([]byte("key0"))
+
+			var export bytes.Buffer
+			if err := bc.Export(&export, format); err != nil {
+				t.Fatalf("unexpected export error: %v", err)
+			}
+
+			target, _ := Open(testBitcaskRestorePath, RWConfig.WithFS(fsys))
+			defer target.Close()
+			if err := target.Import(&export, format); err != nil {
+				t.Fatalf("unexpected import error: %v", err)
+			}
+
+			if len(target.ListKeys()) != 50 {
+				t.Errorf("got %d keys, want 50", len(target.ListKeys()))
+			}
+			got, _ := target.Get([]byte("binary"))
+			assertEqualStrings(t, string(got), "\x00\xff\xfe")
+			got, _ = target.Get([]byte("key7"))
+			assertEqualStrings(t, string(got), "value,\"\n7")
+			_, err := target.Get([]byte("key0"))
+			assertErrorMsg(t, err, BitCaskError("\"key0\": key doesn't exist"))
+
+			_, want, _ := bc.GetWithTimeStamp([]byte("key7"))
+			_, tStamp, _ := target.GetWithTimeStamp([]byte("key7"))
+			if !tStamp.Equal(want) {
+				t.Errorf("got timestamp %v, want %v", tStamp, want)
+			}
+		})
+	}
+
+	for _, format := range []Format{JSONLines, CSV, Binary} {
+		t.Run(format.String()+" import into a store with buckets", func(t *testing.T) {
+			fsys := NewMemFS()
+			bc, _ := Open(testBitcaskBackupPath, RWConfig.WithFS(fsys))
+			defer bc.Close()
+			bc.Bucket("users").Put([]byte("key"), []byte("user"))
+			bc.Bucket("dropped").Put([]byte("key"), []byte("dropped"))
+			bc.DropBucket("dropped")
+			bc.Put([]byte(escapedKeyPrefix+"key"), []byte("root"))
+
+			var export bytes.Buffer
+			if err := bc.Export(&export, format); err != nil {
+				t.Fatalf("unexpected export error: %v", err)
+			}
+
+			target, _ := Open(testBitcaskRestorePath, RWConfig.WithFS(fsys))
+			defer target.Close()
+			target.Bucket("orders").Put([]byte("key"), []byte("order"))
+			if err := target.Import(&export, format); err != nil {
+				t.Fatalf("unexpected import error: %v", err)
+			}
+
+			got, _ := target.Bucket("orders").Get([]byte("key"))
+			assertEqualStrings(t, string(got), "order")
+			got, _ = target.Bucket("users").Get([]byte("key"))
+			assertEqualStrings(t, string(got), "user")
+			got, _ = target.Get([]byte(escapedKeyPrefix + "key"))
+			assertEqualStrings(t, string(got), "root")
+			assertEqualStrings(t, fmt.Sprint(sortedKeys(target.ListKeys())), fmt.Sprintf("[%s]", escapedKeyPrefix+"key"))
+			if target.Bucket("dropped").Has([]byte("key")) {
+				t.Errorf("expected the keys of dropped buckets not to be exported")
+			}
+		})
+	}
+
+	t.Run("import into a store with data makes new writes", func(t *testing.T) {
+		fsys := NewMemFS()
+		bc, _ := Open(testBitcaskRestorePath, RWConfig.WithFS(fsys))
+		bc.Put([]byte("key"), []byte("old"))
+		bc.Delete([]byte("key"))
+
+		data := `{"key":"key","value":"imported","timestamp":"2020-01-01T00:00:00Z"}` + "\n"
+		if err := bc.Import(strings.NewReader(data), JSONLines); err != nil {
+			t.Fatalf("unexpected import error: %v", err)
+		}
+		crash(bc)
+
+		bc, _ = Open(testBitcaskRestorePath, DefaultConfig.WithFS(fsys))
+		defer bc.Close()
+		got, tStamp, _ := bc.GetWithTimeStamp([]byte("key"))
+		assertEqualStrings(t, string(got), "imported")
+		if tStamp.Year() == 2020 {
+			t.Errorf("expected a new timestamp, got %v", tStamp)
+		}
+	})
+
+	t.Run("synced import survives a crash", func(t *testing.T) {
+		fsys := newFaultFS(1)
+		bc, err := Open(testBitcaskRestorePath, RWsyncConfig.WithFS(fsys))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := `{"key":"a","value":"1"}` + "\n" + `{"key":"b","value":"2"}` + "\n"
+		if err := bc.Import(strings.NewReader(data), JSONLines); err != nil {
+			t.Fatalf("unexpected import error: %v", err)
+		}
+		crash(bc)
+		fsys.crash()
+
+		bc, err = Open(testBitcaskRestorePath, DefaultConfig.WithFS(fsys))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bc.Close()
+		got, _ := bc.Get([]byte("b"))
+		assertEqualStrings(t, string(got), "2")
+	})
+
+	t.Run("invalid data", func(t *testing.T) {
+		bc, _ := Open(testBitcaskRestorePath, RWConfig.WithFS(NewMemFS()))
+		defer bc.Close()
+
+		var tests = []struct {
+			format Format
+			data   string
+		}{
+			{JSONLines, `{"key":"a","value":"b"}` + "\n" + `{"key":`},
+			{JSONLines, `{"key":"a","value":"b","encoding":"hex"}`},
+			{CSV, "a,b\n"},
+			{Binary, "BCX1\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00\x00\x05ab"},
+			{Binary, "not binary"},
+		}
+		for _, tt := range tests {
+			if err := bc.Import(strings.NewReader(tt.data), tt.format); !errors.Is(err, ErrInvalidImport) {
+				t.Errorf("%v %q: got %v, want %v", tt.format, tt.data, err, ErrInvalidImport)
+			}
+		}
+	})
+
+	t.Run("parse format", func(t *testing.T) {
+		for _, format := range []Format{JSONLines, CSV, Binary} {
+			if got, err := ParseFormat(format.String()); got != format || err != nil {
+				t.Errorf("got %v, %v, want %v", got, err, format)
+			}
+		}
+		if _, err := ParseFormat("xml"); !errors.Is(err, ErrUnknownFormat) {
+			t.Errorf("got %v, want %v", err, ErrUnknownFormat)
+		}
+	})
+}
@@ -0,0 +1,373 @@
+package bitcask
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// errInjected is the default error of the writes failed by a faultFS.
+var errInjected = errors.New("injected write failure")
+
+// faultFS is a MemFS that fails writes and simulates crashes. Only the
+// data of a file that was synced is sure to survive a crash, and renames
+// are only sure to survive once a file is synced after them.
+type faultFS struct {
+	*MemFS
+
+	mu   sync.Mutex
+	rand *rand.Rand
+	// writeLimit is the number of bytes writes may still write before
+	// they fail with writeErr, negative for no limit.
+	writeLimit int64
+	writeErr   error
+	// tornWrites keeps a random part of the unsynced data of every
+	// file in a crash, instead of dropping all of it.
+	tornWrites bool
+	// reorderRenames undoes a random subset of the renames that aren't
+	// sure to survive a crash.
+	reorderRenames bool
+
+	synced  map[*memData][]byte
+	renames []pendingRename
+}
+
+// pendingRename is a rename that isn't sure to survive a crash yet.
+type pendingRename struct {
+	oldName, newName string
+	data, replaced   *memData
+}
+
+// faultFile is an open faultFS file.
+type faultFile struct {
+	File
+	fsys *faultFS
+	data *memData
+}
+
+// newFaultFS returns an empty faultFS whose random choices follow seed.
+func newFaultFS(seed int64) *faultFS {
+	return &faultFS{
+		MemFS:      NewMemFS(),
+		rand:       rand.New(rand.NewSource(seed)),
+		writeLimit: -1,
+		writeErr:   errInjected,
+		synced:     make(map[*memData][]byte),
+	}
+}
+
+// failWritesAfter makes the writes fail with err once n more bytes are written.
+func (fsys *faultFS) failWritesAfter(n int64, err error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	fsys.writeLimit = n
+	fsys.writeErr = err
+}
+
+// crash drops what a crash of the machine could lose and lifts the write limit.
+func (fsys *faultFS) crash() {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	fsys.MemFS.mu.Lock()
+	defer fsys.MemFS.mu.Unlock()
+
+	for i := len(fsys.renames) - 1; i >= 0; i-- {
+		rename := fsys.renames[i]
+		if fsys.files[rename.newName] != rename.data || (fsys.reorderRenames && fsys.rand.Intn(2) == 0) {
+			continue
+		}
+		fsys.files[rename.oldName] = rename.data
+		delete(fsys.files, rename.newName)
+		if rename.replaced != nil {
+			fsys.files[rename.newName] = rename.replaced
+		}
+	}
+
+	for name, data := range fsys.files {
+		synced := fsys.synced[data]
+		kept := append([]byte{}, synced...)
+		if fsys.tornWrites && len(data.data) > len(synced) && string(data.data[:len(synced)]) == string(synced) {
+			unsynced := data.data[len(synced):]
+			kept = append(kept, unsynced[:fsys.rand.Intn(len(unsynced)+1)]...)
+		}
+
+		crashed := &memData{data: kept, perm: data.perm, modTime: data.modTime}
+		fsys.files[name] = crashed
+		fsys.synced[crashed] = kept
+	}
+
+	fsys.renames = nil
+	fsys.writeLimit = -1
+}
+
+func (fsys *faultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := fsys.MemFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &faultFile{File: file, fsys: fsys, data: file.(*memFile).data}, nil
+}
+
+func (fsys *faultFS) Rename(oldName, newName string) error {
+	oldName, newName = path.Clean(oldName), path.Clean(newName)
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	fsys.MemFS.mu.Lock()
+	rename := pendingRename{oldName, newName, fsys.files[oldName], fsys.files[newName]}
+	fsys.MemFS.mu.Unlock()
+
+	if err := fsys.MemFS.Rename(oldName, newName); err != nil {
+		return err
+	}
+	fsys.renames = append(fsys.renames, rename)
+
+	return nil
+}
+
+func (f *faultFile) Write(b []byte) (int, error) {
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+
+	limit := f.fsys.writeLimit
+	if limit < 0 || int64(len(b)) <= limit {
+		n, err := f.File.Write(b)
+		if limit >= 0 {
+			f.fsys.writeLimit -= int64(n)
+		}
+		return n, err
+	}
+
+	n, _ := f.File.Write(b[:limit])
+	f.fsys.writeLimit = 0
+	return n, &os.PathError{Op: "write", Path: f.Name(), Err: f.fsys.writeErr}
+}
+
+func (f *faultFile) Sync() error {
+	if err := f.File.Sync(); err != nil {
+		return err
+	}
+
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+
+	f.data.mu.RLock()
+	f.fsys.synced[f.data] = append([]byte{}, f.data.data...)
+	f.data.mu.RUnlock()
+	f.fsys.renames = nil
+
+	return nil
+}
+
+// crashHistory records the writes of a workload to tell the values a
+// key may have after a crash.
+type crashHistory struct {
+	// writes holds the values written to every key in order, with
+	// an empty string for a delete.
+	writes map[string][]string
+	// synced is the number of writes of every key synced to disk.
+	synced map[string]int
+}
+
+// runCrashWorkload puts, deletes, syncs and merges keys until a write
+// fails, and records what was synced in history.
+func runCrashWorkload(bc *BitCask, history *crashHistory) {
+	for i := 0; i < 400; i++ {
+		key := "key" + fmt.Sprintf("%d", i%20)
+		value := "value" + fmt.Sprintf("%d", i)
+
+		var err error
+		switch {
+		case i%50 == 49:
+			err = bc.Merge()
+		case i%7 == 3:
+			history.writes[key] = append(history.writes[key], "")
+			err = bc.Delete([]byte(key))
+		default:
+			history.writes[key] = append(history.writes[key], value)
+			err = bc.Put([]byte(key), []byte(value))
+		}
+		if err == nil && (i%10 == 9 || i == 399) {
+			err = bc.Sync()
+			if err == nil {
+				for key, writes := range history.writes {
+					history.synced[key] = len(writes)
+				}
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// assertRecovered checks that every key of bc holds its synced value
+// or one written after it, and never a value that wasn't written.
+func assertRecovered(t testing.TB, bc *BitCask, history *crashHistory) {
+	t.Helper()
+
+	for key, writes := range history.writes {
+		allowed := writes[history.synced[key]:]
+		if history.synced[key] > 0 {
+			allowed = writes[history.synced[key]-1:]
+		} else {
+			allowed = append([]string{""}, allowed...)
+		}
+
+		value, err := bc.Get([]byte(key))
+		if err != nil && !errors.Is(err, ErrKeyNotExist) {
+			t.Errorf("%q: unexpected error %v", key, err)
+			continue
+		}
+		found := false
+		for _, want := range allowed {
+			found = found || want == string(value)
+		}
+		if !found {
+			t.Errorf("%q: got %q, want one of %q", key, value, allowed)
+		}
+	}
+}
+
+func TestCrashRecovery(t *testing.T) {
+	crashAndReopen := func(t *testing.T, fsys *faultFS, bc *BitCask) *BitCask {
+		t.Helper()
+		fsys.crash()
+		// a crashed process leaves its lock behind
+		fsys.Remove(path.Join(testBitcaskPath, bc.lock))
+
+		bc, err := Open(testBitcaskPath, RWConfig.WithFS(fsys))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bc
+	}
+
+	t.Run("synced keys survive a crash after any number of written bytes", func(t *testing.T) {
+		for limit := int64(0); limit < 12000; limit += 331 {
+			fsys := newFaultFS(limit)
+			fsys.tornWrites = true
+			fsys.reorderRenames = true
+			history := &crashHistory{writes: make(map[string][]string), synced: make(map[string]int)}
+
+			bc, err := Open(testBitcaskPath, RWConfig.WithFS(fsys))
+			if err != nil {
+				t.Fatalf("limit %d: %v", limit, err)
+			}
+			fsys.failWritesAfter(limit, errInjected)
+			runCrashWorkload(bc, history)
+
+			bc = crashAndReopen(t, fsys, bc)
+			assertRecovered(t, bc, history)
+			bc.Close()
+
+			report, err := check(fsys.MemFS, testBitcaskPath)
+			if err != nil {
+				t.Fatalf("limit %d: %v", limit, err)
+			}
+			if len(report.KeydirProblems) > 0 {
+				t.Errorf("limit %d: got keydir problems %q", limit, report.KeydirProblems)
+			}
+		}
+	})
+
+	t.Run("synced keys survive crashes of a running store", func(t *testing.T) {
+		for seed := int64(0); seed < 20; seed++ {
+			fsys := newFaultFS(seed)
+			fsys.tornWrites = seed%2 == 0
+			fsys.reorderRenames = true
+			history := &crashHistory{writes: make(map[string][]string), synced: make(map[string]int)}
+
+			bc, err := Open(testBitcaskPath, RWConfig.WithFS(fsys))
+			if err != nil {
+				t.Fatalf("seed %d: %v", seed, err)
+			}
+			fsys.failWritesAfter(fsys.rand.Int63n(12000), errInjected)
+			runCrashWorkload(bc, history)
+
+			// the crash happens again after the store recovered
+			bc = crashAndReopen(t, fsys, bc)
+			assertRecovered(t, bc, history)
+			// whatever survived the crash is on disk now
+			for key := range history.writes {
+				value, _ := bc.Get([]byte(key))
+				history.writes[key] = []string{string(value)}
+				history.synced[key] = 1
+			}
+			fsys.failWritesAfter(fsys.rand.Int63n(4000), errInjected)
+			runCrashWorkload(bc, history)
+
+			bc = crashAndReopen(t, fsys, bc)
+			assertRecovered(t, bc, history)
+			bc.Close()
+		}
+	})
+
+	t.Run("writes fail with ENOSPC and succeed once there is space", func(t *testing.T) {
+		fsys := newFaultFS(0)
+		bc, err := Open(testBitcaskPath, RWsyncConfig.WithFS(fsys))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bc.Put([]byte("key"), []byte("value1"))
+
+		fsys.failWritesAfter(10, syscall.ENOSPC)
+		err = bc.Put([]byte("key"), []byte("value2"))
+		if !errors.Is(err, syscall.ENOSPC) {
+			t.Fatalf("got %v, want ENOSPC", err)
+		}
+		if err := bc.Delete([]byte("key")); !errors.Is(err, syscall.ENOSPC) {
+			t.Fatalf("got %v, want ENOSPC", err)
+		}
+		got, _ := bc.Get([]byte("key"))
+		assertEqualStrings(t, string(got), "value1")
+
+		fsys.failWritesAfter(-1, nil)
+		if err := bc.Put([]byte("key"), []byte("value3")); err != nil {
+			t.Fatal(err)
+		}
+		bc.Put([]byte("other"), []byte("value"))
+		bc.Close()
+
+		bc, err = Open(testBitcaskPath, DefaultConfig.WithFS(fsys))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ = bc.Get([]byte("key"))
+		assertEqualStrings(t, string(got), "value3")
+		got, _ = bc.Get([]byte("other"))
+		assertEqualStrings(t, string(got), "value")
+		bc.Close()
+	})
+
+	t.Run("pending writes are kept when sync fails", func(t *testing.T) {
+		fsys := newFaultFS(0)
+		bc, err := Open(testBitcaskPath, RWConfig.WithFS(fsys))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bc.Put([]byte("key"), []byte("value"))
+
+		fsys.failWritesAfter(0, syscall.ENOSPC)
+		if err := bc.Sync(); !errors.Is(err, syscall.ENOSPC) {
+			t.Fatalf("got %v, want ENOSPC", err)
+		}
+
+		fsys.failWritesAfter(-1, nil)
+		if err := bc.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		bc = crashAndReopen(t, fsys, bc)
+		got, _ := bc.Get([]byte("key"))
+		assertEqualStrings(t, string(got), "value")
+		bc.Close()
+	})
+}
@@ -0,0 +1,156 @@
+package bitcask
+
+import (
+	"container/list"
+	"sync"
+)
+
+// filePool keeps the least recently used data files open for reading,
+// so that reads don't open and close a file every time. It's safe for
+// concurrent use.
+type filePool struct {
+	mu       sync.Mutex
+	fsys     FS
+	capacity int
+	mmap     bool
+	files    map[string]*list.Element
+	lru      *list.List
+}
+
+// pooledFile is a data file opened by a filePool, along with its
+// mapping if it's mapped into memory. It stays open and mapped while
+// it's in use, even if the pool drops it.
+type pooledFile struct {
+	fileId  string
+	file    File
+	mapping []byte
+	unmap   func() error
+	refs    int
+	dropped bool
+}
+
+// WithMaxOpenFiles returns a copy of the config that keeps up to n data
+// files open for reading, DefaultMaxOpenFiles if it isn't set.
+// If n is negative, every read opens and closes its data file.
+func (c Config) WithMaxOpenFiles(n int) Config {
+	c.maxOpenFiles = n
+	return c
+}
+
+// openFiles returns the number of data files to keep open for reading.
+func (c Config) openFiles() int {
+	if c.maxOpenFiles == 0 {
+		return DefaultMaxOpenFiles
+	}
+	if c.maxOpenFiles < 0 {
+		return 0
+	}
+	return c.maxOpenFiles
+}
+
+// newFilePool returns a pool that keeps up to capacity files of fsys
+// open, mapped into memory if mmap is set.
+func newFilePool(fsys FS, capacity int, mmap bool) *filePool {
+	return &filePool{
+		fsys:     fsys,
+		capacity: capacity,
+		mmap:     mmap,
+		files:    make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// get returns the open data file fileId, which the caller releases
+// once it's done reading.
+func (p *filePool) get(fileId string) (*pooledFile, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if elem, ok := p.files[fileId]; ok {
+		p.lru.MoveToFront(elem)
+		pf := elem.Value.(*pooledFile)
+		pf.refs++
+		return pf, nil
+	}
+
+	file, err := openFile(p.fsys, fileId)
+	if err != nil {
+		return nil, err
+	}
+	pf := &pooledFile{fileId: fileId, file: file, refs: 1}
+	if p.mmap {
+		pf.mapping, pf.unmap = mapFile(file)
+	}
+	if p.capacity == 0 {
+		pf.dropped = true
+		return pf, nil
+	}
+
+	p.files[fileId] = p.lru.PushFront(pf)
+	for p.lru.Len() > p.capacity {
+		p.drop(p.lru.Back())
+	}
+
+	return pf, nil
+}
+
+// release gives back a file returned by get.
+func (p *filePool) release(pf *pooledFile) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pf.refs--
+	if pf.dropped && pf.refs == 0 {
+		pf.close()
+	}
+}
+
+// remove closes the data file fileId if it's open, it's called when
+// the file is deleted.
+func (p *filePool) remove(fileId string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if elem, ok := p.files[fileId]; ok {
+		p.drop(elem)
+	}
+}
+
+// close closes every file of the pool once it's not in use.
+func (p *filePool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for p.lru.Len() > 0 {
+		p.drop(p.lru.Back())
+	}
+}
+
+// len returns the number of files kept open by the pool.
+func (p *filePool) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.lru.Len()
+}
+
+// drop removes the file of elem from the pool and closes it, or leaves
+// it to be closed by the last release if it's in use.
+func (p *filePool) drop(elem *list.Element) {
+	pf := p.lru.Remove(elem).(*pooledFile)
+	delete(p.files, pf.fileId)
+
+	pf.dropped = true
+	if pf.refs == 0 {
+		pf.close()
+	}
+}
+
+// close unmaps and closes the file.
+func (pf *pooledFile) close() {
+	if pf.unmap != nil {
+		pf.unmap()
+	}
+	pf.mapping = nil
+	pf.file.Close()
+}
@@ -0,0 +1,164 @@
+package bitcask
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestFilePool(t *testing.T) {
+	fsys := NewMemFS()
+	for i := 0; i < 4; i++ {
+		writeFile(fsys, fmt.Sprintf("%d.cask", i), []byte("data"), UserReadWrite)
+	}
+	isClosed := func(pf *pooledFile) bool {
+		return pf.file.(*memFile).closed
+	}
+
+	t.Run("least recently used files are closed", func(t *testing.T) {
+		pool := newFilePool(fsys, 2, false)
+		first, _ := pool.get("0.cask")
+		pool.release(first)
+		second, _ := pool.get("1.cask")
+		pool.release(second)
+
+		again, _ := pool.get("0.cask")
+		pool.release(again)
+		if again != first {
+			t.Errorf("expected the open file to be reused")
+		}
+
+		third, _ := pool.get("2.cask")
+		pool.release(third)
+		if pool.len() != 2 {
+			t.Errorf("got %d open files, want 2", pool.len())
+		}
+		if !isClosed(second) || isClosed(first) {
+			t.Errorf("expected only the least recently used file to be closed")
+		}
+		pool.close()
+	})
+
+	t.Run("files in use stay open until released", func(t *testing.T) {
+		pool := newFilePool(fsys, 1, false)
+		inUse, _ := pool.get("0.cask")
+		other, _ := pool.get("1.cask")
+		pool.release(other)
+		pool.remove("1.cask")
+
+		if isClosed(inUse) {
+			t.Errorf("expected the file in use to stay open")
+		}
+		if !isClosed(other) {
+			t.Errorf("expected the removed file to be closed")
+		}
+		pool.release(inUse)
+		if !isClosed(inUse) {
+			t.Errorf("expected the dropped file to be closed once released")
+		}
+	})
+
+	t.Run("pool of no files opens a file per read", func(t *testing.T) {
+		pool := newFilePool(fsys, 0, false)
+		pf, _ := pool.get("0.cask")
+		pool.release(pf)
+
+		if pool.len() != 0 || !isClosed(pf) {
+			t.Errorf("expected the file to be closed after the read")
+		}
+	})
+}
+
+func TestReadFilePool(t *testing.T) {
+	t.Run("gets keep a bounded number of files open", func(t *testing.T) {
+		bc, _ := Open(testBitcaskPath, RWsyncConfig.WithFS(NewMemFS()).WithMaxOpenFiles(3))
+		for i := 0; i < 200; i++ {
+			bc.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte("value"+fmt.Sprintf("%d", i)))
+		}
+
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 200; i++ {
+					got, _ := bc.Get([]byte("key" + fmt.Sprintf("%d", i)))
+					assertEqualStrings(t, string(got), "value"+fmt.Sprintf("%d", i))
+				}
+			}()
+		}
+		wg.Wait()
+
+		if n := bc.readFiles.len(); n != 3 {
+			t.Errorf("got %d open files, want 3", n)
+		}
+		bc.Close()
+	})
+
+	t.Run("merged files are dropped from the pool", func(t *testing.T) {
+		bc, _ := Open(testBitcaskPath, RWsyncConfig.WithFS(NewMemFS()))
+		for i := 0; i < 200; i++ {
+			bc.Put([]byte("key"+fmt.Sprintf("%d", i%10)), []byte("value"+fmt.Sprintf("%d", i)))
+		}
+		for i := 0; i < 10; i++ {
+			bc.Get([]byte("key" + fmt.Sprintf("%d", i)))
+		}
+		bc.Merge()
+
+		for fileId := range bc.readFiles.files {
+			if _, err := bc.fs.Stat(fileId); err != nil {
+				t.Errorf("expected deleted file %q to be dropped", fileId)
+			}
+		}
+		for i := 0; i < 10; i++ {
+			got, _ := bc.Get([]byte("key" + fmt.Sprintf("%d", i)))
+			assertEqualStrings(t, string(got), "value"+fmt.Sprintf("%d", 190+i))
+		}
+		bc.Close()
+	})
+}
+
+// benchmarkGet reads random keys spread over many data files of a
+// bitcask opened with config.
+func benchmarkGet(b *testing.B, config Config) {
+	os.RemoveAll(testBitcaskPath)
+	defer os.RemoveAll(testBitcaskPath)
+
+	bc, _ := Open(testBitcaskPath, config)
+	for i := 0; i < 1000; i++ {
+		bc.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte("value"+fmt.Sprintf("%d", i)))
+	}
+	bc.Sync()
+	defer bc.Close()
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = []byte("key" + fmt.Sprintf("%d", (i*7919)%1000))
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if _, err := bc.Get(keys[i%len(keys)]); err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkGet(b *testing.B) {
+	b.Run("pooled files", func(b *testing.B) {
+		benchmarkGet(b, RWConfig)
+	})
+	b.Run("file opened per read", func(b *testing.B) {
+		benchmarkGet(b, RWConfig.WithMaxOpenFiles(-1))
+	})
+	b.Run("mapped files", func(b *testing.B) {
+		benchmarkGet(b, RWConfig.WithMmap())
+	})
+	b.Run("pooled files in memory", func(b *testing.B) {
+		benchmarkGet(b, RWConfig.WithFS(NewMemFS()))
+	})
+}
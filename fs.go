@@ -0,0 +1,442 @@
+package bitcask
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File is an open file of a FS.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+}
+
+// FS is a file system the bitcask stores its files in, see Config.WithFS.
+// Its methods behave like the functions of the os package of the same name.
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Remove(name string) error
+	RemoveAll(name string) error
+	Rename(oldName, newName string) error
+	MkdirAll(name string, perm os.FileMode) error
+	Stat(name string) (os.FileInfo, error)
+	// ReadDir returns the entries of the directory name sorted by name.
+	ReadDir(name string) ([]os.FileInfo, error)
+}
+
+// OSFS is the file system of the operating system, used by default.
+var OSFS FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (osFS) Remove(name string) error                     { return os.Remove(name) }
+func (osFS) RemoveAll(name string) error                  { return os.RemoveAll(name) }
+func (osFS) Rename(oldName, newName string) error         { return os.Rename(oldName, newName) }
+func (osFS) MkdirAll(name string, perm os.FileMode) error { return os.MkdirAll(name, perm) }
+func (osFS) Stat(name string) (os.FileInfo, error)        { return os.Stat(name) }
+
+func (osFS) ReadDir(name string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil {
+			infos = append(infos, info)
+		}
+	}
+	return infos, nil
+}
+
+// fileSystem returns the file system the config stores the bitcask in.
+func (c Config) fileSystem() FS {
+	if c.fs == nil {
+		return OSFS
+	}
+	return c.fs
+}
+
+// WithFS makes the bitcask store its files in fsys instead of OSFS.
+func (c Config) WithFS(fsys FS) Config {
+	c.fs = fsys
+	return c
+}
+
+// openFile opens name for reading.
+func openFile(fsys FS, name string) (File, error) {
+	return fsys.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// syncDir syncs the directory name, so that the files created, renamed
+// and removed in it survive a crash. A file system that can't open
+// directories, like MemFS, has no directory to sync.
+func syncDir(fsys FS, name string) error {
+	dir, err := openFile(fsys, name)
+	if errors.Is(err, os.ErrInvalid) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// readFile reads the whole file name.
+func readFile(fsys FS, name string) ([]byte, error) {
+	file, err := openFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return io.ReadAll(file)
+}
+
+// writeFile writes data to the file name, creating it if needed,
+// and syncs it to disk.
+func writeFile(fsys FS, name string, data []byte, perm os.FileMode) error {
+	file, err := fsys.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// MemFS is a file system that keeps its files in memory, for tests
+// and for stores that don't need to outlive the process.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memData
+	dirs  map[string]void
+}
+
+// memData is the content of a MemFS file.
+type memData struct {
+	mu      sync.RWMutex
+	data    []byte
+	perm    os.FileMode
+	modTime time.Time
+}
+
+// memFile is an open MemFS file.
+type memFile struct {
+	name   string
+	data   *memData
+	flag   int
+	offset int64
+	closed bool
+}
+
+// memFileInfo describes a MemFS file or directory.
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+// NewMemFS returns an empty in-memory file system.
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files: make(map[string]*memData),
+		dirs:  make(map[string]void),
+	}
+}
+
+func (fsys *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = path.Clean(name)
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	if !fsys.isDir(path.Dir(name)) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	if fsys.isDir(name) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrInvalid}
+	}
+
+	data, ok := fsys.files[name]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case !ok:
+		data = &memData{perm: perm, modTime: time.Now()}
+		fsys.files[name] = data
+	case flag&os.O_TRUNC != 0:
+		data.mu.Lock()
+		data.data = nil
+		data.mu.Unlock()
+	}
+
+	return &memFile{name: name, data: data, flag: flag}, nil
+}
+
+func (fsys *MemFS) Remove(name string) error {
+	name = path.Clean(name)
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	if _, ok := fsys.files[name]; ok {
+		delete(fsys.files, name)
+		return nil
+	}
+	if _, ok := fsys.dirs[name]; ok {
+		if len(fsys.children(name)) > 0 {
+			return &os.PathError{Op: "remove", Path: name, Err: os.ErrExist}
+		}
+		delete(fsys.dirs, name)
+		return nil
+	}
+
+	return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+}
+
+func (fsys *MemFS) RemoveAll(name string) error {
+	name = path.Clean(name)
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	for fileName := range fsys.files {
+		if fileName == name || strings.HasPrefix(fileName, name+"/") {
+			delete(fsys.files, fileName)
+		}
+	}
+	for dir := range fsys.dirs {
+		if dir == name || strings.HasPrefix(dir, name+"/") {
+			delete(fsys.dirs, dir)
+		}
+	}
+
+	return nil
+}
+
+func (fsys *MemFS) Rename(oldName, newName string) error {
+	oldName, newName = path.Clean(oldName), path.Clean(newName)
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	data, ok := fsys.files[oldName]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrNotExist}
+	}
+	if !fsys.isDir(path.Dir(newName)) {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrNotExist}
+	}
+
+	delete(fsys.files, oldName)
+	fsys.files[newName] = data
+	return nil
+}
+
+func (fsys *MemFS) MkdirAll(name string, perm os.FileMode) error {
+	name = path.Clean(name)
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	for dir := name; !isRootDir(dir); dir = path.Dir(dir) {
+		if _, ok := fsys.files[dir]; ok {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: os.ErrExist}
+		}
+		fsys.dirs[dir] = member
+	}
+
+	return nil
+}
+
+func (fsys *MemFS) Stat(name string) (os.FileInfo, error) {
+	name = path.Clean(name)
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	return fsys.stat(name)
+}
+
+func (fsys *MemFS) ReadDir(name string) ([]os.FileInfo, error) {
+	name = path.Clean(name)
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	if !fsys.isDir(name) {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	}
+
+	var infos []os.FileInfo
+	for _, child := range fsys.children(name) {
+		info, _ := fsys.stat(child)
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+
+	return infos, nil
+}
+
+// stat describes the file or directory name, the caller holds fsys.mu.
+func (fsys *MemFS) stat(name string) (os.FileInfo, error) {
+	if data, ok := fsys.files[name]; ok {
+		data.mu.RLock()
+		defer data.mu.RUnlock()
+		return memFileInfo{path.Base(name), int64(len(data.data)), data.perm, data.modTime}, nil
+	}
+	if fsys.isDir(name) {
+		return memFileInfo{path.Base(name), 0, os.ModeDir | UserReadWriteExec, time.Time{}}, nil
+	}
+
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+// isDir checks if name is a directory, the caller holds fsys.mu.
+func (fsys *MemFS) isDir(name string) bool {
+	_, ok := fsys.dirs[name]
+	return ok || isRootDir(name)
+}
+
+// children returns the files and directories directly inside dir,
+// the caller holds fsys.mu.
+func (fsys *MemFS) children(dir string) []string {
+	var children []string
+	for name := range fsys.files {
+		if path.Dir(name) == dir {
+			children = append(children, name)
+		}
+	}
+	for name := range fsys.dirs {
+		if path.Dir(name) == dir && name != dir {
+			children = append(children, name)
+		}
+	}
+
+	return children
+}
+
+// isRootDir checks if name is the root or the working directory.
+func isRootDir(name string) bool {
+	return name == "." || name == "/"
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Read(b []byte) (int, error) {
+	n, err := f.ReadAt(b, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(b []byte, offset int64) (int, error) {
+	if f.closed {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: os.ErrClosed}
+	}
+	if f.flag&os.O_WRONLY != 0 {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: os.ErrPermission}
+	}
+
+	f.data.mu.RLock()
+	defer f.data.mu.RUnlock()
+
+	if offset >= int64(len(f.data.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.data.data[offset:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(b []byte) (int, error) {
+	if f.closed {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrClosed}
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+	}
+
+	f.data.mu.Lock()
+	defer f.data.mu.Unlock()
+
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.data.data))
+	}
+	if end := f.offset + int64(len(b)); end > int64(len(f.data.data)) {
+		f.data.data = append(f.data.data, make([]byte, end-int64(len(f.data.data)))...)
+	}
+	copy(f.data.data[f.offset:], b)
+	f.offset += int64(len(b))
+	f.data.modTime = time.Now()
+
+	return len(b), nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.data.mu.RLock()
+	defer f.data.mu.RUnlock()
+
+	return memFileInfo{path.Base(f.name), int64(len(f.data.data)), f.data.perm, f.data.modTime}, nil
+}
+
+func (f *memFile) Sync() error {
+	if f.closed {
+		return &os.PathError{Op: "sync", Path: f.name, Err: os.ErrClosed}
+	}
+	return nil
+}
+
+func (info memFileInfo) Name() string       { return info.name }
+func (info memFileInfo) Size() int64        { return info.size }
+func (info memFileInfo) Mode() os.FileMode  { return info.mode }
+func (info memFileInfo) ModTime() time.Time { return info.modTime }
+func (info memFileInfo) IsDir() bool        { return info.mode.IsDir() }
+func (info memFileInfo) Sys() any           { return nil }
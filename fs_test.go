@@ -0,0 +1,218 @@
+package bitcask
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// fullFS is a file system that has no space left for new data files.
+type fullFS struct {
+	FS
+}
+
+func (fsys fullFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag&os.O_CREATE != 0 && strings.HasSuffix(name, BitCaskFileExtension) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.ENOSPC}
+	}
+	return fsys.FS.OpenFile(name, flag, perm)
+}
+
+func TestMemFS(t *testing.T) {
+	t.Run("files are read and written like os files", func(t *testing.T) {
+		fsys := NewMemFS()
+		fsys.MkdirAll(path.Join("dir", "sub"), UserReadWriteExec)
+
+		file, err := fsys.OpenFile(path.Join("dir", "file"), os.O_CREATE|os.O_EXCL|os.O_RDWR, UserReadWrite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write([]byte("hello "))
+		file.Write([]byte("world"))
+
+		data := make([]byte, 5)
+		file.ReadAt(data, 6)
+		assertEqualStrings(t, string(data), "world")
+		info, _ := file.Stat()
+		if info.Size() != 11 {
+			t.Errorf("got size %d, want 11", info.Size())
+		}
+		file.Close()
+
+		_, err = fsys.OpenFile(path.Join("dir", "file"), os.O_CREATE|os.O_EXCL|os.O_RDWR, UserReadWrite)
+		if !os.IsExist(err) {
+			t.Errorf("got %v, want an exist error", err)
+		}
+
+		got, _ := readFile(fsys, path.Join("dir", "file"))
+		assertEqualStrings(t, string(got), "hello world")
+
+		infos, _ := fsys.ReadDir("dir")
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		assertEqualStrings(t, fmt.Sprint(names), "[file sub]")
+	})
+
+	t.Run("missing files and directories", func(t *testing.T) {
+		fsys := NewMemFS()
+
+		if _, err := openFile(fsys, "file"); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("got %v, want a not exist error", err)
+		}
+		if _, err := fsys.OpenFile(path.Join("dir", "file"), os.O_CREATE|os.O_RDWR, UserReadWrite); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("got %v, want a not exist error", err)
+		}
+		if _, err := fsys.ReadDir("dir"); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("got %v, want a not exist error", err)
+		}
+	})
+
+	t.Run("rename and remove", func(t *testing.T) {
+		fsys := NewMemFS()
+		writeFile(fsys, "old", []byte("data"), UserReadWrite)
+		writeFile(fsys, "new", []byte("replaced"), UserReadWrite)
+
+		if err := fsys.Rename("old", "new"); err != nil {
+			t.Fatal(err)
+		}
+		got, _ := readFile(fsys, "new")
+		assertEqualStrings(t, string(got), "data")
+		if _, err := fsys.Stat("old"); !os.IsNotExist(err) {
+			t.Errorf("expected %q to be renamed", "old")
+		}
+
+		fsys.MkdirAll("dir", UserReadWriteExec)
+		writeFile(fsys, path.Join("dir", "file"), nil, UserReadWrite)
+		if err := fsys.Remove("dir"); err == nil {
+			t.Errorf("expected removing a directory that isn't empty to fail")
+		}
+		fsys.RemoveAll("dir")
+		if _, err := fsys.Stat(path.Join("dir", "file")); !os.IsNotExist(err) {
+			t.Errorf("expected %q to be removed", "dir")
+		}
+	})
+
+	t.Run("read only and closed files", func(t *testing.T) {
+		fsys := NewMemFS()
+		writeFile(fsys, "file", []byte("data"), UserReadWrite)
+
+		file, _ := openFile(fsys, "file")
+		if _, err := file.Write([]byte("more")); err == nil {
+			t.Errorf("expected writing a read only file to fail")
+		}
+		got, _ := io.ReadAll(file)
+		assertEqualStrings(t, string(got), "data")
+
+		file.Close()
+		if _, err := file.Read(make([]byte, 1)); !errors.Is(err, os.ErrClosed) {
+			t.Errorf("got %v, want a closed error", err)
+		}
+	})
+}
+
+func TestOpenWithMemFS(t *testing.T) {
+	t.Run("store runs in memory without touching the disk", func(t *testing.T) {
+		os.RemoveAll(testBitcaskPath)
+		fsys := NewMemFS()
+		bc, err := Open(testBitcaskPath, RWsyncConfig.WithFS(fsys))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 100; i++ {
+			bc.Put([]byte("key"+fmt.Sprintf("%d", i%10)), []byte("value"+fmt.Sprintf("%d", i)))
+		}
+		bc.Delete([]byte("key0"))
+		bc.Merge()
+
+		got, _ := bc.Get([]byte("key5"))
+		assertEqualStrings(t, string(got), "value95")
+		_, err = bc.Get([]byte("key0"))
+		assertErrorMsg(t, err, BitCaskError("\"key0\": key doesn't exist"))
+
+		_, err = Open(testBitcaskPath, RWConfig.WithFS(fsys))
+		assertErrorMsg(t, err, ErrBitCaskIsLocked)
+		bc.Close()
+
+		if _, err := os.Stat(testBitcaskPath); !os.IsNotExist(err) {
+			t.Errorf("expected no directory at %q", testBitcaskPath)
+		}
+
+		bc, _ = Open(testBitcaskPath, DefaultConfig.WithFS(fsys))
+		got, _ = bc.Get([]byte("key9"))
+		assertEqualStrings(t, string(got), "value99")
+		bc.Close()
+	})
+
+	t.Run("keydir is recovered from the data files in memory", func(t *testing.T) {
+		fsys := NewMemFS()
+		bc, _ := Open(testBitcaskPath, RWsyncConfig.WithFS(fsys))
+		for i := 0; i < 100; i++ {
+			bc.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte("value"+fmt.Sprintf("%d", i)))
+		}
+		// a writer that never closes leaves its lock and no keydir file
+		fsys.Remove(path.Join(testBitcaskPath, bc.lock))
+
+		bc, _ = Open(testBitcaskPath, RWsyncConfig.WithFS(fsys))
+		for i := 0; i < 100; i++ {
+			got, _ := bc.Get([]byte("key" + fmt.Sprintf("%d", i)))
+			assertEqualStrings(t, string(got), "value"+fmt.Sprintf("%d", i))
+		}
+		bc.Close()
+
+		report, _ := check(fsys, testBitcaskPath)
+		if !report.OK() {
+			t.Errorf("got check report %+v, want no problems", report)
+		}
+	})
+
+	t.Run("backup to a directory of the same file system", func(t *testing.T) {
+		fsys := NewMemFS()
+		bc, _ := Open(testBitcaskPath, RWsyncConfig.WithFS(fsys))
+		bc.Put([]byte("key"), []byte("value"))
+
+		if err := bc.BackupTo(testBitcaskBackupPath); err != nil {
+			t.Fatal(err)
+		}
+		bc.Close()
+
+		backup, _ := Open(testBitcaskBackupPath, DefaultConfig.WithFS(fsys))
+		got, _ := backup.Get([]byte("key"))
+		assertEqualStrings(t, string(got), "value")
+		backup.Close()
+
+		if _, err := os.Stat(testBitcaskBackupPath); !os.IsNotExist(err) {
+			t.Errorf("expected no directory at %q", testBitcaskBackupPath)
+		}
+	})
+	t.Run("data files that can't be created fail Open and Merge", func(t *testing.T) {
+		fsys := NewMemFS()
+		if _, err := Open(testBitcaskPath, RWConfig.WithFS(fullFS{fsys})); err == nil {
+			t.Fatal("expected Open to fail without space for the active file")
+		}
+
+		bc, err := Open(testBitcaskPath, RWsyncConfig.WithFS(fsys))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bc.Close()
+		for i := 0; i < 100; i++ {
+			bc.Put([]byte("key"+fmt.Sprintf("%d", i%10)), []byte("value"+fmt.Sprintf("%d", i)))
+		}
+		bc.fs = fullFS{fsys}
+		if err := bc.Merge(); err == nil {
+			t.Error("expected Merge to fail without space for the merge file")
+		}
+		bc.fs = fsys
+
+		got, _ := bc.Get([]byte("key5"))
+		assertEqualStrings(t, string(got), "value95")
+	})
+}
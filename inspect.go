@@ -0,0 +1,76 @@
+package bitcask
+
+import (
+	"bufio"
+	"io"
+	"time"
+)
+
+// ItemInfo describes an item of a data file as it's found on disk.
+// The value of a compressed item is decompressed, unless it's corrupted.
+// The key and value of an encrypted item are left encrypted, KeyId is
+// the id of the key they are encrypted with.
+type ItemInfo struct {
+	Offset     int64
+	Size       int64
+	TimeStamp  time.Time
+	Key        []byte
+	Value      []byte
+	Compressed bool
+	Encrypted  bool
+	KeyId      uint32
+	Tombstone  bool
+	ValidCRC   bool
+}
+
+// ScanDataFile calls fn for every item of the data file at filePath in
+// the order they were written, including the items whose crc doesn't match.
+// returns err == ErrCorruptItem if the file ends with a truncated item.
+func ScanDataFile(filePath string, fn func(ItemInfo) error) error {
+	file, err := openFile(OSFS, filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+
+	for {
+		item, err := decodeItem(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		info := ItemInfo{
+			Offset:     offset,
+			Size:       int64(len(item.raw)),
+			TimeStamp:  item.timeStamp,
+			Key:        item.key,
+			Value:      item.value,
+			Compressed: item.compressed,
+			Encrypted:  item.encrypted,
+			Tombstone:  item.isTombstone(),
+			ValidCRC:   item.validCRC(),
+		}
+		if value, err := item.decodedValue(); err == nil && !item.encrypted {
+			info.Value = value
+		}
+		if item.encrypted && len(item.key) >= 4 {
+			info.KeyId = item.keyId()
+		}
+		if err := fn(info); err != nil {
+			return err
+		}
+		offset += info.Size
+	}
+}
+
+// DataFiles returns the data files of the bitcask at directoryPath in
+// the order they were created.
+func DataFiles(directoryPath string) []string {
+	return dataFiles(OSFS, directoryPath)
+}
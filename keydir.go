@@ -0,0 +1,376 @@
+package bitcask
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// fileTable gives every data file of a bitcask a small integer id, which
+// keydir records hold instead of the path of the file. Ids only live as
+// long as the process, the keydir file and the hint files don't hold them.
+// It's safe for concurrent use.
+type fileTable struct {
+	mu    sync.RWMutex
+	ids   map[string]uint32
+	paths []string
+}
+
+// keyIndex is the keydir of a bitcask, it maps every key to the record
+// of its newest item. It's a Go map unless the config asks for a
+// compactKeydir, see Config.WithCompactKeydir, or a lazyKeydir, see
+// Config.WithLazyKeydir. A lazy keyIndex is read only.
+type keyIndex struct {
+	records Keydir
+	compact *compactKeydir
+	lazy    *lazyKeydir
+}
+
+// compactKeydir is a keydir that holds no pointer per key for the
+// garbage collector to scan. Records live in a dense slice of entries,
+// keys in a single arena, prefixed with their length, and an open
+// addressing hash table with linear probing indexes the entries.
+//
+// The target is under 64 bytes per key besides the key itself: an
+// entry takes 32 bytes, its slot in the table 8 bytes at a load factor
+// between 37.5% and 75%, so 11 to 21 bytes, and the key one or two bytes
+// of length in the arena. BenchmarkKeydirMemory measures 52 to 57 bytes
+// besides 16 byte keys, where a Keydir map takes 63 to 100 bytes.
+type compactKeydir struct {
+	slots   []compactSlot
+	entries []compactEntry
+	arena   []byte
+	// garbage is the number of arena bytes of removed keys, the arena
+	// is compacted once it's half garbage.
+	garbage int
+}
+
+// compactSlot is a slot of the hash table of a compactKeydir, entry is
+// one plus the index of its entry, zero for an empty slot.
+type compactSlot struct {
+	hash  uint32
+	entry uint32
+}
+
+// compactEntry is the record of a key of a compactKeydir along with the
+// offset of the key in the arena.
+type compactEntry struct {
+	keyOff uint64
+	record Record
+}
+
+// compactSlotSize and compactEntrySize are the sizes in bytes of a
+// compactSlot and a compactEntry.
+const (
+	compactSlotSize  = int64(unsafe.Sizeof(compactSlot{}))
+	compactEntrySize = int64(unsafe.Sizeof(compactEntry{}))
+)
+
+// WithCompactKeydir returns a copy of the config that keeps the keydir
+// in a compact hash table instead of a Go map, which takes less memory
+// per key and no garbage collector work, at the cost of slightly
+// slower lookups.
+func (c Config) WithCompactKeydir() Config {
+	c.compactKeydir = true
+	return c
+}
+
+// newFileTable returns an empty file table.
+func newFileTable() *fileTable {
+	return &fileTable{ids: make(map[string]uint32)}
+}
+
+// id returns the id of the data file fileId, giving it one if it has none.
+func (t *fileTable) id(fileId string) uint32 {
+	t.mu.RLock()
+	id, ok := t.ids[fileId]
+	t.mu.RUnlock()
+	if ok {
+		return id
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if id, ok := t.ids[fileId]; ok {
+		return id
+	}
+	id = uint32(len(t.paths))
+	t.ids[fileId] = id
+	t.paths = append(t.paths, fileId)
+
+	return id
+}
+
+// path returns the path of the data file of id.
+func (t *fileTable) path(id uint32) string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.paths[id]
+}
+
+// forget drops the deleted data file fileId from the table.
+func (t *fileTable) forget(fileId string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if id, ok := t.ids[fileId]; ok {
+		t.paths[id] = ""
+		delete(t.ids, fileId)
+	}
+}
+
+// time returns the time the item of record was written at, the zero
+// time for the zero record.
+func (r Record) time() time.Time {
+	if r.timeStamp == 0 {
+		return time.Time{}
+	}
+	return time.UnixMicro(r.timeStamp)
+}
+
+// newKeyIndex returns an empty keydir, a compactKeydir if compact is set.
+func newKeyIndex(compact bool) *keyIndex {
+	if compact {
+		return &keyIndex{compact: &compactKeydir{}}
+	}
+	return &keyIndex{records: make(Keydir)}
+}
+
+// get returns the record of key.
+func (kd *keyIndex) get(key string) (Record, bool) {
+	if kd.lazy != nil {
+		return kd.lazy.get(key)
+	}
+	if kd.compact != nil {
+		return kd.compact.get(key)
+	}
+	record, ok := kd.records[key]
+	return record, ok
+}
+
+// set points key at record.
+func (kd *keyIndex) set(key string, record Record) {
+	if kd.compact != nil {
+		kd.compact.set(key, record)
+		return
+	}
+	kd.records[key] = record
+}
+
+// remove removes key.
+func (kd *keyIndex) remove(key string) {
+	if kd.compact != nil {
+		kd.compact.remove(key)
+		return
+	}
+	delete(kd.records, key)
+}
+
+// len returns the number of keys, an estimate for a lazy keydir.
+func (kd *keyIndex) len() int {
+	if kd.lazy != nil {
+		return kd.lazy.len()
+	}
+	if kd.compact != nil {
+		return len(kd.compact.entries)
+	}
+	return len(kd.records)
+}
+
+// each calls fn for every key and its record, fn must not change the keydir.
+func (kd *keyIndex) each(fn func(key string, record Record)) {
+	if kd.lazy != nil {
+		kd.lazy.load().each(fn)
+		return
+	}
+	if kd.compact != nil {
+		kd.compact.each(fn)
+		return
+	}
+	kd.records.each(fn)
+}
+
+// memory estimates the memory used by the keydir in bytes.
+func (kd *keyIndex) memory() int64 {
+	if kd.lazy != nil {
+		return kd.lazy.memory()
+	}
+	if kd.compact != nil {
+		c := kd.compact
+		return int64(cap(c.slots))*compactSlotSize + int64(cap(c.entries))*compactEntrySize + int64(cap(c.arena))
+	}
+
+	var memory int64
+	for key := range kd.records {
+		memory += int64(len(key)) + keydirEntryOverhead
+	}
+	return memory
+}
+
+// each calls fn for every key of the keydir and its record.
+func (keydir Keydir) each(fn func(key string, record Record)) {
+	for key, record := range keydir {
+		fn(key, record)
+	}
+}
+
+// hashKey returns the 32 bit FNV-1a hash of key, which is never zero.
+func hashKey(key string) uint32 {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	if hash == 0 {
+		hash = 1
+	}
+	return hash
+}
+
+// key returns the key of the entry at index i, from the arena.
+func (c *compactKeydir) key(i int) []byte {
+	off := c.entries[i].keyOff
+	size, n := binary.Uvarint(c.arena[off:])
+	begin := off + uint64(n)
+	return c.arena[begin : begin+size]
+}
+
+// find returns the index of the slot of key, or of the empty slot where
+// it would go and false.
+func (c *compactKeydir) find(key string, hash uint32) (int, bool) {
+	mask := len(c.slots) - 1
+	for i := int(hash) & mask; ; i = (i + 1) & mask {
+		slot := c.slots[i]
+		if slot.entry == 0 {
+			return i, false
+		}
+		if slot.hash == hash && string(c.key(int(slot.entry-1))) == key {
+			return i, true
+		}
+	}
+}
+
+func (c *compactKeydir) get(key string) (Record, bool) {
+	if len(c.entries) == 0 {
+		return Record{}, false
+	}
+
+	i, ok := c.find(key, hashKey(key))
+	if !ok {
+		return Record{}, false
+	}
+	return c.entries[c.slots[i].entry-1].record, true
+}
+
+func (c *compactKeydir) set(key string, record Record) {
+	if (len(c.entries)+1)*4 > len(c.slots)*3 {
+		c.resize(len(c.slots) * 2)
+	}
+
+	hash := hashKey(key)
+	i, ok := c.find(key, hash)
+	if ok {
+		c.entries[c.slots[i].entry-1].record = record
+		return
+	}
+
+	c.entries = append(c.entries, compactEntry{keyOff: uint64(len(c.arena)), record: record})
+	c.arena = appendUvarint(c.arena, uint64(len(key)))
+	c.arena = append(c.arena, key...)
+	c.slots[i] = compactSlot{hash: hash, entry: uint32(len(c.entries))}
+}
+
+func (c *compactKeydir) remove(key string) {
+	if len(c.entries) == 0 {
+		return
+	}
+	i, ok := c.find(key, hashKey(key))
+	if !ok {
+		return
+	}
+	removed := int(c.slots[i].entry - 1)
+	c.garbage += uvarintSize(len(key)) + len(key)
+	c.removeSlot(i)
+
+	// the last entry takes the place of the removed one.
+	last := len(c.entries) - 1
+	if removed != last {
+		j, _ := c.find(string(c.key(last)), hashKey(string(c.key(last))))
+		c.slots[j].entry = uint32(removed + 1)
+		c.entries[removed] = c.entries[last]
+	}
+	c.entries = c.entries[:last]
+
+	if c.garbage > 4096 && c.garbage*2 > len(c.arena) {
+		c.compactArena()
+	}
+}
+
+// removeSlot empties slot i and shifts the following slots back, so
+// that no probe sequence crosses an empty slot before reaching its key.
+func (c *compactKeydir) removeSlot(i int) {
+	mask := len(c.slots) - 1
+	for j := (i + 1) & mask; c.slots[j].entry != 0; j = (j + 1) & mask {
+		home := int(c.slots[j].hash) & mask
+		if (j > i && (home <= i || home > j)) || (j < i && home <= i && home > j) {
+			c.slots[i] = c.slots[j]
+			i = j
+		}
+	}
+	c.slots[i] = compactSlot{}
+}
+
+func (c *compactKeydir) each(fn func(key string, record Record)) {
+	for i := range c.entries {
+		fn(string(c.key(i)), c.entries[i].record)
+	}
+}
+
+// resize moves the entries into a hash table of size slots, at least 16.
+func (c *compactKeydir) resize(size int) {
+	if size < 16 {
+		size = 16
+	}
+	c.slots = make([]compactSlot, size)
+
+	mask := size - 1
+	for i := range c.entries {
+		hash := hashKey(string(c.key(i)))
+		j := int(hash) & mask
+		for c.slots[j].entry != 0 {
+			j = (j + 1) & mask
+		}
+		c.slots[j] = compactSlot{hash: hash, entry: uint32(i + 1)}
+	}
+}
+
+// compactArena copies the keys into a new arena without the removed keys.
+func (c *compactKeydir) compactArena() {
+	arena := make([]byte, 0, len(c.arena)-c.garbage)
+	for i := range c.entries {
+		key := c.key(i)
+		c.entries[i].keyOff = uint64(len(arena))
+		arena = appendUvarint(arena, uint64(len(key)))
+		arena = append(arena, key...)
+	}
+	c.arena = arena
+	c.garbage = 0
+}
+
+// appendUvarint appends n encoded as a uvarint to b.
+func appendUvarint(b []byte, n uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], n)]...)
+}
+
+// uvarintSize returns the number of bytes of n encoded as a uvarint.
+func uvarintSize(n int) int {
+	size := 1
+	for ; n >= 0x80; n >>= 7 {
+		size++
+	}
+	return size
+}
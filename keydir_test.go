@@ -0,0 +1,155 @@
+package bitcask
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"runtime"
+	"testing"
+)
+
+// fileOf returns the data file holding the value of key.
+func fileOf(bc *BitCask, key string) string {
+	record, _ := bc.keydir.get(key)
+	return bc.files.path(record.file)
+}
+
+func TestCompactKeydir(t *testing.T) {
+	t.Run("matches a map under random operations", func(t *testing.T) {
+		rnd := rand.New(rand.NewSource(1))
+		compact := newKeyIndex(true)
+		want := make(Keydir)
+
+		for i := 0; i < 50000; i++ {
+			key := "key" + fmt.Sprintf("%d", rnd.Intn(3000))
+			switch rnd.Intn(3) {
+			case 0:
+				compact.remove(key)
+				delete(want, key)
+			default:
+				record := Record{file: uint32(i % 7), valueSize: uint32(i), valuePosition: int64(i), timeStamp: int64(i)}
+				compact.set(key, record)
+				want[key] = record
+			}
+		}
+
+		if compact.len() != len(want) {
+			t.Errorf("got %d keys, want %d", compact.len(), len(want))
+		}
+		for key, record := range want {
+			if got, ok := compact.get(key); !ok || got != record {
+				t.Errorf("%q: got %v, want %v", key, got, record)
+			}
+		}
+		compact.each(func(key string, record Record) {
+			if want[key] != record {
+				t.Errorf("%q: got %v, want %v", key, record, want[key])
+			}
+		})
+	})
+
+	t.Run("removed keys are dropped from the arena", func(t *testing.T) {
+		compact := newKeyIndex(true)
+		for i := 0; i < 10000; i++ {
+			compact.set("key"+fmt.Sprintf("%d", i), Record{})
+		}
+		for i := 0; i < 9000; i++ {
+			compact.remove("key" + fmt.Sprintf("%d", i))
+		}
+
+		if len(compact.compact.arena) > 2*1000*len("_key9999") {
+			t.Errorf("got an arena of %d bytes for 1000 keys", len(compact.compact.arena))
+		}
+		if _, ok := compact.get("key9999"); !ok {
+			t.Errorf("expected key9999 to be kept")
+		}
+	})
+
+	t.Run("bitcask with a compact keydir", func(t *testing.T) {
+		os.RemoveAll(testBitcaskPath)
+		bc, _ := Open(testBitcaskPath, RWsyncConfig.WithCompactKeydir())
+		for i := 0; i < 300; i++ {
+			bc.Put([]byte("key"+fmt.Sprintf("%d", i%50)), []byte("value"+fmt.Sprintf("%d", i)))
+		}
+		bc.Delete([]byte("key7"))
+		bc.Merge()
+		bc.Close()
+
+		bc, _ = Open(testBitcaskPath, RWsyncConfig.WithCompactKeydir())
+		for i := 0; i < 50; i++ {
+			got, _ := bc.Get([]byte("key" + fmt.Sprintf("%d", i)))
+			if i == 7 {
+				assertEqualStrings(t, string(got), "")
+				continue
+			}
+			assertEqualStrings(t, string(got), "value"+fmt.Sprintf("%d", 250+i))
+		}
+		if keys := len(bc.ListKeys()); keys != 49 {
+			t.Errorf("got %d keys, want 49", keys)
+		}
+		bc.Close()
+		os.RemoveAll(testBitcaskPath)
+	})
+}
+
+func TestFileTable(t *testing.T) {
+	files := newFileTable()
+	first, second := files.id("1.cask"), files.id("2.cask")
+	if first == second || files.id("1.cask") != first {
+		t.Errorf("expected every file to keep its own id")
+	}
+	assertEqualStrings(t, files.path(second), "2.cask")
+
+	files.forget("1.cask")
+	if files.id("1.cask") == first {
+		t.Errorf("expected a forgotten file to get a new id")
+	}
+}
+
+// benchmarkKeydirMemory reports the heap bytes a keydir takes per key.
+func benchmarkKeydirMemory(b *testing.B, compact bool) {
+	const keys = 200000
+	var stats runtime.MemStats
+
+	for n := 0; n < b.N; n++ {
+		runtime.GC()
+		runtime.ReadMemStats(&stats)
+		before := stats.HeapAlloc
+
+		keydir := newKeyIndex(compact)
+		for i := 0; i < keys; i++ {
+			keydir.set("user:"+fmt.Sprintf("%011d", i), Record{valueSize: 100, valuePosition: int64(i), timeStamp: int64(i)})
+		}
+
+		runtime.GC()
+		runtime.ReadMemStats(&stats)
+		b.ReportMetric(float64(stats.HeapAlloc-before)/keys, "B/key")
+		runtime.KeepAlive(keydir)
+	}
+}
+
+func BenchmarkKeydirMemory(b *testing.B) {
+	b.Run("map", func(b *testing.B) {
+		benchmarkKeydirMemory(b, false)
+	})
+	b.Run("compact", func(b *testing.B) {
+		benchmarkKeydirMemory(b, true)
+	})
+}
+
+func BenchmarkKeydirGet(b *testing.B) {
+	for _, compact := range []bool{false, true} {
+		keydir := newKeyIndex(compact)
+		keys := make([][]byte, 100000)
+		for i := range keys {
+			keys[i] = []byte("user:" + fmt.Sprintf("%011d", i))
+			keydir.set(string(keys[i]), Record{})
+		}
+
+		b.Run(fmt.Sprintf("compact=%v", compact), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				keydir.get(string(keys[i%len(keys)]))
+			}
+		})
+	}
+}
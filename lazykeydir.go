@@ -0,0 +1,245 @@
+package bitcask
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+)
+
+// lazyKeydir is the keydir of a reader that doesn't load the records of
+// the data files having a hint file. It keeps the bloom filter of their
+// hint files, and reads the hint files whose filter may hold a key to
+// find its record. The records of the other data files, written since
+// they were last merged, are kept in memory. It's read only.
+type lazyKeydir struct {
+	fsys   FS
+	cipher *itemCipher
+	files  []lazyFile
+
+	// hints caches the records of the last lazyHintCacheSize hint files
+	// read by lookups, most recently used first.
+	mu    sync.Mutex
+	hints *list.List
+}
+
+// cachedHints are the records of the hint file of a data file.
+type cachedHints struct {
+	fileId  string
+	records Keydir
+}
+
+// lazyFile is a data file of a lazyKeydir, either with the bloom filter
+// of its hint file or with its records, tombstones included.
+type lazyFile struct {
+	fileId  string
+	id      uint32
+	filter  *bloomFilter
+	records Keydir
+}
+
+// WithLazyKeydir returns a copy of the config that, for a process
+// without write permission, keeps only the bloom filters of the hint
+// files in memory instead of the whole keydir. Looking up a missing key
+// rarely reads a file, a key that exists is found in the hint files
+// whose filter may hold it. Listing the keys reads every hint file.
+// The keydir file isn't used, and writers ignore the setting.
+func (c Config) WithLazyKeydir() Config {
+	c.lazyKeydir = true
+	return c
+}
+
+// openLazyKeydir loads the lazy keydir of the data files at directoryPath,
+// giving them ids from files.
+// returns err == ErrEncrypted or err == ErrDecryptionFailed if the
+// files can't be decrypted with itemCipher.
+func openLazyKeydir(fsys FS, itemCipher *itemCipher, directoryPath string, files *fileTable) (*lazyKeydir, error) {
+	lazy := &lazyKeydir{fsys: fsys, cipher: itemCipher, hints: list.New()}
+
+	for _, fileId := range dataFiles(fsys, directoryPath) {
+		file := lazyFile{fileId: fileId, id: files.id(fileId)}
+		if hints, err := readFile(fsys, hintFileName(fileId)); err == nil {
+			if hints, err = itemCipher.openData(hintFileName(fileId), hints); err != nil {
+				return nil, err
+			}
+			file.filter = readBloomFile(fsys, itemCipher, fileId, hints)
+			lazy.files = append(lazy.files, file)
+			continue
+		}
+
+		file.records = make(Keydir)
+		err := scanItems(fsys, itemCipher, fileId, func(item fileItem, offset int64) error {
+			record := Record{
+				file:          file.id,
+				valueSize:     item.valueSizeField(),
+				valuePosition: item.valuePosition(offset),
+				timeStamp:     item.timeStamp.UnixMicro(),
+			}
+			if item.isTombstone() {
+				record.valuePosition = tombstoneHintPosition
+			}
+			if current, ok := file.records[string(item.key)]; !ok || record.timeStamp >= current.timeStamp {
+				file.records[string(item.key)] = record
+			}
+			return nil
+		})
+		if errors.Is(err, ErrEncrypted) || errors.Is(err, ErrDecryptionFailed) {
+			return nil, err
+		}
+		lazy.files = append(lazy.files, file)
+	}
+
+	return lazy, nil
+}
+
+// get returns the record of key, the newest one of the data files, like
+// recoverKeydir picks it.
+func (lk *lazyKeydir) get(key string) (Record, bool) {
+	var newest Record
+	found := false
+	for _, file := range lk.files {
+		record, ok := lk.find(file, key)
+		if ok && (!found || record.timeStamp >= newest.timeStamp) {
+			newest, found = record, true
+		}
+	}
+
+	if !found || newest.valuePosition == tombstoneHintPosition {
+		return Record{}, false
+	}
+	return newest, true
+}
+
+// find returns the record of key in file, tombstones included.
+func (lk *lazyKeydir) find(file lazyFile, key string) (Record, bool) {
+	if file.filter == nil {
+		record, ok := file.records[key]
+		return record, ok
+	}
+	if !file.filter.mayContain(key) {
+		return Record{}, false
+	}
+
+	record, ok := lk.hintRecords(file)[key]
+	return record, ok
+}
+
+// hintRecords returns the records of the hint file of file, from the
+// cache if it was read lately.
+func (lk *lazyKeydir) hintRecords(file lazyFile) Keydir {
+	lk.mu.Lock()
+	for elem := lk.hints.Front(); elem != nil; elem = elem.Next() {
+		if cached := elem.Value.(*cachedHints); cached.fileId == file.fileId {
+			lk.hints.MoveToFront(elem)
+			lk.mu.Unlock()
+			return cached.records
+		}
+	}
+	lk.mu.Unlock()
+
+	records := make(Keydir)
+	lk.eachHint(file, func(key string, record Record) {
+		records[key] = record
+	})
+
+	lk.mu.Lock()
+	defer lk.mu.Unlock()
+	lk.hints.PushFront(&cachedHints{fileId: file.fileId, records: records})
+	if lk.hints.Len() > lazyHintCacheSize {
+		lk.hints.Remove(lk.hints.Back())
+	}
+	return records
+}
+
+// eachHint calls fn for every entry of the hint file of file. A hint
+// file that can't be read any more has no entries.
+func (lk *lazyKeydir) eachHint(file lazyFile, fn func(key string, record Record)) {
+	name := hintFileName(file.fileId)
+	hints, err := readFile(lk.fsys, name)
+	if err == nil {
+		hints, err = lk.cipher.openData(name, hints)
+	}
+	if err != nil {
+		return
+	}
+
+	parseHints(hints, func(key string, record Record) {
+		record.file = file.id
+		fn(key, record)
+	})
+}
+
+// load returns the records of all the keys.
+func (lk *lazyKeydir) load() Keydir {
+	keydir := make(Keydir)
+	add := func(key string, record Record) {
+		if current, ok := keydir[key]; ok && record.timeStamp < current.timeStamp {
+			return
+		}
+		keydir[key] = record
+	}
+
+	for _, file := range lk.files {
+		if file.filter == nil {
+			file.records.each(add)
+		} else {
+			lk.eachHint(file, add)
+		}
+	}
+	for key, record := range keydir {
+		if record.valuePosition == tombstoneHintPosition {
+			delete(keydir, key)
+		}
+	}
+
+	return keydir
+}
+
+// len estimates the number of keys, see countKeys.
+func (lk *lazyKeydir) len() int {
+	keys, bucketKeys := lk.countKeys()
+	return keys + bucketKeys
+}
+
+// countKeys estimates the number of keys of the default namespace and
+// of the buckets from the key counts of the bloom filters, without
+// reading the hint files. A key updated or deleted since its hint file
+// was written is counted more than once.
+func (lk *lazyKeydir) countKeys() (keys, bucketKeys int) {
+	for _, file := range lk.files {
+		if file.filter != nil {
+			keys += file.filter.keys
+			bucketKeys += file.filter.bucketKeys
+			continue
+		}
+		for key, record := range file.records {
+			if record.valuePosition != tombstoneHintPosition {
+				k, b := countKey(key)
+				keys, bucketKeys = keys+k, bucketKeys+b
+			}
+		}
+	}
+	return keys, bucketKeys
+}
+
+// memory estimates the memory used by the filters and the records,
+// the cached hint files included.
+func (lk *lazyKeydir) memory() int64 {
+	var memory int64
+	for _, file := range lk.files {
+		if file.filter != nil {
+			memory += int64(len(file.filter.bits))
+		}
+		for key := range file.records {
+			memory += int64(len(key)) + keydirEntryOverhead
+		}
+	}
+
+	lk.mu.Lock()
+	defer lk.mu.Unlock()
+	for elem := lk.hints.Front(); elem != nil; elem = elem.Next() {
+		for key := range elem.Value.(*cachedHints).records {
+			memory += int64(len(key)) + keydirEntryOverhead
+		}
+	}
+	return memory
+}
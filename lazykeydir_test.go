@@ -0,0 +1,190 @@
+package bitcask
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"testing"
+)
+
+// countingFS is a MemFS that counts the opens of hint files.
+type countingFS struct {
+	*MemFS
+
+	mu        sync.Mutex
+	hintOpens int
+}
+
+func (fsys *countingFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if path.Ext(name) == HintFileExtension {
+		fsys.mu.Lock()
+		fsys.hintOpens++
+		fsys.mu.Unlock()
+	}
+	return fsys.MemFS.OpenFile(name, flag, perm)
+}
+
+func (fsys *countingFS) opens() int {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	return fsys.hintOpens
+}
+
+func TestBloomFilter(t *testing.T) {
+	filter := newBloomFilter(1000)
+	for i := 0; i < 1000; i++ {
+		filter.add(fmt.Sprintf("key%d", i))
+	}
+
+	filter, ok := parseBloomFilter(filter.marshal())
+	if !ok {
+		t.Fatal("can't parse the marshaled filter")
+	}
+	for i := 0; i < 1000; i++ {
+		if !filter.mayContain(fmt.Sprintf("key%d", i)) {
+			t.Fatalf("key%d is missing", i)
+		}
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if filter.mayContain(fmt.Sprintf("missing%d", i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 300 {
+		t.Errorf("got %d false positives out of 10000, want about 100", falsePositives)
+	}
+
+	for _, data := range [][]byte{nil, {0, 0, 0, 7}, {0, 0, 0, 0, 1}} {
+		if _, ok := parseBloomFilter(data); ok {
+			t.Errorf("parsed the invalid filter %v", data)
+		}
+	}
+}
+
+func TestLazyKeydir(t *testing.T) {
+	// fillLazyBitcask writes keys to merged files with hint files and to
+	// files written after the merge.
+	fillLazyBitcask := func(fsys FS, config Config) {
+		bc, _ := Open(testBitcaskPath, config.WithFS(fsys))
+		for i := 0; i < 100; i++ {
+			bc.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)))
+		}
+		for i := 0; i < 100; i += 10 {
+			bc.Delete([]byte(fmt.Sprintf("key%d", i)))
+		}
+		bc.Merge()
+		for i := 0; i < 100; i += 7 {
+			bc.Put([]byte(fmt.Sprintf("key%d", i)), []byte("updated"))
+		}
+		bc.Delete([]byte("key21"))
+		bc.Close()
+	}
+
+	t.Run("lookups match the full keydir", func(t *testing.T) {
+		fsys := &countingFS{MemFS: NewMemFS()}
+		fillLazyBitcask(fsys, RWsyncConfig)
+
+		full, _ := Open(testBitcaskPath, DefaultConfig.WithFS(fsys))
+		defer full.Close()
+		lazy, err := Open(testBitcaskPath, DefaultConfig.WithFS(fsys).WithLazyKeydir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer lazy.Close()
+		if lazy.Stats().KeydirMemory >= full.Stats().KeydirMemory {
+			t.Errorf("got %d bytes of lazy keydir, want less than %d", lazy.Stats().KeydirMemory, full.Stats().KeydirMemory)
+		}
+
+		for i := 0; i < 110; i++ {
+			key := []byte(fmt.Sprintf("key%d", i))
+			want, wantErr := full.Get(key)
+			got, err := lazy.Get(key)
+			assertEqualStrings(t, string(got), string(want))
+			if errors.Is(err, ErrKeyNotExist) != errors.Is(wantErr, ErrKeyNotExist) {
+				t.Errorf("%s: got %v, want %v", key, err, wantErr)
+			}
+		}
+		assertEqualStrings(t, fmt.Sprint(sortedKeys(lazy.ListKeys())), fmt.Sprint(sortedKeys(full.ListKeys())))
+
+		opens := fsys.opens()
+		for i := 0; i < 1000; i++ {
+			lazy.Get([]byte(fmt.Sprintf("missing%d", i)))
+		}
+		if read := fsys.opens() - opens; read > 100 {
+			t.Errorf("got %d hint files read for 1000 missing keys, want a few", read)
+		}
+	})
+
+	t.Run("stats and repeated lookups don't read hint files again", func(t *testing.T) {
+		fsys := &countingFS{MemFS: NewMemFS()}
+		bc, _ := Open(testBitcaskPath, RWsyncConfig.WithFS(fsys))
+		for i := 0; i < 100; i++ {
+			bc.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)))
+		}
+		bc.Bucket("users").Put([]byte("key"), []byte("value"))
+		bc.Merge()
+		bc.Close()
+
+		lazy, _ := Open(testBitcaskPath, DefaultConfig.WithFS(fsys).WithLazyKeydir())
+		defer lazy.Close()
+		opens := fsys.opens()
+		if stats := lazy.Stats(); stats.Keys != 100 || stats.BucketKeys != 1 {
+			t.Errorf("got %d keys and %d bucket keys, want 100 and 1", stats.Keys, stats.BucketKeys)
+		}
+		if read := fsys.opens() - opens; read != 0 {
+			t.Errorf("got %d hint files read by Stats, want none", read)
+		}
+
+		got, _ := lazy.Get([]byte("key42"))
+		assertEqualStrings(t, string(got), "value42")
+		opens = fsys.opens()
+		for i := 0; i < 10; i++ {
+			lazy.Get([]byte("key42"))
+		}
+		if read := fsys.opens() - opens; read != 0 {
+			t.Errorf("got %d hint files read by repeated lookups, want none", read)
+		}
+	})
+
+	t.Run("missing bloom files are rebuilt from the hint files", func(t *testing.T) {
+		fsys := NewMemFS()
+		fillLazyBitcask(fsys, RWsyncConfig)
+		infos, _ := fsys.ReadDir(testBitcaskPath)
+		blooms := 0
+		for _, info := range infos {
+			if path.Ext(info.Name()) == BloomFileExtension {
+				fsys.Remove(path.Join(testBitcaskPath, info.Name()))
+				blooms++
+			}
+		}
+		if blooms == 0 {
+			t.Fatal("merge wrote no bloom files")
+		}
+
+		bc, _ := Open(testBitcaskPath, DefaultConfig.WithFS(fsys).WithLazyKeydir())
+		got, _ := bc.Get([]byte("key1"))
+		assertEqualStrings(t, string(got), "value1")
+		if _, err := bc.Get([]byte("key10")); !errors.Is(err, ErrKeyNotExist) {
+			t.Errorf("got %v, want ErrKeyNotExist", err)
+		}
+		bc.Close()
+	})
+
+	t.Run("encrypted lazy keydir", func(t *testing.T) {
+		fsys := NewMemFS()
+		fillLazyBitcask(fsys, RWsyncConfig.WithEncryption(testEncryptionKey))
+
+		_, err := Open(testBitcaskPath, DefaultConfig.WithFS(fsys).WithLazyKeydir())
+		assertErrorMsg(t, err, ErrEncrypted)
+
+		bc, _ := Open(testBitcaskPath, DefaultConfig.WithFS(fsys).WithLazyKeydir().WithEncryption(testEncryptionKey))
+		got, _ := bc.Get([]byte("key14"))
+		assertEqualStrings(t, string(got), "updated")
+		got, _ = bc.Get([]byte("key3"))
+		assertEqualStrings(t, string(got), "value3")
+		bc.Close()
+	})
+}
@@ -0,0 +1,530 @@
+package bitcask
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MergePolicy contains the knobs that decide when a background merge
+// is triggered and which data files a merge picks. Names follow the
+// ones used in the Bitcask paper. A zero trigger or threshold is disabled.
+type MergePolicy struct {
+	// FragMergeTrigger is the percentage of dead bytes in an immutable
+	// data file that triggers a merge.
+	FragMergeTrigger int
+	// DeadBytesMergeTrigger is the amount of dead bytes in a single
+	// immutable data file that triggers a merge.
+	DeadBytesMergeTrigger int64
+	// FragThreshold is the percentage of dead bytes that makes a data
+	// file be picked by a merge.
+	FragThreshold int
+	// DeadBytesThreshold is the amount of dead bytes that makes a data
+	// file be picked by a merge.
+	DeadBytesThreshold int64
+	// SmallFileThreshold is the size under which data files are picked
+	// by a merge to be coalesced, as long as there is more than one file to merge.
+	SmallFileThreshold int64
+	// WindowStart and WindowEnd restrict merging to the hours in
+	// [WindowStart, WindowEnd]. If they are equal, merging may happen
+	// at any hour.
+	WindowStart int
+	WindowEnd   int
+	// CheckInterval is how often the background merger checks the triggers.
+	CheckInterval time.Duration
+}
+
+// fileStat tracks how many bytes of a data file belong to live
+// and dead items.
+type fileStat struct {
+	liveBytes int64
+	deadBytes int64
+	// oldest is the oldest timestamp of the items in the file,
+	// it's zero if unknown.
+	oldest time.Time
+}
+
+// WithAutoMerge returns a copy of the config that runs a background
+// merger which merges the datastore whenever policy's triggers are exceeded.
+func (c Config) WithAutoMerge(policy MergePolicy) Config {
+	if policy.CheckInterval <= 0 {
+		policy.CheckInterval = DefaultMergePolicy.CheckInterval
+	}
+	c.autoMerge = true
+	c.mergePolicy = policy
+	return c
+}
+
+// WithMergePolicy returns a copy of the config whose merges pick data
+// files according to policy, without running a background merger.
+func (c Config) WithMergePolicy(policy MergePolicy) Config {
+	c.mergePolicy = policy
+	return c
+}
+
+// policy returns the merge policy of the config, or DefaultMergePolicy
+// if none was given. A policy without selection thresholds picks the
+// files exceeding its triggers, or the files DefaultMergePolicy picks
+// if it has no triggers either.
+func (c Config) policy() MergePolicy {
+	policy := c.mergePolicy
+	if policy == (MergePolicy{}) {
+		return DefaultMergePolicy
+	}
+
+	if policy.FragThreshold == 0 && policy.DeadBytesThreshold == 0 && policy.SmallFileThreshold == 0 {
+		policy.FragThreshold = policy.FragMergeTrigger
+		policy.DeadBytesThreshold = policy.DeadBytesMergeTrigger
+		if policy.FragThreshold == 0 && policy.DeadBytesThreshold == 0 {
+			policy.FragThreshold = DefaultMergePolicy.FragThreshold
+			policy.DeadBytesThreshold = DefaultMergePolicy.DeadBytesThreshold
+			policy.SmallFileThreshold = DefaultMergePolicy.SmallFileThreshold
+		}
+	}
+	return policy
+}
+
+// inWindow reports whether merging is allowed at time t.
+func (p MergePolicy) inWindow(t time.Time) bool {
+	if p.WindowStart == p.WindowEnd {
+		return true
+	}
+
+	hour := t.Hour()
+	if p.WindowStart < p.WindowEnd {
+		return hour >= p.WindowStart && hour <= p.WindowEnd
+	}
+	// the window wraps around midnight
+	return hour >= p.WindowStart || hour <= p.WindowEnd
+}
+
+// addTimestamp updates the oldest timestamp of the file with an item
+// written at timeStamp.
+func (s *fileStat) addTimestamp(timeStamp time.Time) {
+	if s.liveBytes+s.deadBytes == 0 || timeStamp.Before(s.oldest) {
+		s.oldest = timeStamp
+	}
+}
+
+// fragmentation returns the percentage of dead bytes in the file.
+func (s *fileStat) fragmentation() int {
+	total := s.liveBytes + s.deadBytes
+	if total == 0 {
+		return 0
+	}
+	return int(s.deadBytes * 100 / total)
+}
+
+// needsMerge checks if any immutable data file exceeds one of
+// the merge triggers.
+func (bc *BitCask) needsMerge() bool {
+	policy := bc.config.mergePolicy
+
+	for fileId, stat := range bc.fileStats {
+		if bc.activeFile != nil && fileId == bc.activeFile.Name() {
+			continue
+		}
+		if policy.FragMergeTrigger > 0 && stat.fragmentation() >= policy.FragMergeTrigger {
+			return true
+		}
+		if policy.DeadBytesMergeTrigger > 0 && stat.deadBytes >= policy.DeadBytesMergeTrigger {
+			return true
+		}
+	}
+
+	return false
+}
+
+// autoMerge periodically checks the merge triggers and merges the
+// datastore once one of them is exceeded inside the merge window.
+func (bc *BitCask) autoMerge() {
+	defer bc.mergeWg.Done()
+
+	ticker := time.NewTicker(bc.config.mergePolicy.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-bc.stopMerge:
+			return
+		case now := <-ticker.C:
+			if !bc.config.mergePolicy.inWindow(now) {
+				continue
+			}
+
+			bc.mu.RLock()
+			needed := bc.needsMerge()
+			bc.mu.RUnlock()
+
+			if needed {
+				bc.Merge()
+			}
+		}
+	}
+}
+
+// selectMergeFiles picks the immutable data files worth merging: the
+// ones exceeding the fragmentation or dead bytes thresholds, plus the
+// small files that can be coalesced with others.
+func (bc *BitCask) selectMergeFiles(policy MergePolicy) []string {
+	var selected, small []string
+
+	for fileId, stat := range bc.fileStats {
+		if fileId == bc.activeFile.Name() {
+			continue
+		}
+
+		switch {
+		case policy.FragThreshold > 0 && stat.fragmentation() >= policy.FragThreshold,
+			policy.DeadBytesThreshold > 0 && stat.deadBytes >= policy.DeadBytesThreshold:
+			selected = append(selected, fileId)
+		case policy.SmallFileThreshold > 0 && stat.liveBytes+stat.deadBytes < policy.SmallFileThreshold:
+			small = append(small, fileId)
+		}
+	}
+
+	if len(small) > 1 || len(selected) > 0 {
+		selected = append(selected, small...)
+	}
+	sort.Strings(selected)
+
+	return selected
+}
+
+// mergeSet holds what a merge works on, captured when the merge starts.
+type mergeSet struct {
+	files       []string
+	liveRecords Keydir
+	// outside tells if there are data files left out of the merge and
+	// oldestOutside is the oldest timestamp they may hold an item with.
+	outside       bool
+	oldestOutside time.Time
+	// fileMerged, if set, is called after every file is merged.
+	fileMerged func(fileId string)
+}
+
+// freezeFiles captures the keydir records pointing into frozenFiles at
+// the time of the call along with the oldest timestamp that the files
+// left out of the merge may hold.
+func (bc *BitCask) freezeFiles(frozenFiles []string) *mergeSet {
+	set := &mergeSet{files: frozenFiles, liveRecords: make(Keydir)}
+
+	frozen := make(map[uint32]void)
+	for _, fileId := range frozenFiles {
+		frozen[bc.files.id(fileId)] = member
+	}
+
+	bc.keydir.each(func(key string, record Record) {
+		if _, ok := frozen[record.file]; ok {
+			set.liveRecords[key] = record
+		}
+	})
+
+	for fileId, stat := range bc.fileStats {
+		if _, ok := frozen[bc.files.id(fileId)]; ok {
+			continue
+		}
+		if !set.outside || stat.oldest.Before(set.oldestOutside) {
+			set.oldestOutside = stat.oldest
+		}
+		set.outside = true
+	}
+
+	return set
+}
+
+// retainTombstone checks if a tombstone of key written at timeStamp
+// must survive the merge, that's if the key is still deleted and a file
+// left out of the merge could hold an older value that would otherwise
+// be resurrected during recovery.
+func (bc *BitCask) retainTombstone(set *mergeSet, key string, timeStamp time.Time) bool {
+	bc.mu.RLock()
+	_, ok := bc.keydir.get(key)
+	bc.mu.RUnlock()
+
+	return !ok && set.outside && set.oldestOutside.Before(timeStamp)
+}
+
+// mergeFiles copies the live items and the needed tombstones of the
+// merge set into new data files, writes a hint file next to each of
+// them and returns the new location of every copied key along with the
+// stats of the new files. It doesn't touch the keydir, so it runs
+// without holding the bitcask lock.
+func (bc *BitCask) mergeFiles(set *mergeSet) (Keydir, map[string]*fileStat, error) {
+	var mergeFile File
+	var cursor int64
+	var hints []byte
+	var mergeFiles []string
+	merged := make(Keydir)
+	stats := make(map[string]*fileStat)
+
+	for _, fileId := range set.files {
+		file := bc.files.id(fileId)
+		err := scanItems(bc.fs, bc.cipher, fileId, func(item fileItem, offset int64) error {
+			key := string(item.key)
+			record, ok := set.liveRecords[key]
+			tombstone := item.isTombstone()
+
+			if tombstone {
+				if !bc.retainTombstone(set, key, item.timeStamp) {
+					return nil
+				}
+			} else if !ok || record.file != file || record.valuePosition != item.valuePosition(offset) {
+				return nil
+			}
+
+			// items are rewritten with the current compression and encryption
+			// settings and key, values that don't compress are just written again.
+			raw := item.raw
+			if bc.cipher.outdated(item) || (!tombstone && item.compressed != bc.config.compression) {
+				value, err := item.decodedValue()
+				if err != nil {
+					return err
+				}
+				raw = bc.makeItem(item.key, value, item.timeStamp)
+			}
+
+			if mergeFile == nil {
+				if mergeFile = newFile(bc.fs, bc.dirName); mergeFile == nil {
+					return fmt.Errorf("can't create data file in %s", bc.dirName)
+				}
+				mergeFiles = append(mergeFiles, mergeFile.Name())
+				if err := markMerged(bc.fs, mergeFile.Name()); err != nil {
+					return err
+				}
+			}
+			previousFile := mergeFile.Name()
+			itemPos, err := bc.appendItemToFile(raw, &cursor, &mergeFile)
+			if mergeFile.Name() != previousFile {
+				mergeFiles = append(mergeFiles, mergeFile.Name())
+				if err := markMerged(bc.fs, mergeFile.Name()); err != nil {
+					return err
+				}
+				if err := writeHintFile(bc.fs, bc.cipher, previousFile, hints); err != nil {
+					return err
+				}
+				hints = nil
+			}
+			if err != nil {
+				return err
+			}
+
+			stat, ok := stats[mergeFile.Name()]
+			if !ok {
+				stat = &fileStat{}
+				stats[mergeFile.Name()] = stat
+			}
+			stat.addTimestamp(item.timeStamp)
+
+			if tombstone {
+				stat.deadBytes += int64(len(raw))
+				hints = appendHint(hints, key, Record{valuePosition: tombstoneHintPosition, timeStamp: item.timeStamp.UnixMicro()})
+				return nil
+			}
+
+			newRecord := Record{
+				file:          bc.files.id(mergeFile.Name()),
+				valueSize:     binary.BigEndian.Uint32(raw[16:]),
+				valuePosition: itemPos + int64(len(raw)) - int64(binary.BigEndian.Uint32(raw[16:])&^valueSizeFlags),
+				timeStamp:     item.timeStamp.UnixMicro(),
+			}
+			merged[key] = newRecord
+			hints = appendHint(hints, key, newRecord)
+
+			return nil
+		})
+		if err != nil {
+			if mergeFile != nil {
+				mergeFile.Close()
+			}
+			bc.deleteOldFiles(mergeFiles)
+			return nil, nil, err
+		}
+		if set.fileMerged != nil {
+			set.fileMerged(fileId)
+		}
+	}
+
+	// the merged files must be on disk before the old files are deleted.
+	if mergeFile != nil {
+		err := mergeFile.Sync()
+		mergeFile.Close()
+		if err == nil {
+			err = writeHintFile(bc.fs, bc.cipher, mergeFile.Name(), hints)
+		}
+		if err != nil {
+			bc.deleteOldFiles(mergeFiles)
+			return nil, nil, err
+		}
+	}
+
+	return merged, stats, nil
+}
+
+// merge merges the files of set, frozen at start, and replaces them by
+// the merged files. The caller holds mergeMu.
+func (bc *BitCask) merge(set *mergeSet, start time.Time) error {
+	if len(set.files) == 0 {
+		return nil
+	}
+
+	merged, stats, err := bc.mergeFiles(set)
+	if err != nil {
+		return err
+	}
+	bc.truncateLog(set.files)
+
+	bc.mu.Lock()
+	bc.swapMerged(set, merged, stats)
+	bc.lastMerge = start
+	bc.lastMergeDuration = time.Since(start)
+	bc.unlock()
+
+	bc.deleteOldFiles(set.files)
+
+	return nil
+}
+
+// swapMerged points the keydir at the merged copy of every key that
+// wasn't updated or deleted while merging, and updates the file stats.
+func (bc *BitCask) swapMerged(set *mergeSet, merged Keydir, stats map[string]*fileStat) {
+	for fileId, stat := range stats {
+		bc.fileStats[fileId] = stat
+	}
+
+	for key, newRecord := range merged {
+		current, ok := bc.keydir.get(key)
+		old := set.liveRecords[key]
+		if ok && current.file == old.file && current.valuePosition == old.valuePosition {
+			bc.keydir.set(key, newRecord)
+			bc.markLive(key, newRecord)
+		} else {
+			bc.statOf(bc.files.path(newRecord.file)).deadBytes += recordSize(key, newRecord)
+		}
+	}
+
+	for _, fileId := range set.files {
+		delete(bc.fileStats, fileId)
+	}
+}
+
+// appendHint appends the hint entry of key to hints. A hint entry holds
+// the timestamp, key size, value size, value position and the key.
+// Tombstones are written with tombstoneHintPosition as value position.
+func appendHint(hints []byte, key string, record Record) []byte {
+	entry := make([]byte, hintHeaderSize, hintHeaderSize+len(key))
+
+	binary.BigEndian.PutUint64(entry[0:], uint64(record.timeStamp))
+	binary.BigEndian.PutUint32(entry[8:], uint32(len(key)))
+	binary.BigEndian.PutUint32(entry[12:], record.valueSize)
+	binary.BigEndian.PutUint64(entry[16:], uint64(record.valuePosition))
+	entry = append(entry, key...)
+
+	return append(hints, entry...)
+}
+
+// writeHintFile writes the hint file of the data file fileId, encrypted
+// with itemCipher. Hint entries have no crc, so the file is replaced at
+// once to never leave a torn hint file behind.
+func writeHintFile(fsys FS, itemCipher *itemCipher, fileId string, hints []byte) error {
+	// the bloom file comes first, a bloom file is only used along with
+	// its hint file.
+	if err := writeBloomFile(fsys, itemCipher, fileId, hints); err != nil {
+		return err
+	}
+	name := hintFileName(fileId)
+	return replaceFile(fsys, name, itemCipher.sealData(name, hints))
+}
+
+// markMerged writes the marker telling that the data file fileId is a
+// merge output, which isn't part of the log shipped to followers.
+func markMerged(fsys FS, fileId string) error {
+	return writeFile(fsys, mergedFileName(fileId), nil, UserReadWrite)
+}
+
+// isMerged checks if the data file fileId is a merge output.
+func isMerged(fsys FS, fileId string) bool {
+	_, err := fsys.Stat(mergedFileName(fileId))
+	return err == nil
+}
+
+// mergedFileName returns the name of the merge output marker of the data file fileId.
+func mergedFileName(fileId string) string {
+	return strings.TrimSuffix(fileId, BitCaskFileExtension) + MergedFileExtension
+}
+
+// hintFileName returns the name of the hint file of the data file fileId.
+func hintFileName(fileId string) string {
+	return strings.TrimSuffix(fileId, BitCaskFileExtension) + HintFileExtension
+}
+
+// markLive adds the item of record to the live bytes of its file.
+func (bc *BitCask) markLive(key string, record Record) {
+	bc.statOf(bc.files.path(record.file)).liveBytes += recordSize(key, record)
+}
+
+// markDead moves the item of record from the live to the dead bytes of its file.
+func (bc *BitCask) markDead(key string, record Record) {
+	stat := bc.statOf(bc.files.path(record.file))
+	size := recordSize(key, record)
+	stat.liveBytes -= size
+	stat.deadBytes += size
+}
+
+// statOf returns the stats of fileId, creating them if needed.
+func (bc *BitCask) statOf(fileId string) *fileStat {
+	stat, ok := bc.fileStats[fileId]
+	if !ok {
+		stat = &fileStat{}
+		bc.fileStats[fileId] = stat
+	}
+	return stat
+}
+
+// loadFileStats rebuilds the per file stats from the keydir and the
+// sizes of the data files on disk. Every byte not referenced by the
+// keydir is considered dead.
+func (bc *BitCask) loadFileStats() {
+	bc.fileStats = make(map[string]*fileStat)
+
+	// a lazy keydir would have to read every hint file.
+	if bc.keydir.lazy == nil {
+		bc.keydir.each(bc.markLive)
+	}
+
+	files, err := bc.fs.ReadDir(bc.dirName)
+	if err != nil {
+		return
+	}
+
+	for _, fileInfo := range files {
+		if !isDataFile(fileInfo.Name()) {
+			continue
+		}
+		stat := bc.statOf(path.Join(bc.dirName, fileInfo.Name()))
+		stat.deadBytes = fileInfo.Size() - stat.liveBytes
+	}
+}
+
+// itemSize returns the size of a file item holding key and a value of valueSize bytes.
+func itemSize(key string, valueSize int) int64 {
+	return int64(itemHeaderSize + len(key) + valueSize)
+}
+
+// recordSize returns the size of the file item of record, whose key is
+// stored sealed if it's encrypted.
+func recordSize(key string, record Record) int64 {
+	size := itemSize(key, record.size())
+	if record.encrypted() {
+		size += sealOverhead
+	}
+	return size
+}
+
+// isDataFile checks if name is the name of a bitcask data file.
+func isDataFile(name string) bool {
+	return strings.HasSuffix(name, BitCaskFileExtension) && name != keydirFileName
+}
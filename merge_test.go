@@ -0,0 +1,318 @@
+package bitcask
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAutoMerge(t *testing.T) {
+	t.Run("merges once fragmentation trigger is exceeded", func(t *testing.T) {
+		policy := MergePolicy{FragMergeTrigger: 50, CheckInterval: 10 * time.Millisecond}
+		bc, _ := Open(testBitcaskAutoMergePath, RWsyncConfig.WithFS(NewMemFS()).WithAutoMerge(policy))
+		defer bc.Close()
+
+		for round := 0; round < 5; round++ {
+			for i := 0; i < 20; i++ {
+				key := "key" + fmt.Sprintf("%d", i)
+				value := "value" + fmt.Sprintf("%d", round)
+				bc.Put([]byte(key), []byte(value))
+			}
+		}
+
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			bc.mu.RLock()
+			needed := bc.needsMerge()
+			bc.mu.RUnlock()
+			if !needed {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("expected background merger to merge fragmented files")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		got, _ := bc.Get([]byte("key7"))
+		assertEqualStrings(t, string(got), "value4")
+	})
+
+	t.Run("close doesn't merge when auto merge is enabled", func(t *testing.T) {
+		fsys := NewMemFS()
+		policy := MergePolicy{FragMergeTrigger: 100, CheckInterval: time.Hour}
+		bc, _ := Open(testBitcaskAutoMergePath, RWsyncConfig.WithFS(fsys).WithAutoMerge(policy))
+		for i := 0; i < 50; i++ {
+			bc.Put([]byte("key"), []byte("value"+fmt.Sprintf("%d", i)))
+		}
+		files := len(bc.fileStats)
+		bc.Close()
+
+		bc, _ = Open(testBitcaskAutoMergePath, DefaultConfig.WithFS(fsys))
+		defer bc.Close()
+		if len(bc.fileStats) != files {
+			t.Errorf("got %d data files, expected %d", len(bc.fileStats), files)
+		}
+		got, _ := bc.Get([]byte("key"))
+		assertEqualStrings(t, string(got), "value49")
+	})
+}
+
+func TestMergeWindow(t *testing.T) {
+	var tests = []struct {
+		testName string
+		policy   MergePolicy
+		hour     int
+		want     bool
+	}{
+		{"always", MergePolicy{}, 13, true},
+		{"inside window", MergePolicy{WindowStart: 1, WindowEnd: 5}, 3, true},
+		{"outside window", MergePolicy{WindowStart: 1, WindowEnd: 5}, 6, false},
+		{"inside window wrapping midnight", MergePolicy{WindowStart: 22, WindowEnd: 2}, 1, true},
+		{"outside window wrapping midnight", MergePolicy{WindowStart: 22, WindowEnd: 2}, 12, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			now := time.Date(2022, 8, 8, tt.hour, 30, 0, 0, time.Local)
+			if got := tt.policy.inWindow(now); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNonBlockingMerge(t *testing.T) {
+	t.Run("writes during merge aren't lost", func(t *testing.T) {
+		bc, _ := Open(testBitcaskMergePath, RWsyncConfig.WithFS(NewMemFS()))
+		defer bc.Close()
+		for i := 0; i < 100; i++ {
+			bc.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte("old"))
+		}
+
+		done := make(chan error)
+		go func() {
+			done <- bc.Merge()
+		}()
+		for i := 0; i < 100; i++ {
+			bc.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte("new"+fmt.Sprintf("%d", i)))
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("unexpected merge error: %v", err)
+		}
+
+		for i := 0; i < 100; i++ {
+			got, _ := bc.Get([]byte("key" + fmt.Sprintf("%d", i)))
+			assertEqualStrings(t, string(got), "new"+fmt.Sprintf("%d", i))
+		}
+	})
+
+	t.Run("merge writes hint files and keeps the lock", func(t *testing.T) {
+		fsys := NewMemFS()
+		bc, _ := Open(testBitcaskMergePath, RWsyncConfig.WithFS(fsys))
+		defer bc.Close()
+		for i := 0; i < 100; i++ {
+			bc.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte("value"+fmt.Sprintf("%d", i)))
+		}
+		bc.Merge()
+
+		for fileId := range bc.fileStats {
+			if fileId == bc.activeFile.Name() {
+				continue
+			}
+			if _, err := fsys.Stat(hintFileName(fileId)); err != nil {
+				t.Errorf("expected to find hint file of %q", fileId)
+			}
+		}
+		if _, err := Open(testBitcaskMergePath, RWConfig.WithFS(fsys)); err != ErrBitCaskIsLocked {
+			t.Errorf("expected bitcask to stay locked after merge, got %v", err)
+		}
+
+		got, _ := bc.Get([]byte("key42"))
+		assertEqualStrings(t, string(got), "value42")
+	})
+}
+
+func TestSelectMergeFiles(t *testing.T) {
+	var tests = []struct {
+		testName string
+		policy   MergePolicy
+		stats    map[string]*fileStat
+		want     []string
+	}{
+		{
+			"fragmented files only",
+			MergePolicy{FragThreshold: 40},
+			map[string]*fileStat{"1": {liveBytes: 50, deadBytes: 50}, "2": {liveBytes: 100}, "3": {liveBytes: 70, deadBytes: 30}},
+			[]string{"1"},
+		},
+		{
+			"dead bytes threshold",
+			MergePolicy{DeadBytesThreshold: 40},
+			map[string]*fileStat{"1": {liveBytes: 1000, deadBytes: 50}, "2": {liveBytes: 100, deadBytes: 10}},
+			[]string{"1"},
+		},
+		{
+			"small files are coalesced",
+			MergePolicy{FragThreshold: 40, SmallFileThreshold: 200},
+			map[string]*fileStat{"1": {liveBytes: 100}, "2": {liveBytes: 100}, "3": {liveBytes: 1000}},
+			[]string{"1", "2"},
+		},
+		{
+			"single small file is left alone",
+			MergePolicy{FragThreshold: 40, SmallFileThreshold: 200},
+			map[string]*fileStat{"1": {liveBytes: 100}, "2": {liveBytes: 1000}},
+			nil,
+		},
+		{
+			"active file is never picked",
+			MergePolicy{FragThreshold: 40},
+			map[string]*fileStat{"1": {deadBytes: 100}, "active": {deadBytes: 100}},
+			[]string{"1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			fsys := NewMemFS()
+			bc, _ := Open(testBitcaskMergePath, RWConfig.WithFS(fsys))
+			defer bc.Close()
+			active := bc.fileStats[bc.activeFile.Name()]
+			bc.fileStats = tt.stats
+			bc.fileStats[bc.activeFile.Name()] = bc.fileStats["active"]
+			delete(bc.fileStats, "active")
+
+			got := bc.selectMergeFiles(tt.policy)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			bc.fileStats = map[string]*fileStat{bc.activeFile.Name(): active}
+		})
+	}
+
+	t.Run("fully live files aren't rewritten", func(t *testing.T) {
+		bc, _ := Open(testBitcaskMergePath, RWsyncConfig.WithFS(NewMemFS()).WithMergePolicy(MergePolicy{FragThreshold: 40}))
+		defer bc.Close()
+		for i := 0; i < 100; i++ {
+			bc.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte("value"+fmt.Sprintf("%d", i)))
+		}
+		for i := 0; i < 10; i++ {
+			bc.Put([]byte("key0"), []byte("value"+fmt.Sprintf("%d", i)))
+		}
+		liveFiles := make(map[string]void)
+		for fileId, stat := range bc.fileStats {
+			if stat.fragmentation() < 40 && fileId != bc.activeFile.Name() {
+				liveFiles[fileId] = member
+			}
+		}
+
+		bc.Merge()
+
+		for fileId := range liveFiles {
+			if _, ok := bc.fileStats[fileId]; !ok {
+				t.Errorf("expected %q to be left alone", fileId)
+			}
+		}
+		got, _ := bc.Get([]byte("key0"))
+		assertEqualStrings(t, string(got), "value9")
+		got, _ = bc.Get([]byte("key99"))
+		assertEqualStrings(t, string(got), "value99")
+	})
+}
+
+func TestMergePolicyThresholds(t *testing.T) {
+	var tests = []struct {
+		testName string
+		policy   MergePolicy
+		want     MergePolicy
+	}{
+		{"no policy", MergePolicy{}, DefaultMergePolicy},
+		{
+			"thresholds from the triggers",
+			MergePolicy{FragMergeTrigger: 50, DeadBytesMergeTrigger: 1024, CheckInterval: time.Second},
+			MergePolicy{FragMergeTrigger: 50, DeadBytesMergeTrigger: 1024, FragThreshold: 50, DeadBytesThreshold: 1024, CheckInterval: time.Second},
+		},
+		{
+			"default thresholds without triggers",
+			MergePolicy{CheckInterval: time.Second},
+			MergePolicy{
+				FragThreshold:      DefaultMergePolicy.FragThreshold,
+				DeadBytesThreshold: DefaultMergePolicy.DeadBytesThreshold,
+				SmallFileThreshold: DefaultMergePolicy.SmallFileThreshold,
+				CheckInterval:      time.Second,
+			},
+		},
+		{"thresholds are kept", MergePolicy{FragMergeTrigger: 50, SmallFileThreshold: 10}, MergePolicy{FragMergeTrigger: 50, SmallFileThreshold: 10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			if got := RWConfig.WithMergePolicy(tt.policy).policy(); got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeTimestampsAndTombstones(t *testing.T) {
+	t.Run("merge keeps original timestamps", func(t *testing.T) {
+		bc, _ := Open(testBitcaskMergePath, RWsyncConfig.WithFS(NewMemFS()))
+		defer bc.Close()
+		for i := 0; i < 100; i++ {
+			bc.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte("value"+fmt.Sprintf("%d", i)))
+		}
+		want, _ := bc.keydir.get("key3")
+
+		bc.Merge()
+
+		if got, _ := bc.keydir.get("key3"); got.timeStamp != want.timeStamp {
+			t.Errorf("got timestamp %v, want %v", got.timeStamp, want)
+		}
+	})
+
+	t.Run("tombstone is kept while an older file holds the key", func(t *testing.T) {
+		fsys := NewMemFS()
+		bc, _ := Open(testBitcaskMergePath, RWsyncConfig.WithFS(fsys).WithMergePolicy(MergePolicy{FragThreshold: 50}))
+		for i := 0; i < 40; i++ {
+			bc.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte("value"+fmt.Sprintf("%d", i)))
+		}
+		oldFile := fileOf(bc, "key0")
+		bc.Delete([]byte("key0"))
+		for i := 0; i < 100; i++ {
+			bc.Put([]byte("hot"), []byte("value"+fmt.Sprintf("%d", i)))
+		}
+
+		bc.Merge()
+		if _, ok := bc.fileStats[oldFile]; !ok {
+			t.Fatalf("expected %q to be left out of the merge", oldFile)
+		}
+		crash(bc)
+
+		bc, _ = Open(testBitcaskMergePath, DefaultConfig.WithFS(fsys))
+		defer bc.Close()
+		_, err := bc.Get([]byte("key0"))
+		assertErrorMsg(t, err, BitCaskError("\"key0\": key doesn't exist"))
+	})
+
+	t.Run("full merge drops tombstones", func(t *testing.T) {
+		fsys := NewMemFS()
+		bc, _ := Open(testBitcaskMergePath, RWsyncConfig.WithFS(fsys))
+		defer bc.Close()
+		for i := 0; i < 40; i++ {
+			bc.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte("value"+fmt.Sprintf("%d", i)))
+			bc.Delete([]byte("key" + fmt.Sprintf("%d", i)))
+		}
+		bc.Put([]byte("last"), []byte("value"))
+		bc.Merge()
+
+		for fileId := range bc.fileStats {
+			if fileId == bc.activeFile.Name() {
+				continue
+			}
+			scanItems(fsys, nil, fileId, func(item fileItem, offset int64) error {
+				if item.isTombstone() {
+					t.Errorf("found tombstone of %q in %q", item.key, fileId)
+				}
+				return nil
+			})
+		}
+	})
+}
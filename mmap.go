@@ -0,0 +1,46 @@
+package bitcask
+
+import "os"
+
+// WithMmap returns a copy of the config that memory maps the data files
+// and reads values by slicing the mapping. A file is mapped as it is when
+// it's opened, so the values appended to the active file later are read
+// with ReadAt until the file is full and mapped again. Only files of OSFS
+// on unix systems and of MemFS can be mapped, the others are read with ReadAt.
+func (c Config) WithMmap() Config {
+	c.mmap = true
+	return c
+}
+
+// mapFile maps the whole content of file into memory. It returns a nil
+// mapping if file can't be mapped, along with the function that unmaps it.
+func mapFile(file File) ([]byte, func() error) {
+	switch file := file.(type) {
+	case *os.File:
+		info, err := file.Stat()
+		if err != nil || info.Size() == 0 || int64(int(info.Size())) != info.Size() {
+			return nil, nil
+		}
+		data, err := mmap(file, int(info.Size()))
+		if err != nil {
+			return nil, nil
+		}
+		return data, func() error { return munmap(data) }
+
+	case *memFile:
+		file.data.mu.RLock()
+		defer file.data.mu.RUnlock()
+		return file.data.data[:len(file.data.data):len(file.data.data)], nil
+	}
+
+	return nil, nil
+}
+
+// view returns size bytes of the mapping of pf at offset, or false if
+// they aren't mapped.
+func (pf *pooledFile) view(offset int64, size int) ([]byte, bool) {
+	if pf.mapping == nil || offset < 0 || offset+int64(size) > int64(len(pf.mapping)) {
+		return nil, false
+	}
+	return pf.mapping[offset : offset+int64(size)], true
+}
@@ -0,0 +1,22 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package bitcask
+
+import (
+	"errors"
+	"os"
+)
+
+// errMmapUnsupported is returned by mmap on systems it doesn't support,
+// files are read with ReadAt there.
+var errMmapUnsupported = errors.New("mmap isn't supported on this system")
+
+// mmap maps the first size bytes of file read only.
+func mmap(file *os.File, size int) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+// munmap unmaps a mapping returned by mmap.
+func munmap(data []byte) error {
+	return errMmapUnsupported
+}
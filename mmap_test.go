@@ -0,0 +1,122 @@
+package bitcask
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestMmap(t *testing.T) {
+	t.Run("values of full files are read from the mapping", func(t *testing.T) {
+		os.RemoveAll(testBitcaskPath)
+		bc, _ := Open(testBitcaskPath, RWsyncConfig.WithMmap())
+		for i := 0; i < 200; i++ {
+			bc.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte("value"+fmt.Sprintf("%d", i)))
+		}
+
+		for i := 0; i < 200; i++ {
+			got, _ := bc.Get([]byte("key" + fmt.Sprintf("%d", i)))
+			assertEqualStrings(t, string(got), "value"+fmt.Sprintf("%d", i))
+		}
+		pf, _ := bc.readFiles.get(fileOf(bc, "key0"))
+		if pf.mapping == nil {
+			t.Errorf("expected %q to be mapped", pf.fileId)
+		}
+		bc.readFiles.release(pf)
+
+		bc.Close()
+		os.RemoveAll(testBitcaskPath)
+	})
+
+	t.Run("values appended after the active file is mapped", func(t *testing.T) {
+		os.RemoveAll(testBitcaskPath)
+		bc, _ := Open(testBitcaskPath, RWsyncConfig.WithMmap())
+		bc.Put([]byte("key1"), []byte("value1"))
+		got, _ := bc.Get([]byte("key1"))
+		assertEqualStrings(t, string(got), "value1")
+
+		bc.Put([]byte("key2"), []byte("value2"))
+		got, _ = bc.Get([]byte("key2"))
+		assertEqualStrings(t, string(got), "value2")
+
+		bc.Close()
+		os.RemoveAll(testBitcaskPath)
+	})
+
+	t.Run("view stays valid while a merge deletes its file", func(t *testing.T) {
+		os.RemoveAll(testBitcaskPath)
+		bc, _ := Open(testBitcaskPath, RWsyncConfig.WithMmap())
+		for i := 0; i < 100; i++ {
+			bc.Put([]byte("key"+fmt.Sprintf("%d", i%10)), []byte("value"+fmt.Sprintf("%d", i)))
+		}
+		for i := 0; i < 50; i++ {
+			bc.Put([]byte("other"), []byte("value"+fmt.Sprintf("%d", i)))
+		}
+		fileId := fileOf(bc, "key0")
+
+		err := bc.GetView([]byte("key0"), func(value []byte) error {
+			bc.Merge()
+			if _, err := os.Stat(fileId); !os.IsNotExist(err) {
+				t.Errorf("expected %q to be merged", fileId)
+			}
+			assertEqualStrings(t, string(value), "value90")
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bc.Close()
+		os.RemoveAll(testBitcaskPath)
+	})
+
+	t.Run("get view errors", func(t *testing.T) {
+		bc, _ := Open(testBitcaskPath, RWConfig.WithFS(NewMemFS()).WithMmap())
+		bc.Put([]byte("key"), []byte("value"))
+
+		err := bc.GetView([]byte("key"), func(value []byte) error {
+			assertEqualStrings(t, string(value), "value")
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		errStop := errors.New("stop")
+		err = bc.GetView([]byte("key"), func(value []byte) error { return errStop })
+		assertErrorMsg(t, err, errStop)
+
+		err = bc.GetView([]byte("missing"), func(value []byte) error { return nil })
+		assertErrorMsg(t, err, BitCaskError("\"missing\": key doesn't exist"))
+		bc.Close()
+	})
+}
+
+func BenchmarkGetView(b *testing.B) {
+	os.RemoveAll(testBitcaskPath)
+	defer os.RemoveAll(testBitcaskPath)
+
+	bc, _ := Open(testBitcaskPath, RWConfig.WithMmap())
+	for i := 0; i < 1000; i++ {
+		bc.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte("value"+fmt.Sprintf("%d", i)))
+	}
+	bc.Sync()
+	defer bc.Close()
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = []byte("key" + fmt.Sprintf("%d", (i*7919)%1000))
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			err := bc.GetView(keys[i%len(keys)], func(value []byte) error { return nil })
+			if err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+}
@@ -0,0 +1,18 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package bitcask
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmap maps the first size bytes of file read only.
+func mmap(file *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(file.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// munmap unmaps a mapping returned by mmap.
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,125 @@
+package bitcask
+
+import (
+	"encoding/binary"
+	"errors"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recoverKeydir rebuilds keydir from the data files in directoryPath,
+// reading the hint file of a data file instead of the data file itself
+// when there is one. If a key has several items, the newest one wins.
+// The data files get their ids from files. It returns the oldest
+// timestamp found in every data file.
+// returns err == ErrEncrypted or err == ErrDecryptionFailed if the items
+// can't be decrypted with itemCipher.
+func recoverKeydir(fsys FS, itemCipher *itemCipher, directoryPath string, files *fileTable, keydir *keyIndex) (map[string]time.Time, error) {
+	oldest := make(map[string]time.Time)
+
+	// tombstones are kept in keydir with the tombstone hint position
+	// until every file is read, since an older put may come later.
+	add := func(fileId, key string, record Record) {
+		if t, ok := oldest[fileId]; !ok || record.time().Before(t) {
+			oldest[fileId] = record.time()
+		}
+		if current, ok := keydir.get(key); ok && record.timeStamp < current.timeStamp {
+			return
+		}
+		keydir.set(key, record)
+	}
+
+	for _, fileId := range dataFiles(fsys, directoryPath) {
+		file := files.id(fileId)
+		if hints, err := readFile(fsys, hintFileName(fileId)); err == nil {
+			if hints, err = itemCipher.openData(hintFileName(fileId), hints); err != nil {
+				return nil, err
+			}
+			parseHints(hints, func(key string, record Record) {
+				record.file = file
+				add(fileId, key, record)
+			})
+			continue
+		}
+
+		// a corrupted item ends the scan of its file, the items before it are kept.
+		err := scanItems(fsys, itemCipher, fileId, func(item fileItem, offset int64) error {
+			record := Record{
+				file:          file,
+				valueSize:     item.valueSizeField(),
+				valuePosition: item.valuePosition(offset),
+				timeStamp:     item.timeStamp.UnixMicro(),
+			}
+			if item.isTombstone() {
+				record.valuePosition = tombstoneHintPosition
+			}
+			add(fileId, string(item.key), record)
+			return nil
+		})
+		if errors.Is(err, ErrEncrypted) || errors.Is(err, ErrDecryptionFailed) {
+			return nil, err
+		}
+	}
+
+	var tombstones []string
+	keydir.each(func(key string, record Record) {
+		if record.valuePosition == tombstoneHintPosition {
+			tombstones = append(tombstones, key)
+		}
+	})
+	for _, key := range tombstones {
+		keydir.remove(key)
+	}
+
+	return oldest, nil
+}
+
+// parseHints calls fn for every entry of a hint file.
+func parseHints(hints []byte, fn func(key string, record Record)) {
+	for len(hints) >= hintHeaderSize {
+		keySize := int(binary.BigEndian.Uint32(hints[8:]))
+		if len(hints) < hintHeaderSize+keySize {
+			return
+		}
+
+		fn(string(hints[hintHeaderSize:hintHeaderSize+keySize]), Record{
+			valueSize:     binary.BigEndian.Uint32(hints[12:]),
+			valuePosition: int64(binary.BigEndian.Uint64(hints[16:])),
+			timeStamp:     int64(binary.BigEndian.Uint64(hints[0:])),
+		})
+		hints = hints[hintHeaderSize+keySize:]
+	}
+}
+
+// dataFiles returns the data files in directoryPath ordered by their ids,
+// which is the order they were created in.
+func dataFiles(fsys FS, directoryPath string) []string {
+	infos, err := fsys.ReadDir(directoryPath)
+	if err != nil {
+		return nil
+	}
+
+	var ids []int64
+	for _, info := range infos {
+		name := info.Name()
+		if !isDataFile(name) {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSuffix(name, BitCaskFileExtension), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	files := make([]string, 0, len(ids))
+	for _, id := range ids {
+		files = append(files, path.Join(directoryPath, strconv.FormatInt(id, 10)+BitCaskFileExtension))
+	}
+
+	return files
+}
@@ -0,0 +1,67 @@
+package bitcask
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+)
+
+// crash leaves the bitcask without closing it, as if the writer process died,
+// and removes its lock like an operator would.
+func crash(bc *BitCask) {
+	bc.activeFile.Close()
+	bc.fs.Remove(path.Join(bc.dirName, bc.lock))
+}
+
+func TestRecovery(t *testing.T) {
+	t.Run("keydir is recovered from data files", func(t *testing.T) {
+		os.RemoveAll(testBitcaskPath)
+		bc, _ := Open(testBitcaskPath, RWsyncConfig)
+		for i := 0; i < 100; i++ {
+			bc.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte("value"+fmt.Sprintf("%d", i)))
+		}
+		bc.Put([]byte("key5"), []byte("updated"))
+		bc.Delete([]byte("key7"))
+		crash(bc)
+
+		bc, _ = Open(testBitcaskPath)
+		got, _ := bc.Get([]byte("key5"))
+		assertEqualStrings(t, string(got), "updated")
+		got, _ = bc.Get([]byte("key99"))
+		assertEqualStrings(t, string(got), "value99")
+
+		_, err := bc.Get([]byte("key7"))
+		assertErrorMsg(t, err, BitCaskError("\"key7\": key doesn't exist"))
+		bc.Close()
+		os.RemoveAll(testBitcaskPath)
+	})
+
+	t.Run("keydir is recovered from hint files", func(t *testing.T) {
+		os.RemoveAll(testBitcaskPath)
+		bc, _ := Open(testBitcaskPath, RWsyncConfig)
+		for i := 0; i < 100; i++ {
+			bc.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte("value"+fmt.Sprintf("%d", i)))
+		}
+		bc.Merge()
+		bc.Put([]byte("key1"), []byte("after merge"))
+		want, _ := bc.keydir.get("key42")
+		wantFile := fileOf(bc, "key42")
+		crash(bc)
+
+		bc, _ = Open(testBitcaskPath)
+		record, _ := bc.keydir.get("key42")
+		if gotFile := fileOf(bc, "key42"); gotFile != wantFile {
+			t.Errorf("got file %q, want %q", gotFile, wantFile)
+		}
+		// file ids are given again by every process
+		record.file, want.file = 0, 0
+		if record != want {
+			t.Errorf("got record %v, want %v", record, want)
+		}
+		got, _ := bc.Get([]byte("key1"))
+		assertEqualStrings(t, string(got), "after merge")
+		bc.Close()
+		os.RemoveAll(testBitcaskPath)
+	})
+}
@@ -0,0 +1,337 @@
+package bitcask
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+)
+
+// CorruptRange is a range of bytes [Start, End) of a data file that
+// holds no valid items.
+type CorruptRange struct {
+	Start int64
+	End   int64
+}
+
+// FileReport contains the result of checking a data file.
+type FileReport struct {
+	File          string
+	ValidItems    int
+	CorruptRanges []CorruptRange
+}
+
+// CheckReport contains the result of checking a bitcask datastore.
+type CheckReport struct {
+	Files []FileReport
+	// KeydirProblems describes the entries of the keydir file
+	// that don't point at a valid item.
+	KeydirProblems []string
+	// Encrypted tells if the datastore has encrypted items or files,
+	// whose keydir file can't be checked without their key.
+	Encrypted bool
+}
+
+// RepairReport contains the result of repairing a bitcask datastore.
+type RepairReport struct {
+	// Check is the report of the datastore before it was repaired.
+	Check *CheckReport
+	// Quarantined lists the corrupted data files, which are moved to
+	// the quarantine directory after their valid items are rewritten.
+	Quarantined []string
+	// LostKeys lists the keys of the keydir file that couldn't be
+	// recovered, or only with an older value. The keys of the hint
+	// files are used if there is no keydir file.
+	LostKeys [][]byte
+}
+
+// validItem is the location of a valid item found while checking a data file.
+type validItem struct {
+	key       string
+	valueSize uint32
+}
+
+// OK reports whether the check found no problems.
+func (r *CheckReport) OK() bool {
+	for _, file := range r.Files {
+		if len(file.CorruptRanges) > 0 {
+			return false
+		}
+	}
+
+	return len(r.KeydirProblems) == 0
+}
+
+// Check walks every item of the data files at directoryPath, checking
+// its crc and sizes, and cross checks the keydir file against the
+// valid items found. The keydir file of an encrypted datastore isn't
+// checked. It doesn't modify the datastore.
+func Check(directoryPath string) (*CheckReport, error) {
+	return check(OSFS, directoryPath)
+}
+
+// check checks the bitcask at directoryPath of fsys, see Check.
+func check(fsys FS, directoryPath string) (*CheckReport, error) {
+	if _, err := fsys.Stat(directoryPath); err != nil {
+		return nil, err
+	}
+
+	report := &CheckReport{}
+	items := make(map[string]map[int64]validItem)
+
+	for _, fileId := range dataFiles(fsys, directoryPath) {
+		fileItems := make(map[int64]validItem)
+		fileReport, err := checkFile(fsys, fileId, func(item fileItem, offset int64) {
+			fileItems[offset] = validItem{key: string(item.key), valueSize: item.valueSizeField()}
+			report.Encrypted = report.Encrypted || item.encrypted
+		})
+		if err != nil {
+			return nil, err
+		}
+		report.Files = append(report.Files, fileReport)
+		items[fileId] = fileItems
+	}
+
+	keydirPath := path.Join(directoryPath, keydirFileName)
+	keydirData, err := readFile(fsys, keydirPath)
+	if err != nil {
+		return report, nil
+	}
+	if report.Encrypted || isEncryptedData(keydirData) {
+		report.Encrypted = true
+		return report, nil
+	}
+
+	files, keydir := newFileTable(), newKeyIndex(false)
+	parseKeydirData(string(keydirData), files, keydir)
+	keydir.each(func(key string, record Record) {
+		fileId := files.path(record.file)
+		itemBegin := record.valuePosition - itemHeaderSize - int64(len(key))
+		item, ok := items[fileId][itemBegin]
+		if !ok || item.key != key || item.valueSize != record.valueSize {
+			report.KeydirProblems = append(report.KeydirProblems,
+				fmt.Sprintf("%q: no valid item at %s:%d", key, fileId, itemBegin))
+		}
+	})
+
+	return report, nil
+}
+
+// Repair rebuilds a clean datastore at directoryPath from its valid
+// items. The valid items of corrupted data files are rewritten into new
+// data files and the corrupted files are moved to the quarantine
+// directory. Then the keydir file and the hint files are built again.
+// returns err == ErrBitCaskIsLocked if a process has the bitcask open
+// err == ErrEncrypted if the datastore is encrypted.
+func Repair(directoryPath string) (*RepairReport, error) {
+	return repair(OSFS, directoryPath)
+}
+
+// repair repairs the bitcask at directoryPath of fsys, see Repair.
+func repair(fsys FS, directoryPath string) (*RepairReport, error) {
+	if checkLock(fsys, directoryPath) != noProcess {
+		return nil, ErrBitCaskIsLocked
+	}
+
+	checkReport, err := check(fsys, directoryPath)
+	if err != nil {
+		return nil, err
+	}
+	if checkReport.Encrypted {
+		return nil, ErrEncrypted
+	}
+	report := &RepairReport{Check: checkReport}
+
+	files, oldKeydir := newFileTable(), newKeyIndex(false)
+	if keydirData, err := readFile(fsys, path.Join(directoryPath, keydirFileName)); err == nil {
+		parseKeydirData(string(keydirData), files, oldKeydir)
+	} else {
+		parseHintFiles(fsys, directoryPath, oldKeydir)
+	}
+
+	for _, fileReport := range checkReport.Files {
+		if len(fileReport.CorruptRanges) == 0 {
+			continue
+		}
+		if err := quarantine(fsys, directoryPath, fileReport.File); err != nil {
+			return nil, err
+		}
+		report.Quarantined = append(report.Quarantined, fileReport.File)
+	}
+
+	// hint files may be as broken as the data files, so the keydir is
+	// rebuilt from the data files themselves.
+	for _, fileId := range dataFiles(fsys, directoryPath) {
+		fsys.Remove(hintFileName(fileId))
+		fsys.Remove(bloomFileName(fileId))
+	}
+	fsys.Remove(path.Join(directoryPath, keydirFileName))
+
+	keydir := newKeyIndex(false)
+	if _, err := recoverKeydir(fsys, nil, directoryPath, files, keydir); err != nil {
+		return nil, err
+	}
+	for _, fileId := range dataFiles(fsys, directoryPath) {
+		var hints []byte
+		err := scanItems(fsys, nil, fileId, func(item fileItem, offset int64) error {
+			record := Record{
+				valueSize:     item.valueSizeField(),
+				valuePosition: item.valuePosition(offset),
+				timeStamp:     item.timeStamp.UnixMicro(),
+			}
+			if item.isTombstone() {
+				record = Record{valuePosition: tombstoneHintPosition, timeStamp: item.timeStamp.UnixMicro()}
+			}
+			hints = appendHint(hints, string(item.key), record)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeHintFile(fsys, nil, fileId, hints); err != nil {
+			return nil, err
+		}
+	}
+	writeKeydirFile(fsys, nil, directoryPath, files, keydir)
+
+	oldKeydir.each(func(key string, record Record) {
+		if recovered, ok := keydir.get(key); !ok || recovered.timeStamp < record.timeStamp {
+			report.LostKeys = append(report.LostKeys, []byte(key))
+		}
+	})
+
+	return report, nil
+}
+
+// parseHintFiles fills keydir with the newest record of every key of the
+// hint files at directoryPath, leaving out the deleted keys. The records
+// point at no file, since they're only compared with the recovered ones.
+func parseHintFiles(fsys FS, directoryPath string, keydir *keyIndex) {
+	for _, fileId := range dataFiles(fsys, directoryPath) {
+		hints, err := readFile(fsys, hintFileName(fileId))
+		if err != nil {
+			continue
+		}
+		parseHints(hints, func(key string, record Record) {
+			if current, ok := keydir.get(key); ok && record.timeStamp < current.timeStamp {
+				return
+			}
+			keydir.set(key, record)
+		})
+	}
+
+	var tombstones []string
+	keydir.each(func(key string, record Record) {
+		if record.valuePosition == tombstoneHintPosition {
+			tombstones = append(tombstones, key)
+		}
+	})
+	for _, key := range tombstones {
+		keydir.remove(key)
+	}
+}
+
+// checkFile walks the items of the data file fileId, calling fn for
+// every valid item, and reports the ranges that hold no valid items.
+func checkFile(fsys FS, fileId string, fn func(item fileItem, offset int64)) (FileReport, error) {
+	report := FileReport{File: fileId}
+
+	file, err := openFile(fsys, fileId)
+	if err != nil {
+		return report, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return report, err
+	}
+
+	addCorrupt := func(start, end int64) {
+		last := len(report.CorruptRanges) - 1
+		if last >= 0 && report.CorruptRanges[last].End == start {
+			report.CorruptRanges[last].End = end
+			return
+		}
+		report.CorruptRanges = append(report.CorruptRanges, CorruptRange{Start: start, End: end})
+	}
+
+	reader := bufio.NewReader(file)
+	var offset int64
+
+	for {
+		item, err := decodeItem(reader)
+		if err == io.EOF {
+			return report, nil
+		}
+		if err != nil {
+			// a truncated item takes the rest of the file with it
+			addCorrupt(offset, info.Size())
+			return report, nil
+		}
+
+		end := offset + int64(len(item.raw))
+		if !item.validCRC() || len(item.key) == 0 {
+			addCorrupt(offset, end)
+		} else {
+			report.ValidItems++
+			fn(item, offset)
+		}
+		offset = end
+	}
+}
+
+// quarantine rewrites the valid items of the corrupted data file fileId
+// into a new data file and moves fileId into the quarantine directory.
+// The new data file is synced first, so that the valid items survive a
+// crash during the move.
+func quarantine(fsys FS, directoryPath, fileId string) error {
+	quarantineDir := path.Join(directoryPath, quarantineDirName)
+	if err := fsys.MkdirAll(quarantineDir, UserReadWriteExec); err != nil {
+		return err
+	}
+
+	repaired := newFile(fsys, directoryPath)
+	if repaired == nil {
+		return fmt.Errorf("can't create data file in %s", directoryPath)
+	}
+	defer repaired.Close()
+
+	var writeErr error
+	fileReport, err := checkFile(fsys, fileId, func(item fileItem, offset int64) {
+		if writeErr == nil {
+			_, writeErr = repaired.Write(item.raw)
+		}
+	})
+	if err == nil {
+		err = writeErr
+	}
+	if err == nil {
+		err = repaired.Sync()
+	}
+	if err != nil {
+		fsys.Remove(repaired.Name())
+		return err
+	}
+
+	// the repaired file isn't part of the log shipped to followers.
+	if fileReport.ValidItems == 0 {
+		fsys.Remove(repaired.Name())
+	} else if err := markMerged(fsys, repaired.Name()); err != nil {
+		return err
+	}
+	if err := syncDir(fsys, directoryPath); err != nil {
+		return err
+	}
+
+	fsys.Remove(hintFileName(fileId))
+	fsys.Remove(bloomFileName(fileId))
+	fsys.Remove(mergedFileName(fileId))
+	if err := fsys.Rename(fileId, path.Join(quarantineDir, path.Base(fileId))); err != nil {
+		return err
+	}
+	if err := syncDir(fsys, quarantineDir); err != nil {
+		return err
+	}
+	return syncDir(fsys, directoryPath)
+}
@@ -0,0 +1,204 @@
+package bitcask
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+// corruptValue flips a byte in the value of key in the file system of bc.
+func corruptValue(bc *BitCask, key string) {
+	record, _ := bc.keydir.get(key)
+	data, _ := readFile(bc.fs, fileOf(bc, key))
+	data[record.valuePosition] ^= 0xff
+	writeFile(bc.fs, fileOf(bc, key), data, UserReadWrite)
+}
+
+// fillBitcask writes the keys to a bitcask in a MemFS and closes it.
+func fillBitcask(t testing.TB) *BitCask {
+	t.Helper()
+	bc, err := Open(testBitcaskPath, RWsyncConfig.WithFS(NewMemFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		bc.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte("value"+fmt.Sprintf("%d", i)))
+	}
+	bc.Close()
+	return bc
+}
+
+func TestCheck(t *testing.T) {
+	t.Run("healthy bitcask", func(t *testing.T) {
+		bc := fillBitcask(t)
+		report, err := check(bc.fs, testBitcaskPath)
+
+		if err != nil || !report.OK() {
+			t.Errorf("expected healthy bitcask, got %+v, %v", report, err)
+		}
+	})
+
+	t.Run("corrupted value", func(t *testing.T) {
+		bc := fillBitcask(t)
+		corruptValue(bc, "key42")
+		report, err := check(bc.fs, testBitcaskPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if report.OK() {
+			t.Fatal("expected check to find problems")
+		}
+		var corrupted []string
+		for _, file := range report.Files {
+			if len(file.CorruptRanges) > 0 {
+				corrupted = append(corrupted, file.File)
+			}
+		}
+		if want := []string{fileOf(bc, "key42")}; !reflect.DeepEqual(corrupted, want) {
+			t.Errorf("got corrupted files %v, want %v", corrupted, want)
+		}
+		if len(report.KeydirProblems) != 1 {
+			t.Errorf("got keydir problems %v, expected one", report.KeydirProblems)
+		}
+	})
+
+	t.Run("truncated file", func(t *testing.T) {
+		bc := fillBitcask(t)
+		record, _ := bc.keydir.get("key42")
+		fileId := fileOf(bc, "key42")
+		data, _ := readFile(bc.fs, fileId)
+		writeFile(bc.fs, fileId, data[:record.valuePosition], UserReadWrite)
+		report, err := check(bc.fs, testBitcaskPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, file := range report.Files {
+			if file.File != fileId {
+				continue
+			}
+			want := []CorruptRange{{record.valuePosition - itemHeaderSize - int64(len("key42")), record.valuePosition}}
+			if !reflect.DeepEqual(file.CorruptRanges, want) {
+				t.Errorf("got corrupt ranges %v, want %v", file.CorruptRanges, want)
+			}
+		}
+	})
+}
+
+func TestRepair(t *testing.T) {
+	t.Run("locked bitcask", func(t *testing.T) {
+		fsys := NewMemFS()
+		bc, _ := Open(testBitcaskPath, RWConfig.WithFS(fsys))
+		defer bc.Close()
+		_, err := repair(fsys, testBitcaskPath)
+
+		assertErrorMsg(t, err, ErrBitCaskIsLocked)
+	})
+
+	t.Run("corrupted file is quarantined", func(t *testing.T) {
+		bc := fillBitcask(t)
+		corruptValue(bc, "key42")
+		corruptedFile := fileOf(bc, "key42")
+
+		fsys := bc.fs
+		report, err := repair(fsys, testBitcaskPath)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(report.Quarantined, []string{corruptedFile}) {
+			t.Errorf("got quarantined files %v, want %v", report.Quarantined, []string{corruptedFile})
+		}
+		if !reflect.DeepEqual(report.LostKeys, [][]byte{[]byte("key42")}) {
+			t.Errorf("got lost keys %q, want key42", report.LostKeys)
+		}
+		if _, err := fsys.Stat(path.Join(testBitcaskPath, quarantineDirName, path.Base(corruptedFile))); err != nil {
+			t.Errorf("expected corrupted file in quarantine: %v", err)
+		}
+
+		if checkReport, _ := check(fsys, testBitcaskPath); !checkReport.OK() {
+			t.Errorf("expected repaired bitcask to be healthy, got %+v", checkReport)
+		}
+
+		bc, _ = Open(testBitcaskPath, DefaultConfig.WithFS(fsys))
+		defer bc.Close()
+		for i := 0; i < 100; i++ {
+			key := "key" + fmt.Sprintf("%d", i)
+			got, err := bc.Get([]byte(key))
+			if key == "key42" {
+				assertErrorMsg(t, err, BitCaskError("\"key42\": key doesn't exist"))
+				continue
+			}
+			assertEqualStrings(t, string(got), "value"+fmt.Sprintf("%d", i))
+		}
+	})
+
+	t.Run("lost keys without a keydir file come from the hint files", func(t *testing.T) {
+		bc := fillBitcask(t)
+		fsys := bc.fs
+		bc, _ = Open(testBitcaskPath, RWConfig.WithFS(fsys))
+		bc.Merge()
+		bc.Close()
+		corruptValue(bc, "key42")
+		fsys.Remove(path.Join(testBitcaskPath, keydirFileName))
+
+		report, err := repair(fsys, testBitcaskPath)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(report.LostKeys, [][]byte{[]byte("key42")}) {
+			t.Errorf("got lost keys %q, want key42", report.LostKeys)
+		}
+	})
+
+	// fillFaultFS writes the keys to a bitcask in a faultFS and corrupts key42.
+	fillFaultFS := func(t *testing.T) (*faultFS, string) {
+		fsys := newFaultFS(1)
+		bc, err := Open(testBitcaskPath, RWsyncConfig.WithFS(fsys))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			bc.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte("value"+fmt.Sprintf("%d", i)))
+		}
+		bc.Close()
+		corruptValue(bc, "key42")
+		return fsys, fileOf(bc, "key42")
+	}
+
+	t.Run("failed writes leave the corrupted file in place", func(t *testing.T) {
+		fsys, corruptedFile := fillFaultFS(t)
+		fsys.failWritesAfter(0, syscall.ENOSPC)
+
+		if _, err := repair(fsys, testBitcaskPath); !errors.Is(err, syscall.ENOSPC) {
+			t.Fatalf("got %v, want ENOSPC", err)
+		}
+		if _, err := fsys.Stat(corruptedFile); err != nil {
+			t.Errorf("expected %q to stay in place: %v", corruptedFile, err)
+		}
+	})
+
+	t.Run("repaired items survive a crash", func(t *testing.T) {
+		fsys, _ := fillFaultFS(t)
+		if _, err := repair(fsys, testBitcaskPath); err != nil {
+			t.Fatal(err)
+		}
+		fsys.crash()
+
+		bc, err := Open(testBitcaskPath, DefaultConfig.WithFS(fsys))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bc.Close()
+		for i := 0; i < 100; i++ {
+			if i == 42 {
+				continue
+			}
+			got, _ := bc.Get([]byte("key" + fmt.Sprintf("%d", i)))
+			assertEqualStrings(t, string(got), "value"+fmt.Sprintf("%d", i))
+		}
+	})
+}
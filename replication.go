@@ -0,0 +1,442 @@
+package bitcask
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ReplicationPosition is a position in the log of a leader, that's the
+// items appended to its active files by Put, Delete and Sync.
+// The zero position is the beginning of the log.
+type ReplicationPosition struct {
+	// File is the name of a data file of the leader.
+	File string
+	// Offset is the number of bytes of File applied by the follower.
+	Offset int64
+}
+
+// logSection is a range of a log file of the leader to send to a follower.
+type logSection struct {
+	file       File
+	start, end int64
+}
+
+// AsFollower makes the bitcask a follower that applies the writes of a
+// leader, see Replicate. A follower is opened as a writer of its own
+// directory, but Put, Delete and the other writes return
+// ErrFollowerIsReadOnly. It may still be merged.
+func (c Config) AsFollower() Config {
+	c.writePermission = true
+	c.follower = true
+	return c
+}
+
+// ServeReplica ships the log of the bitcask to a follower over rw. It
+// reads the position the follower starts from, sends the items after it
+// and then every item appended later, in order. It returns nil once the
+// bitcask is closed, or the error of reading or writing rw.
+// Merge drops the log files it merges, so a follower can only start from
+// a position after the newest merged log file, or at its end, and a new
+// follower can only start from the beginning of the log if the leader
+// never merged.
+// Otherwise the follower is seeded from a backup of the leader, which
+// holds the position to start from, see Backup.
+// returns err == ErrHasNoWritePerms if the calling process has no write permissions
+// err == ErrReplicationPositionLost if the leader merged the items after the position.
+func (bc *BitCask) ServeReplica(rw io.ReadWriter) error {
+	if !bc.config.writePermission {
+		return ErrHasNoWritePerms
+	}
+
+	pos, err := readReplicationPosition(rw)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(rw)
+
+	for {
+		sections, appended, err := bc.openLog(pos)
+		if err != nil {
+			return err
+		}
+
+		shipped := false
+		for _, section := range sections {
+			if err == nil {
+				var n int
+				n, err = shipSection(w, section, &pos)
+				shipped = shipped || n > 0
+			}
+			section.file.Close()
+		}
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			return err
+		}
+
+		if shipped {
+			continue
+		}
+		select {
+		case <-appended:
+		case <-bc.closed:
+			return nil
+		}
+	}
+}
+
+// Replicate applies the log of a leader served by ServeReplica over rw
+// to the follower. It sends the position of the last applied item to
+// the leader, so it can be called again with a new connection to resume
+// after a disconnect. The position is saved when Replicate returns and
+// when the follower is closed, a follower that crashes before that
+// applies some items again, which leaves it in the same state.
+// It returns nil when the leader closes the stream.
+// returns err == ErrNotFollower if the bitcask isn't a follower
+// err == ErrBitCaskClosed if the follower is closed while replicating
+// err wrapping ErrInvalidReplicationStream if the leader sends invalid data.
+func (bc *BitCask) Replicate(rw io.ReadWriter) error {
+	if !bc.config.follower {
+		return ErrNotFollower
+	}
+
+	bc.mu.RLock()
+	pos := bc.replicationPos
+	bc.mu.RUnlock()
+
+	defer func() {
+		bc.mu.Lock()
+		bc.saveReplicationPosition()
+		bc.unlock()
+	}()
+
+	if err := writeReplicationPosition(rw, pos); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(rw)
+	for {
+		framePos, err := readReplicationPosition(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidReplicationStream, err)
+		}
+		item, err := readItem(r)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidReplicationStream, err)
+		}
+
+		if err := bc.applyReplicated(framePos, item); err != nil {
+			return err
+		}
+	}
+}
+
+// ReplicationPosition returns the position in the log of the leader
+// of the last item applied by the follower.
+func (bc *BitCask) ReplicationPosition() ReplicationPosition {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+
+	return bc.replicationPos
+}
+
+// openLog opens the sections of the log after pos, along with a channel
+// that is closed once an item is appended after them. Holding the merge
+// lock makes sure no merge output is mistaken for a log file, and the
+// opened files stay readable if a merge deletes them later.
+func (bc *BitCask) openLog(pos ReplicationPosition) ([]logSection, chan void, error) {
+	bc.mergeMu.Lock()
+	defer bc.mergeMu.Unlock()
+
+	bc.mu.Lock()
+	activeFile, cursor, appended := bc.activeFile.Name(), bc.cursor, bc.appended
+	files := dataFiles(bc.fs, bc.dirName)
+	bc.unlock()
+
+	// merge outputs are marked, the log files appended by Put, Delete
+	// and Sync aren't.
+	var logFiles []string
+	for _, fileId := range files {
+		if !isMerged(bc.fs, fileId) {
+			logFiles = append(logFiles, fileId)
+		}
+	}
+
+	start, offset := -1, pos.Offset
+	truncated := logFileId(bc.logTruncatedAt.File)
+	switch {
+	case pos.File == "":
+		if truncated == 0 && len(logFiles) == len(files) {
+			start = 0
+		}
+	case pos == bc.logTruncatedAt:
+		// the follower applied every item of the newest merged log
+		// file, it goes on with the log file after it.
+		for i, fileId := range logFiles {
+			if logFileId(path.Base(fileId)) > truncated {
+				start, offset = i, 0
+				break
+			}
+		}
+	case logFileId(pos.File) > truncated:
+		for i, fileId := range logFiles {
+			if path.Base(fileId) == pos.File {
+				start = i
+			}
+		}
+	}
+	if start == -1 {
+		return nil, nil, ErrReplicationPositionLost
+	}
+
+	var sections []logSection
+	for i, fileId := range logFiles[start:] {
+		section := logSection{}
+		if i == 0 {
+			section.start = offset
+		}
+		if fileId == activeFile {
+			section.end = cursor
+		} else if info, err := bc.fs.Stat(fileId); err == nil {
+			section.end = info.Size()
+		}
+		if section.start >= section.end && fileId != logFiles[len(logFiles)-1] {
+			continue
+		}
+
+		file, err := openFile(bc.fs, fileId)
+		if err != nil {
+			for _, section := range sections {
+				section.file.Close()
+			}
+			return nil, nil, err
+		}
+		section.file = file
+		sections = append(sections, section)
+	}
+
+	return sections, appended, nil
+}
+
+// shipSection writes the items of section to w, every item preceded by
+// its position, and moves pos past them. It returns the number of items written.
+func shipSection(w io.Writer, section logSection, pos *ReplicationPosition) (int, error) {
+	name := path.Base(section.file.Name())
+	if name != pos.File {
+		*pos = ReplicationPosition{File: name}
+	}
+	if section.start >= section.end {
+		return 0, nil
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(section.file, section.start, section.end-section.start))
+	n := 0
+	for {
+		item, err := readItem(r)
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+
+		if err := writeReplicationPosition(w, *pos); err != nil {
+			return n, err
+		}
+		if _, err := w.Write(item.raw); err != nil {
+			return n, err
+		}
+		pos.Offset += int64(len(item.raw))
+		n++
+	}
+}
+
+// applyReplicated applies an item of the leader found at pos to the
+// follower. Items older than the current value of their key were
+// already applied and are skipped.
+func (bc *BitCask) applyReplicated(pos ReplicationPosition, item fileItem) error {
+	bc.mu.Lock()
+	defer bc.unlock()
+
+	select {
+	case <-bc.closed:
+		return ErrBitCaskClosed
+	default:
+	}
+
+	expected := bc.replicationPos
+	if (pos.File == expected.File && pos.Offset != expected.Offset) || (pos.File != expected.File && pos.Offset != 0) {
+		return fmt.Errorf("%w: got item at %s:%d after %s:%d", ErrInvalidReplicationStream,
+			pos.File, pos.Offset, expected.File, expected.Offset)
+	}
+	next := ReplicationPosition{File: pos.File, Offset: pos.Offset + int64(len(item.raw))}
+	if err := bc.cipher.openItem(&item); err != nil {
+		return err
+	}
+
+	if record, ok := bc.keydir.get(string(item.key)); ok && record.timeStamp >= item.timeStamp.UnixMicro() {
+		bc.replicationPos = next
+		return nil
+	}
+	if item.timeStamp.After(bc.lastTimeStamp) {
+		bc.lastTimeStamp = item.timeStamp
+	}
+
+	var err error
+	if item.isTombstone() {
+		// the keys of a dropped bucket are forgotten along with it.
+		dropped := defaultBucket
+		bucket, name := splitNamespaceKey(string(item.key))
+		if bucket == catalogBucket {
+			dropped, _ = bc.bucketId(name)
+		}
+		err = bc.writeTombstoneAt(item.key, item.timeStamp)
+		if err == nil && dropped != defaultBucket {
+			bc.forgetBucket(name, dropped)
+		}
+	} else {
+		// the value is written with the compression setting of the follower.
+		var value []byte
+		if value, err = item.decodedValue(); err == nil {
+			err = bc.writeItem(item.key, value, item.timeStamp)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	bc.replicationPos = next
+
+	return nil
+}
+
+// writeReplicationPosition writes pos to w as the size of the file name,
+// the offset and the file name.
+func writeReplicationPosition(w io.Writer, pos ReplicationPosition) error {
+	data := make([]byte, replicationHeaderSize, replicationHeaderSize+len(pos.File))
+	binary.BigEndian.PutUint16(data[0:], uint16(len(pos.File)))
+	binary.BigEndian.PutUint64(data[2:], uint64(pos.Offset))
+	data = append(data, pos.File...)
+
+	_, err := w.Write(data)
+	return err
+}
+
+// readReplicationPosition reads a position written by writeReplicationPosition.
+// returns err == io.EOF if r has no more data.
+func readReplicationPosition(r io.Reader) (ReplicationPosition, error) {
+	header := make([]byte, replicationHeaderSize)
+	if n, err := io.ReadFull(r, header); err != nil {
+		if n == 0 && err == io.EOF {
+			return ReplicationPosition{}, io.EOF
+		}
+		return ReplicationPosition{}, io.ErrUnexpectedEOF
+	}
+
+	name := make([]byte, binary.BigEndian.Uint16(header))
+	if _, err := io.ReadFull(r, name); err != nil {
+		return ReplicationPosition{}, io.ErrUnexpectedEOF
+	}
+
+	return ReplicationPosition{
+		File:   string(name),
+		Offset: int64(binary.BigEndian.Uint64(header[2:])),
+	}, nil
+}
+
+// saveReplicationPosition writes the position of the follower to the
+// replication position file.
+func (bc *BitCask) saveReplicationPosition() {
+	// the items before the position must not be lost in a crash
+	if err := bc.syncActiveFile(); err != nil {
+		return
+	}
+	replaceFile(bc.fs, path.Join(bc.dirName, replicationPosFileName), positionFileData(bc.replicationPos))
+}
+
+// truncateLog records that the log files among the merged files are
+// dropped, so that followers don't resume from positions before them.
+// The end of the newest merged log file is recorded along with it, so
+// that followers that applied all of it resume from the next log file.
+func (bc *BitCask) truncateLog(mergedFiles []string) {
+	truncatedAt := bc.logTruncatedAt
+	for _, fileId := range mergedFiles {
+		if isMerged(bc.fs, fileId) {
+			continue
+		}
+		if logFileId(path.Base(fileId)) > logFileId(truncatedAt.File) {
+			truncatedAt = ReplicationPosition{File: path.Base(fileId), Offset: -1}
+			if info, err := bc.fs.Stat(fileId); err == nil {
+				truncatedAt.Offset = info.Size()
+			}
+		}
+	}
+
+	if truncatedAt != bc.logTruncatedAt {
+		bc.logTruncatedAt = truncatedAt
+		replaceFile(bc.fs, path.Join(bc.dirName, logTruncatedFileName), positionFileData(truncatedAt))
+	}
+}
+
+// loadLogTruncation returns the end of the newest log file merged at
+// directoryPath, the position is zero if there is none.
+func loadLogTruncation(fsys FS, directoryPath string) ReplicationPosition {
+	return loadPositionFile(fsys, path.Join(directoryPath, logTruncatedFileName))
+}
+
+// logFileId returns the id of the data file name, zero if it has none.
+func logFileId(name string) int64 {
+	id, _ := strconv.ParseInt(strings.TrimSuffix(name, BitCaskFileExtension), 10, 64)
+	return id
+}
+
+// replaceFile writes data to a new file and renames it to filePath,
+// so that filePath holds either the old or the new data after a crash.
+func replaceFile(fsys FS, filePath string, data []byte) error {
+	tmp := filePath + ".tmp"
+	if err := writeFile(fsys, tmp, data, UserReadWrite); err != nil {
+		return err
+	}
+
+	return fsys.Rename(tmp, filePath)
+}
+
+// positionFileData returns the content of the replication position file holding pos.
+func positionFileData(pos ReplicationPosition) []byte {
+	return []byte(pos.File + " " + strconv.FormatInt(pos.Offset, 10) + "\n")
+}
+
+// loadReplicationPosition reads the replication position file at
+// directoryPath, the position is zero if there is none.
+func loadReplicationPosition(fsys FS, directoryPath string) ReplicationPosition {
+	return loadPositionFile(fsys, path.Join(directoryPath, replicationPosFileName))
+}
+
+// loadPositionFile reads a position written by positionFileData to
+// filePath, the position is zero if there is none.
+func loadPositionFile(fsys FS, filePath string) ReplicationPosition {
+	data, err := readFile(fsys, filePath)
+	if err != nil {
+		return ReplicationPosition{}
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return ReplicationPosition{}
+	}
+	offset, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return ReplicationPosition{}
+	}
+
+	return ReplicationPosition{File: fields[0], Offset: offset}
+}
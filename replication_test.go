@@ -0,0 +1,224 @@
+package bitcask
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// replicate connects follower to leader over a pipe and returns a
+// function that disconnects them and returns the error of Replicate.
+func replicate(leader, follower *BitCask) func() error {
+	leaderConn, followerConn := net.Pipe()
+	go leader.ServeReplica(leaderConn)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- follower.Replicate(followerConn)
+	}()
+
+	return func() error {
+		leaderConn.Close()
+		followerConn.Close()
+		return <-done
+	}
+}
+
+// waitForValue waits until key has value in bc.
+func waitForValue(t testing.TB, bc *BitCask, key, value string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got, _ := bc.Get([]byte(key))
+		if string(got) == value {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %q for %q, want %q", got, key, value)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	t.Run("follower applies the writes of its leader", func(t *testing.T) {
+		fsys := NewMemFS()
+		leader, _ := Open(testBitcaskPath, RWsyncConfig.WithFS(fsys))
+		defer leader.Close()
+		follower, _ := Open(testBitcaskFollowerPath, RWConfig.WithFS(fsys).AsFollower())
+		defer follower.Close()
+		for i := 0; i < 50; i++ {
+			leader.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte("value"+fmt.Sprintf("%d", i)))
+		}
+
+		disconnect := replicate(leader, follower)
+		for i := 0; i < 50; i++ {
+			leader.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte("new"+fmt.Sprintf("%d", i)))
+		}
+		leader.Delete([]byte("key0"))
+		leader.Put([]byte("last"), []byte("value"))
+		waitForValue(t, follower, "last", "value")
+
+		for i := 1; i < 50; i++ {
+			got, _ := follower.Get([]byte("key" + fmt.Sprintf("%d", i)))
+			assertEqualStrings(t, string(got), "new"+fmt.Sprintf("%d", i))
+		}
+		_, err := follower.Get([]byte("key0"))
+		assertErrorMsg(t, err, BitCaskError("\"key0\": key doesn't exist"))
+		_, want, _ := leader.GetWithTimeStamp([]byte("key7"))
+		_, got, _ := follower.GetWithTimeStamp([]byte("key7"))
+		if !got.Equal(want) {
+			t.Errorf("got timestamp %v, want %v", got, want)
+		}
+
+		assertErrorMsg(t, follower.Put([]byte("key"), []byte("value")), ErrFollowerIsReadOnly)
+		disconnect()
+	})
+
+	t.Run("follower resumes after disconnects and restarts", func(t *testing.T) {
+		fsys := NewMemFS()
+		leader, _ := Open(testBitcaskPath, RWsyncConfig.WithFS(fsys))
+		defer leader.Close()
+		follower, _ := Open(testBitcaskFollowerPath, RWConfig.WithFS(fsys).AsFollower())
+
+		disconnect := replicate(leader, follower)
+		leader.Put([]byte("key"), []byte("value1"))
+		waitForValue(t, follower, "key", "value1")
+		disconnect()
+
+		leader.Put([]byte("key"), []byte("value2"))
+		disconnect = replicate(leader, follower)
+		waitForValue(t, follower, "key", "value2")
+		disconnect()
+		pos := follower.ReplicationPosition()
+		follower.Close()
+
+		for i := 0; i < 50; i++ {
+			leader.Put([]byte("key"), []byte("value"+fmt.Sprintf("%d", i)))
+		}
+		follower, _ = Open(testBitcaskFollowerPath, RWConfig.WithFS(fsys).AsFollower())
+		defer follower.Close()
+		if got := follower.ReplicationPosition(); got != pos {
+			t.Errorf("got position %v, want %v", got, pos)
+		}
+		disconnect = replicate(leader, follower)
+		waitForValue(t, follower, "key", "value49")
+		disconnect()
+	})
+
+	t.Run("follower seeded from a backup of a merged leader", func(t *testing.T) {
+		fsys := NewMemFS()
+		leader, _ := Open(testBitcaskPath, RWsyncConfig.WithFS(fsys))
+		defer leader.Close()
+		for i := 0; i < 100; i++ {
+			leader.Put([]byte("key"), []byte("value"+fmt.Sprintf("%d", i)))
+		}
+		leader.Merge()
+
+		var backup bytes.Buffer
+		leader.Backup(&backup)
+		restore(fsys, &backup, testBitcaskFollowerPath)
+		leader.Put([]byte("key"), []byte("after backup"))
+
+		follower, _ := Open(testBitcaskFollowerPath, RWConfig.WithFS(fsys).AsFollower())
+		defer follower.Close()
+		disconnect := replicate(leader, follower)
+		waitForValue(t, follower, "key", "after backup")
+		disconnect()
+	})
+
+	t.Run("repaired and restored leaders keep their log", func(t *testing.T) {
+		fsys := NewMemFS()
+		leader, err := Open(testBitcaskPath, RWsyncConfig.WithFS(fsys))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 50; i++ {
+			leader.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte("value"+fmt.Sprintf("%d", i)))
+		}
+		leader.Close()
+		if _, err := repair(fsys, testBitcaskPath); err != nil {
+			t.Fatal(err)
+		}
+
+		leader, _ = Open(testBitcaskPath, RWsyncConfig.WithFS(fsys))
+		defer leader.Close()
+		if err := leader.BackupTo(testBitcaskBackupPath); err != nil {
+			t.Fatal(err)
+		}
+		restored, _ := Open(testBitcaskBackupPath, RWsyncConfig.WithFS(fsys))
+		defer restored.Close()
+
+		for _, bc := range []*BitCask{leader, restored} {
+			follower, _ := Open(testBitcaskFollowerPath, RWConfig.WithFS(NewMemFS()).AsFollower())
+			disconnect := replicate(bc, follower)
+			waitForValue(t, follower, "key49", "value49")
+			disconnect()
+			follower.Close()
+		}
+	})
+
+	t.Run("caught up follower resumes after its leader merges", func(t *testing.T) {
+		fsys := NewMemFS()
+		leader, _ := Open(testBitcaskPath, RWsyncConfig.WithFS(fsys))
+		defer leader.Close()
+		follower, _ := Open(testBitcaskFollowerPath, RWConfig.WithFS(fsys).AsFollower())
+		defer follower.Close()
+		// every value fills most of a data file, so every put rotates it.
+		value := strings.Repeat("v", int(MaxFileSize)/2)
+		leader.Put([]byte("a"), []byte(value))
+		leader.Put([]byte("b"), []byte(value))
+
+		disconnect := replicate(leader, follower)
+		waitForValue(t, follower, "b", value)
+		disconnect()
+		pos := follower.ReplicationPosition()
+		leader.Put([]byte("c"), []byte(value))
+		leader.Merge()
+		if _, err := fsys.Stat(path.Join(testBitcaskPath, pos.File)); !os.IsNotExist(err) {
+			t.Fatalf("expected %q to be merged", pos.File)
+		}
+
+		disconnect = replicate(leader, follower)
+		waitForValue(t, follower, "c", value)
+		if err := disconnect(); err != nil {
+			t.Errorf("unexpected replication error: %v", err)
+		}
+	})
+
+	t.Run("leader refuses positions it merged away", func(t *testing.T) {
+		fsys := NewMemFS()
+		leader, _ := Open(testBitcaskPath, RWsyncConfig.WithFS(fsys))
+		defer leader.Close()
+		oldFile := leader.activeFile.Name()
+		for i := 0; i < 100; i++ {
+			leader.Put([]byte("key"+fmt.Sprintf("%d", i%10)), []byte("value"+fmt.Sprintf("%d", i)))
+		}
+		leader.Merge()
+		if _, err := fsys.Stat(oldFile); !os.IsNotExist(err) {
+			t.Fatalf("expected %q to be merged", oldFile)
+		}
+
+		leaderConn, followerConn := net.Pipe()
+		done := make(chan error)
+		go func() {
+			done <- leader.ServeReplica(leaderConn)
+		}()
+		writeReplicationPosition(followerConn, ReplicationPosition{})
+		assertErrorMsg(t, <-done, ErrReplicationPositionLost)
+
+		go func() {
+			done <- leader.ServeReplica(leaderConn)
+		}()
+		writeReplicationPosition(followerConn, ReplicationPosition{File: path.Base(oldFile)})
+		assertErrorMsg(t, <-done, ErrReplicationPositionLost)
+
+		leaderConn.Close()
+		followerConn.Close()
+	})
+}
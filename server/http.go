@@ -0,0 +1,300 @@
+package server
+
+import (
+	"bitcask"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// httpHandler exposes a bitcask datastore over http.
+type httpHandler struct {
+	bc *bitcask.BitCask
+	// maxValueSize bounds the body of PUT requests.
+	maxValueSize int64
+}
+
+var errInvalidIfMatch = errors.New("invalid If-Match header")
+
+// NewHTTPHandler returns an http.Handler that exposes bc:
+//
+//	GET    /keys/{key}     the value of key, binary safe
+//	PUT    /keys/{key}     store the request body at key
+//	DELETE /keys/{key}     delete key
+//	GET    /keys?prefix=p  json list of the keys starting with p
+//	POST   /merge          merge the data files
+//	POST   /sync           sync pending writes to disk
+//	GET    /stats          json datastore statistics
+//
+// Values carry an ETag made from the timestamp of their write. PUT and
+// DELETE with If-Match, and PUT with If-None-Match: *, are done as
+// compare and swap operations and fail with 412 if the key was changed.
+// If-Match: * only needs the key to exist. PUT bodies larger than redis
+// bulk strings fail with 413.
+func NewHTTPHandler(bc *bitcask.BitCask) http.Handler {
+	return &httpHandler{bc: bc, maxValueSize: maxBulkLength}
+}
+
+func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/keys":
+		h.route(w, r, map[string]http.HandlerFunc{http.MethodGet: h.listKeys})
+	case strings.HasPrefix(r.URL.Path, "/keys/"):
+		h.route(w, r, map[string]http.HandlerFunc{
+			http.MethodGet:    h.getKey,
+			http.MethodHead:   h.getKey,
+			http.MethodPut:    h.putKey,
+			http.MethodDelete: h.deleteKey,
+		})
+	case r.URL.Path == "/merge":
+		h.route(w, r, map[string]http.HandlerFunc{http.MethodPost: h.merge})
+	case r.URL.Path == "/sync":
+		h.route(w, r, map[string]http.HandlerFunc{http.MethodPost: h.sync})
+	case r.URL.Path == "/stats":
+		h.route(w, r, map[string]http.HandlerFunc{http.MethodGet: h.stats})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// route calls the handler of the request method.
+func (h *httpHandler) route(w http.ResponseWriter, r *http.Request, handlers map[string]http.HandlerFunc) {
+	handler, ok := handlers[r.Method]
+	if !ok {
+		var allowed []string
+		for method := range handlers {
+			allowed = append(allowed, method)
+		}
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	handler(w, r)
+}
+
+func (h *httpHandler) getKey(w http.ResponseWriter, r *http.Request) {
+	key, ok := keyOf(w, r)
+	if !ok {
+		return
+	}
+
+	value, tStamp, err := h.bc.GetWithTimeStamp(key)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+
+	etag := makeETag(tStamp)
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(value)
+}
+
+func (h *httpHandler) putKey(w http.ResponseWriter, r *http.Request) {
+	key, ok := keyOf(w, r)
+	if !ok {
+		return
+	}
+
+	value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, h.maxValueSize))
+	if err != nil {
+		// the reader stops with an error once it read maxValueSize bytes
+		status := http.StatusBadRequest
+		if int64(len(value)) == h.maxValueSize {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+	switch {
+	case ifMatch != "":
+		var newTStamp time.Time
+		err := h.ifMatch(key, ifMatch, func(tStamp time.Time) (err error) {
+			newTStamp, err = h.bc.CompareAndSwap(key, value, tStamp)
+			return err
+		})
+		writeSwapped(w, newTStamp, err)
+	case ifNoneMatch == "*":
+		newTStamp, err := h.bc.CompareAndSwap(key, value, time.Time{})
+		writeSwapped(w, newTStamp, err)
+	case ifNoneMatch != "":
+		http.Error(w, "If-None-Match only supports *", http.StatusBadRequest)
+	default:
+		if err := h.bc.Put(key, value); err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// writeSwapped writes the response of a compare and swap that wrote
+// a value at tStamp, or failed with err.
+func writeSwapped(w http.ResponseWriter, tStamp time.Time, err error) {
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", makeETag(tStamp))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ifMatch calls fn with the timestamp matched by the If-Match header
+// ifMatch. For * that's the timestamp of the current value of key, fn
+// is called again if the key was changed meanwhile.
+// returns err == ErrTimeStampMismatch if key doesn't exist for *
+// err == errInvalidIfMatch if the header is no ETag.
+func (h *httpHandler) ifMatch(key []byte, ifMatch string, fn func(tStamp time.Time) error) error {
+	if ifMatch != "*" {
+		tStamp, ok := parseETag(ifMatch)
+		if !ok {
+			return errInvalidIfMatch
+		}
+		return fn(tStamp)
+	}
+
+	for {
+		_, tStamp, err := h.bc.GetWithTimeStamp(key)
+		if errors.Is(err, bitcask.ErrKeyNotExist) {
+			return bitcask.ErrTimeStampMismatch
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(tStamp); !errors.Is(err, bitcask.ErrTimeStampMismatch) {
+			return err
+		}
+	}
+}
+
+func (h *httpHandler) deleteKey(w http.ResponseWriter, r *http.Request) {
+	key, ok := keyOf(w, r)
+	if !ok {
+		return
+	}
+
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		err := h.ifMatch(key, ifMatch, func(tStamp time.Time) error {
+			return h.bc.CompareAndDelete(key, tStamp)
+		})
+		if err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if !h.bc.Has(key) {
+		writeHTTPError(w, fmt.Errorf("%q: %w", key, bitcask.ErrKeyNotExist))
+		return
+	}
+	if err := h.bc.Delete(key); err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *httpHandler) listKeys(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+
+	keys := []string{}
+	for _, key := range h.bc.ListKeys() {
+		if strings.HasPrefix(string(key), prefix) {
+			keys = append(keys, string(key))
+		}
+	}
+	sort.Strings(keys)
+
+	writeJSON(w, keys)
+}
+
+func (h *httpHandler) merge(w http.ResponseWriter, r *http.Request) {
+	if err := h.bc.Merge(); err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *httpHandler) sync(w http.ResponseWriter, r *http.Request) {
+	if err := h.bc.Sync(); err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *httpHandler) stats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.bc.Stats())
+}
+
+// keyOf returns the key of a /keys/{key} request, it writes a
+// bad request response if the key is empty.
+func keyOf(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	key := strings.TrimPrefix(r.URL.Path, "/keys/")
+	if key == "" {
+		http.Error(w, "empty key", http.StatusBadRequest)
+		return nil, false
+	}
+
+	return []byte(key), true
+}
+
+// makeETag makes a strong ETag out of the timestamp of a write.
+func makeETag(tStamp time.Time) string {
+	return `"` + strconv.FormatInt(tStamp.UnixMicro(), 10) + `"`
+}
+
+// parseETag returns the timestamp an ETag was made from.
+func parseETag(etag string) (time.Time, bool) {
+	micro, err := strconv.ParseInt(strings.Trim(etag, `"`), 10, 64)
+	if err != nil || micro <= 0 {
+		return time.Time{}, false
+	}
+
+	return time.UnixMicro(micro), true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeHTTPError maps bitcask errors to http status codes.
+func writeHTTPError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, bitcask.ErrKeyNotExist):
+		status = http.StatusNotFound
+	case errors.Is(err, bitcask.ErrTimeStampMismatch), errors.Is(err, errInvalidIfMatch):
+		status = http.StatusPreconditionFailed
+	case errors.Is(err, bitcask.ErrHasNoWritePerms), errors.Is(err, bitcask.ErrFollowerIsReadOnly):
+		status = http.StatusForbidden
+	case errors.Is(err, bitcask.ErrNullKeyOrValue):
+		status = http.StatusBadRequest
+	}
+
+	http.Error(w, err.Error(), status)
+}
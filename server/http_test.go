@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bitcask"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testHTTPBitcaskPath = path.Join("bitcask_http")
+
+func startHTTPServer(t testing.TB) (*httptest.Server, func()) {
+	t.Helper()
+	os.RemoveAll(testHTTPBitcaskPath)
+	bc, err := bitcask.Open(testHTTPBitcaskPath, bitcask.RWConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(NewHTTPHandler(bc))
+	return srv, func() {
+		srv.Close()
+		bc.Close()
+		os.RemoveAll(testHTTPBitcaskPath)
+	}
+}
+
+// request sends an http request and returns the response and its body.
+func request(t testing.TB, method, url, body string, headers ...string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp, string(data)
+}
+
+func assertStatus(t testing.TB, resp *http.Response, want int) {
+	t.Helper()
+	if resp.StatusCode != want {
+		t.Errorf("got status %d, want %d", resp.StatusCode, want)
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+	t.Run("put, get and delete a key", func(t *testing.T) {
+		srv, stop := startHTTPServer(t)
+		defer stop()
+
+		resp, _ := request(t, http.MethodPut, srv.URL+"/keys/name", "bitcask\x00\xff")
+		assertStatus(t, resp, http.StatusNoContent)
+
+		resp, body := request(t, http.MethodGet, srv.URL+"/keys/name", "")
+		assertStatus(t, resp, http.StatusOK)
+		assertEqual(t, body, "bitcask\x00\xff")
+		assertEqual(t, resp.Header.Get("Content-Type"), "application/octet-stream")
+
+		resp, _ = request(t, http.MethodDelete, srv.URL+"/keys/name", "")
+		assertStatus(t, resp, http.StatusNoContent)
+
+		resp, _ = request(t, http.MethodGet, srv.URL+"/keys/name", "")
+		assertStatus(t, resp, http.StatusNotFound)
+		resp, _ = request(t, http.MethodDelete, srv.URL+"/keys/name", "")
+		assertStatus(t, resp, http.StatusNotFound)
+	})
+
+	t.Run("etags and conditional requests", func(t *testing.T) {
+		srv, stop := startHTTPServer(t)
+		defer stop()
+
+		resp, _ := request(t, http.MethodPut, srv.URL+"/keys/name", "v1", "If-None-Match", "*")
+		assertStatus(t, resp, http.StatusNoContent)
+		etag := resp.Header.Get("ETag")
+
+		resp, _ = request(t, http.MethodPut, srv.URL+"/keys/name", "v1", "If-None-Match", "*")
+		assertStatus(t, resp, http.StatusPreconditionFailed)
+
+		resp, _ = request(t, http.MethodGet, srv.URL+"/keys/name", "")
+		assertEqual(t, resp.Header.Get("ETag"), etag)
+		resp, _ = request(t, http.MethodGet, srv.URL+"/keys/name", "", "If-None-Match", etag)
+		assertStatus(t, resp, http.StatusNotModified)
+
+		resp, _ = request(t, http.MethodPut, srv.URL+"/keys/name", "v2", "If-Match", etag)
+		assertStatus(t, resp, http.StatusNoContent)
+		newETag := resp.Header.Get("ETag")
+		if newETag == etag {
+			t.Errorf("expected etag to change after a write")
+		}
+
+		resp, _ = request(t, http.MethodPut, srv.URL+"/keys/name", "v3", "If-Match", etag)
+		assertStatus(t, resp, http.StatusPreconditionFailed)
+		resp, _ = request(t, http.MethodDelete, srv.URL+"/keys/name", "", "If-Match", etag)
+		assertStatus(t, resp, http.StatusPreconditionFailed)
+
+		_, body := request(t, http.MethodGet, srv.URL+"/keys/name", "")
+		assertEqual(t, body, "v2")
+
+		resp, _ = request(t, http.MethodPut, srv.URL+"/keys/name", "v3", "If-Match", "*")
+		assertStatus(t, resp, http.StatusNoContent)
+		resp, _ = request(t, http.MethodDelete, srv.URL+"/keys/name", "", "If-Match", "*")
+		assertStatus(t, resp, http.StatusNoContent)
+		resp, _ = request(t, http.MethodPut, srv.URL+"/keys/name", "v4", "If-Match", "*")
+		assertStatus(t, resp, http.StatusPreconditionFailed)
+	})
+
+	t.Run("large values are rejected", func(t *testing.T) {
+		bc, err := bitcask.Open(testHTTPBitcaskPath, bitcask.RWConfig.WithFS(bitcask.NewMemFS()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bc.Close()
+		h := &httpHandler{bc: bc, maxValueSize: 8}
+
+		for _, tt := range []struct {
+			value string
+			want  int
+		}{{"small", http.StatusNoContent}, {"too-large-value", http.StatusRequestEntityTooLarge}} {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/keys/"+tt.value, strings.NewReader(tt.value)))
+			if w.Code != tt.want {
+				t.Errorf("%q: got status %d, want %d", tt.value, w.Code, tt.want)
+			}
+		}
+	})
+
+	t.Run("list keys by prefix", func(t *testing.T) {
+		srv, stop := startHTTPServer(t)
+		defer stop()
+
+		for _, key := range []string{"user:2", "user:1", "order:1"} {
+			request(t, http.MethodPut, srv.URL+"/keys/"+key, "value")
+		}
+
+		_, body := request(t, http.MethodGet, srv.URL+"/keys?prefix=user:", "")
+		var got []string
+		if err := json.Unmarshal([]byte(body), &got); err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"user:1", "user:2"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("merge, sync and stats", func(t *testing.T) {
+		srv, stop := startHTTPServer(t)
+		defer stop()
+
+		request(t, http.MethodPut, srv.URL+"/keys/name", "bitcask")
+		resp, _ := request(t, http.MethodPost, srv.URL+"/sync", "")
+		assertStatus(t, resp, http.StatusNoContent)
+		resp, _ = request(t, http.MethodPost, srv.URL+"/merge", "")
+		assertStatus(t, resp, http.StatusNoContent)
+
+		_, body := request(t, http.MethodGet, srv.URL+"/stats", "")
+		var stats bitcask.Stats
+		if err := json.Unmarshal([]byte(body), &stats); err != nil {
+			t.Fatal(err)
+		}
+		if stats.Keys != 1 {
+			t.Errorf("got %d keys, want 1", stats.Keys)
+		}
+	})
+
+	t.Run("writes to followers are forbidden", func(t *testing.T) {
+		bc, err := bitcask.Open(testHTTPBitcaskPath, bitcask.RWConfig.WithFS(bitcask.NewMemFS()).AsFollower())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bc.Close()
+		srv := httptest.NewServer(NewHTTPHandler(bc))
+		defer srv.Close()
+
+		resp, _ := request(t, http.MethodPut, srv.URL+"/keys/name", "value")
+		assertStatus(t, resp, http.StatusForbidden)
+	})
+
+	t.Run("unknown routes and methods", func(t *testing.T) {
+		srv, stop := startHTTPServer(t)
+		defer stop()
+
+		resp, _ := request(t, http.MethodGet, srv.URL+"/unknown", "")
+		assertStatus(t, resp, http.StatusNotFound)
+		resp, _ = request(t, http.MethodGet, srv.URL+"/merge", "")
+		assertStatus(t, resp, http.StatusMethodNotAllowed)
+		assertEqual(t, resp.Header.Get("Allow"), "POST")
+		resp, _ = request(t, http.MethodGet, srv.URL+"/keys/", "")
+		assertStatus(t, resp, http.StatusBadRequest)
+	})
+}
+
+func assertEqual(t testing.TB, got, want string) {
+	t.Helper()
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
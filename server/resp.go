@@ -0,0 +1,227 @@
+// package server serves a bitcask datastore to clients over the network.
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxMultibulkLength and maxBulkLength bound the number of arguments
+	// and the size of an argument of a command, like redis does.
+	maxMultibulkLength = 1024 * 1024
+	maxBulkLength      = 512 * 1024 * 1024
+	// bulkChunkSize is the largest bulk string allocated before its
+	// data arrives, larger ones grow as they are read.
+	bulkChunkSize = 64 * 1024
+	// maxLineLength bounds inline commands and the length lines of RESP
+	// arrays and bulk strings.
+	maxLineLength = 64 * 1024
+)
+
+var (
+	errProtocol        = errors.New("ERR protocol error")
+	errMultibulkLength = errors.New("ERR protocol error: invalid multibulk length")
+	errBulkLength      = errors.New("ERR protocol error: invalid bulk length")
+	errLineLength      = errors.New("ERR protocol error: too big inline request")
+)
+
+// readCommand reads a command sent by a client, either as a RESP array
+// of bulk strings or as an inline command separated by spaces.
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 || line[0] != '*' {
+		var args [][]byte
+		for _, field := range strings.Fields(string(line)) {
+			args = append(args, []byte(field))
+		}
+		return args, nil
+	}
+
+	count, err := strconv.Atoi(string(line[1:]))
+	if err != nil || count < 0 || count > maxMultibulkLength {
+		return nil, errMultibulkLength
+	}
+
+	var args [][]byte
+	for i := 0; i < count; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errProtocol
+		}
+
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > maxBulkLength {
+			return nil, errBulkLength
+		}
+
+		arg, err := readBulk(r, size)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+
+	return args, nil
+}
+
+// readBulk reads the size bytes of a bulk string followed by \r\n. A
+// large bulk string is grown as its data arrives, so that a client
+// can't make the server allocate more than it sends.
+func readBulk(r *bufio.Reader, size int) ([]byte, error) {
+	var buf bytes.Buffer
+	if size+2 <= bulkChunkSize {
+		buf.Grow(size + 2)
+	}
+	if _, err := io.CopyN(&buf, r, int64(size+2)); err != nil {
+		return nil, err
+	}
+
+	arg := buf.Bytes()
+	if string(arg[size:]) != "\r\n" {
+		return nil, errProtocol
+	}
+	return arg[:size], nil
+}
+
+// readLine reads a line ending with \r\n, or \n for inline commands.
+// returns err == errLineLength if the line is longer than maxLineLength.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > maxLineLength {
+			return nil, errLineLength
+		}
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			return nil, err
+		}
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+
+	return line, nil
+}
+
+func writeSimple(w *bufio.Writer, s string) {
+	fmt.Fprintf(w, "+%s\r\n", s)
+}
+
+func writeError(w *bufio.Writer, s string) {
+	fmt.Fprintf(w, "-%s\r\n", s)
+}
+
+func writeInt(w *bufio.Writer, n int) {
+	fmt.Fprintf(w, ":%d\r\n", n)
+}
+
+// writeBulk writes b as a bulk string, or the null bulk string if b is nil.
+func writeBulk(w *bufio.Writer, b []byte) {
+	if b == nil {
+		w.WriteString("$-1\r\n")
+		return
+	}
+	fmt.Fprintf(w, "$%d\r\n", len(b))
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+func writeArrayHeader(w *bufio.Writer, n int) {
+	fmt.Fprintf(w, "*%d\r\n", n)
+}
+
+// match reports whether s matches the redis glob pattern, which
+// supports *, ?, [abc], [^abc], [a-z] and \ escapes. A mismatch after
+// a * only retries the pattern after the last *, so patterns with many
+// stars don't backtrack exponentially.
+func match(pattern, s string) bool {
+	p, i := 0, 0
+	star, starS := -1, 0
+
+	for p < len(pattern) || i < len(s) {
+		if p < len(pattern) && pattern[p] == '*' {
+			for p < len(pattern) && pattern[p] == '*' {
+				p++
+			}
+			star, starS = p, i
+			continue
+		}
+		if p < len(pattern) && i < len(s) {
+			if n, ok := matchByte(pattern[p:], s[i]); ok {
+				p += n
+				i++
+				continue
+			}
+		}
+		// the last * takes one more byte of s
+		if star < 0 || starS >= len(s) {
+			return false
+		}
+		starS++
+		p, i = star, starS
+	}
+
+	return true
+}
+
+// matchByte reports whether c matches the first element of pattern,
+// which isn't a *, and returns the length of that element.
+func matchByte(pattern string, c byte) (int, bool) {
+	switch pattern[0] {
+	case '?':
+		return 1, true
+	case '[':
+		end := strings.IndexByte(pattern[1:], ']')
+		if end < 0 {
+			return 1, c == '['
+		}
+		class := pattern[1 : end+1]
+		negate := len(class) > 0 && class[0] == '^'
+		if negate {
+			class = class[1:]
+		}
+		return end + 2, matchClass(class, c) != negate
+	case '\\':
+		if len(pattern) > 1 {
+			return 2, pattern[1] == c
+		}
+	}
+
+	return 1, pattern[0] == c
+}
+
+// matchClass reports whether c is in a character class like abc or a-z.
+func matchClass(class string, c byte) bool {
+	for i := 0; i < len(class); i++ {
+		if i+2 < len(class) && class[i+1] == '-' {
+			if class[i] <= c && c <= class[i+2] {
+				return true
+			}
+			i += 2
+			continue
+		}
+		if class[i] == c {
+			return true
+		}
+	}
+
+	return false
+}
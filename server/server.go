@@ -0,0 +1,433 @@
+package server
+
+import (
+	"bitcask"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrServerClosed is returned by Serve after the server is closed.
+var ErrServerClosed = errors.New("server closed")
+
+// Server serves a bitcask datastore over the redis serialization
+// protocol, so redis-cli and redis client libraries can use it.
+type Server struct {
+	bc *bitcask.BitCask
+	// writeMu serializes the commands that check a key before changing it.
+	writeMu   sync.Mutex
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// New creates a server for bc. Closing the server doesn't close bc.
+func New(bc *bitcask.BitCask) *Server {
+	return &Server{
+		bc:        bc,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// ListenAndServe listens on the "tcp" or "unix" network address and
+// serves the connections made to it.
+func (s *Server) ListenAndServe(network, address string) error {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l and serves each one of them in its own
+// goroutine until the server is closed.
+// returns err == ErrServerClosed after Close is called.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops the listeners, closes every connection and waits for
+// their goroutines and the merges they started to finish.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+// serveConn reads commands from conn and writes their replies until the
+// client quits or the connection fails.
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		s.wg.Done()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				message := errProtocol.Error()
+				if err == errMultibulkLength || err == errBulkLength || err == errLineLength {
+					message = err.Error()
+				}
+				writeError(w, message)
+				w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		quit := s.handle(args, w)
+
+		// replies of pipelined commands are flushed together.
+		if r.Buffered() == 0 || quit {
+			if err := w.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// handle runs a command and writes its reply, it returns true if the
+// client asked to close the connection.
+func (s *Server) handle(args [][]byte, w *bufio.Writer) bool {
+	command := strings.ToUpper(string(args[0]))
+	args = args[1:]
+
+	switch command {
+	case "PING":
+		s.ping(args, w)
+	case "ECHO":
+		if len(args) != 1 {
+			writeArgsError(w, command)
+			break
+		}
+		writeBulk(w, args[0])
+	case "GET":
+		s.get(args, w)
+	case "SET":
+		s.set(args, w)
+	case "DEL":
+		s.del(args, w)
+	case "EXISTS":
+		s.exists(args, w)
+	case "KEYS":
+		s.keys(args, w)
+	case "SCAN":
+		s.scan(args, w)
+	case "DBSIZE":
+		writeInt(w, len(s.bc.ListKeys()))
+	case "INFO":
+		s.info(w)
+	case "BGREWRITEAOF":
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.bc.Merge()
+		}()
+		writeSimple(w, "Background append only file rewriting started")
+	case "SELECT":
+		if len(args) != 1 || string(args[0]) != "0" {
+			writeError(w, "ERR DB index is out of range")
+			break
+		}
+		writeSimple(w, "OK")
+	case "COMMAND":
+		writeArrayHeader(w, 0)
+	case "QUIT":
+		writeSimple(w, "OK")
+		return true
+	default:
+		writeError(w, fmt.Sprintf("ERR unknown command '%s'", truncate(command)))
+	}
+
+	return false
+}
+
+func (s *Server) ping(args [][]byte, w *bufio.Writer) {
+	switch len(args) {
+	case 0:
+		writeSimple(w, "PONG")
+	case 1:
+		writeBulk(w, args[0])
+	default:
+		writeArgsError(w, "PING")
+	}
+}
+
+func (s *Server) get(args [][]byte, w *bufio.Writer) {
+	if len(args) != 1 {
+		writeArgsError(w, "GET")
+		return
+	}
+
+	value, err := s.bc.Get(args[0])
+	if errors.Is(err, bitcask.ErrKeyNotExist) {
+		writeBulk(w, nil)
+		return
+	}
+	if err != nil {
+		writeBitcaskError(w, err)
+		return
+	}
+	writeBulk(w, value)
+}
+
+// set stores a value, it supports the NX and XX options. EX, PX and the
+// other expiry options are refused since bitcask keys don't expire.
+func (s *Server) set(args [][]byte, w *bufio.Writer) {
+	if len(args) < 2 {
+		writeArgsError(w, "SET")
+		return
+	}
+
+	var nx, xx bool
+	for _, option := range args[2:] {
+		switch strings.ToUpper(string(option)) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "EX", "PX", "EXAT", "PXAT", "KEEPTTL":
+			writeError(w, "ERR keys can't expire in this datastore")
+			return
+		default:
+			writeError(w, "ERR syntax error")
+			return
+		}
+	}
+	if nx && xx {
+		writeError(w, "ERR syntax error")
+		return
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if nx || xx {
+		exists := s.bc.Has(args[0])
+		if (nx && exists) || (xx && !exists) {
+			writeBulk(w, nil)
+			return
+		}
+	}
+
+	if err := s.bc.Put(args[0], args[1]); err != nil {
+		writeBitcaskError(w, err)
+		return
+	}
+	writeSimple(w, "OK")
+}
+
+func (s *Server) del(args [][]byte, w *bufio.Writer) {
+	if len(args) == 0 {
+		writeArgsError(w, "DEL")
+		return
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	var deleted int
+	for _, key := range args {
+		if !s.bc.Has(key) {
+			continue
+		}
+
+		if err := s.bc.Delete(key); err != nil {
+			writeBitcaskError(w, err)
+			return
+		}
+		deleted++
+	}
+	writeInt(w, deleted)
+}
+
+func (s *Server) exists(args [][]byte, w *bufio.Writer) {
+	if len(args) == 0 {
+		writeArgsError(w, "EXISTS")
+		return
+	}
+
+	var count int
+	for _, key := range args {
+		if s.bc.Has(key) {
+			count++
+		}
+	}
+	writeInt(w, count)
+}
+
+func (s *Server) keys(args [][]byte, w *bufio.Writer) {
+	if len(args) != 1 {
+		writeArgsError(w, "KEYS")
+		return
+	}
+
+	keys := s.sortedKeys(string(args[0]))
+	writeArrayHeader(w, len(keys))
+	for _, key := range keys {
+		writeBulk(w, []byte(key))
+	}
+}
+
+// scan walks the sorted keys, the cursor is the index of the next key.
+func (s *Server) scan(args [][]byte, w *bufio.Writer) {
+	if len(args) == 0 || len(args)%2 != 1 {
+		writeArgsError(w, "SCAN")
+		return
+	}
+
+	cursor, err := strconv.Atoi(string(args[0]))
+	if err != nil || cursor < 0 {
+		writeError(w, "ERR invalid cursor")
+		return
+	}
+
+	pattern, count := "*", 10
+	for i := 1; i < len(args); i += 2 {
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = string(args[i+1])
+		case "COUNT":
+			count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil || count < 1 {
+				writeError(w, "ERR value is not an integer or out of range")
+				return
+			}
+		default:
+			writeError(w, "ERR syntax error")
+			return
+		}
+	}
+
+	keys := s.sortedKeys("*")
+	var found []string
+	next := 0
+	for i := cursor; i < len(keys); i++ {
+		if i-cursor == count {
+			next = i
+			break
+		}
+		if match(pattern, keys[i]) {
+			found = append(found, keys[i])
+		}
+	}
+
+	writeArrayHeader(w, 2)
+	writeBulk(w, []byte(strconv.Itoa(next)))
+	writeArrayHeader(w, len(found))
+	for _, key := range found {
+		writeBulk(w, []byte(key))
+	}
+}
+
+func (s *Server) info(w *bufio.Writer) {
+	stats := s.bc.Stats()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Keyspace\r\n")
+	fmt.Fprintf(&b, "db0:keys=%d\r\n", stats.Keys)
+	fmt.Fprintf(&b, "# Bitcask\r\n")
+	fmt.Fprintf(&b, "data_files:%d\r\n", stats.DataFiles)
+	fmt.Fprintf(&b, "live_bytes:%d\r\n", stats.LiveBytes)
+	fmt.Fprintf(&b, "dead_bytes:%d\r\n", stats.DeadBytes)
+	fmt.Fprintf(&b, "active_file_size:%d\r\n", stats.ActiveFileSize)
+	fmt.Fprintf(&b, "pending_writes:%d\r\n", stats.PendingWrites)
+	fmt.Fprintf(&b, "pending_bytes:%d\r\n", stats.PendingBytes)
+	fmt.Fprintf(&b, "keydir_memory:%d\r\n", stats.KeydirMemory)
+	if !stats.LastMerge.IsZero() {
+		fmt.Fprintf(&b, "last_merge:%d\r\n", stats.LastMerge.Unix())
+		fmt.Fprintf(&b, "last_merge_duration_us:%d\r\n", stats.LastMergeDuration.Microseconds())
+	}
+
+	writeBulk(w, []byte(b.String()))
+}
+
+// sortedKeys returns the keys matching pattern in order.
+func (s *Server) sortedKeys(pattern string) []string {
+	var keys []string
+	for _, key := range s.bc.ListKeys() {
+		if match(pattern, string(key)) {
+			keys = append(keys, string(key))
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func writeArgsError(w *bufio.Writer, command string) {
+	writeError(w, fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(command)))
+}
+
+func writeBitcaskError(w *bufio.Writer, err error) {
+	writeError(w, "ERR "+err.Error())
+}
+
+// truncate shortens an unknown command before it's echoed back.
+func truncate(command string) string {
+	if len(command) > 64 {
+		return command[:64]
+	}
+	return command
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"bitcask"
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+var testBitcaskPath = path.Join("bitcask")
+
+// client sends commands to a test server and reads raw replies.
+type client struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func startServer(t testing.TB) (*client, func()) {
+	t.Helper()
+	os.RemoveAll(testBitcaskPath)
+	bc, err := bitcask.Open(testBitcaskPath, bitcask.RWsyncConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := New(bc)
+	go srv.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &client{conn, bufio.NewReader(conn)}, func() {
+		conn.Close()
+		srv.Close()
+		bc.Close()
+		os.RemoveAll(testBitcaskPath)
+	}
+}
+
+// do sends a command as a RESP array and returns the raw reply.
+func (c *client) do(t testing.TB, args ...string) string {
+	t.Helper()
+	command := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		command += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.conn.Write([]byte(command)); err != nil {
+		t.Fatal(err)
+	}
+
+	return c.readReply(t)
+}
+
+func (c *client) readReply(t testing.TB) string {
+	t.Helper()
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	switch line[0] {
+	case '$':
+		var size int
+		fmt.Sscanf(line, "$%d", &size)
+		if size < 0 {
+			return line
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			t.Fatal(err)
+		}
+		return line + string(data)
+	case '*':
+		var count int
+		fmt.Sscanf(line, "*%d", &count)
+		for i := 0; i < count; i++ {
+			line += c.readReply(t)
+		}
+	}
+
+	return line
+}
+
+func TestServer(t *testing.T) {
+	c, stop := startServer(t)
+	defer stop()
+
+	var tests = []struct {
+		args []string
+		want string
+	}{
+		{[]string{"PING"}, "+PONG\r\n"},
+		{[]string{"ping", "hello"}, "$5\r\nhello\r\n"},
+		{[]string{"GET", "name"}, "$-1\r\n"},
+		{[]string{"SET", "name", "salah"}, "+OK\r\n"},
+		{[]string{"GET", "name"}, "$5\r\nsalah\r\n"},
+		{[]string{"SET", "name", "ahmed", "NX"}, "$-1\r\n"},
+		{[]string{"SET", "nick", "ahmed", "XX"}, "$-1\r\n"},
+		{[]string{"SET", "nick", "ahmed", "NX"}, "+OK\r\n"},
+		{[]string{"SET", "age", "22", "EX", "10"}, "-ERR keys can't expire in this datastore\r\n"},
+		{[]string{"SET", "bin", "a\r\nb"}, "+OK\r\n"},
+		{[]string{"GET", "bin"}, "$4\r\na\r\nb\r\n"},
+		{[]string{"EXISTS", "name", "nick", "age"}, ":2\r\n"},
+		{[]string{"DBSIZE"}, ":3\r\n"},
+		{[]string{"KEYS", "n*"}, "*2\r\n$4\r\nname\r\n$4\r\nnick\r\n"},
+		{[]string{"SCAN", "0", "COUNT", "2"}, "*2\r\n$1\r\n2\r\n*2\r\n$3\r\nbin\r\n$4\r\nname\r\n"},
+		{[]string{"SCAN", "2", "MATCH", "n*"}, "*2\r\n$1\r\n0\r\n*1\r\n$4\r\nnick\r\n"},
+		{[]string{"DEL", "name", "age"}, ":1\r\n"},
+		{[]string{"GET", "name"}, "$-1\r\n"},
+		{[]string{"BGREWRITEAOF"}, "+Background append only file rewriting started\r\n"},
+		{[]string{"FLUSHALL"}, "-ERR unknown command 'FLUSHALL'\r\n"},
+		{[]string{"GET"}, "-ERR wrong number of arguments for 'get' command\r\n"},
+	}
+	for _, tt := range tests {
+		if got := c.do(t, tt.args...); got != tt.want {
+			t.Errorf("%v: got %q, want %q", tt.args, got, tt.want)
+		}
+	}
+
+	if got := c.do(t, "INFO"); !strings.Contains(got, "db0:keys=2\r\n") {
+		t.Errorf("got info %q", got)
+	}
+}
+
+func TestInlineAndPipelinedCommands(t *testing.T) {
+	c, stop := startServer(t)
+	defer stop()
+
+	c.conn.Write([]byte("SET name salah\r\nGET name\r\nQUIT\r\n"))
+	for _, want := range []string{"+OK\r\n", "$5\r\nsalah\r\n", "+OK\r\n"} {
+		if got := c.readReply(t); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestCommandLimits(t *testing.T) {
+	var tests = []struct {
+		command string
+		want    string
+	}{
+		{"*99999999999\r\n", "-ERR protocol error: invalid multibulk length\r\n"},
+		{"*1\r\n$99999999999\r\n", "-ERR protocol error: invalid bulk length\r\n"},
+		{"*1\r\n$-3\r\n", "-ERR protocol error: invalid bulk length\r\n"},
+		{"*1\r\n$4\r\nPINGxx", "-ERR protocol error\r\n"},
+		{strings.Repeat("x", 2*maxLineLength), "-ERR protocol error: too big inline request\r\n"},
+		{"*1\r\n$" + strings.Repeat("1", 2*maxLineLength), "-ERR protocol error: too big inline request\r\n"},
+	}
+	for _, tt := range tests {
+		c, stop := startServer(t)
+		c.conn.Write([]byte(tt.command))
+		if got := c.readReply(t); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.command, got, tt.want)
+		}
+		stop()
+	}
+
+	c, stop := startServer(t)
+	defer stop()
+	value := strings.Repeat("v", 3*bulkChunkSize)
+	if got := c.do(t, "SET", "big", value); got != "+OK\r\n" {
+		t.Errorf("got %q, want +OK", got)
+	}
+	if got := c.do(t, "GET", "big"); got != fmt.Sprintf("$%d\r\n%s\r\n", len(value), value) {
+		t.Errorf("got %d bytes, want the value", len(got))
+	}
+}
+
+func TestMatch(t *testing.T) {
+	var tests = []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "users", false},
+		{"h?llo", "hello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h\\*llo", "h*llo", true},
+		{"a/*", "a/b/c", true},
+		{"*a*b", "xaxxb", true},
+		{"*a*b", "xaxxbc", false},
+		{"a*", "", false},
+		{"[abc", "[abc", true},
+		{"h\\", "h\\", true},
+		{strings.Repeat("*a", 30) + "*b", strings.Repeat("a", 100), false},
+	}
+	for _, tt := range tests {
+		if got := match(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("match(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
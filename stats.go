@@ -0,0 +1,74 @@
+package bitcask
+
+import (
+	"path"
+	"time"
+	"unsafe"
+)
+
+// keydirEntryOverhead estimates the bytes a keydir map entry takes
+// besides the key bytes: the key header, the record and the map bucket share.
+const keydirEntryOverhead = int64(unsafe.Sizeof("") + unsafe.Sizeof(Record{}) + 8)
+
+// Stats contains statistics about a bitcask datastore.
+type Stats struct {
+	// Keys is the number of keys in keydir, pending writes not included.
+	// It's an estimate for a lazy keydir, see Config.WithLazyKeydir.
+	// The keys of buckets are counted by BucketKeys.
+	Keys       int
+	BucketKeys int
+	// DataFiles is the number of data files, Files has the stats of each
+	// one of them by file name.
+	DataFiles int
+	Files     map[string]FileStats
+	LiveBytes int64
+	DeadBytes int64
+	// ActiveFileSize is the size of the file being written to,
+	// it's always zero for readers.
+	ActiveFileSize    int64
+	PendingWrites     int
+	PendingBytes      int64
+	LastMerge         time.Time
+	LastMergeDuration time.Duration
+	// KeydirMemory is an estimate of the memory used by keydir in bytes.
+	KeydirMemory int64
+}
+
+// FileStats contains the live and dead bytes of a data file.
+type FileStats struct {
+	LiveBytes int64
+	DeadBytes int64
+}
+
+// Stats returns statistics about the bitcask datastore.
+func (bc *BitCask) Stats() Stats {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+
+	stats := Stats{
+		DataFiles:         len(bc.fileStats),
+		Files:             make(map[string]FileStats),
+		PendingWrites:     len(bc.pendingWrites),
+		LastMerge:         bc.lastMerge,
+		LastMergeDuration: bc.lastMergeDuration,
+	}
+
+	for fileId, stat := range bc.fileStats {
+		stats.Files[path.Base(fileId)] = FileStats{LiveBytes: stat.liveBytes, DeadBytes: stat.deadBytes}
+		stats.LiveBytes += stat.liveBytes
+		stats.DeadBytes += stat.deadBytes
+	}
+
+	if bc.config.writePermission {
+		stats.ActiveFileSize = bc.cursor
+	}
+
+	for key, value := range bc.pendingWrites {
+		stats.PendingBytes += int64(len(key) + len(value))
+	}
+
+	stats.Keys, stats.BucketKeys = bc.countKeys()
+	stats.KeydirMemory = bc.keydir.memory()
+
+	return stats
+}
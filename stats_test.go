@@ -0,0 +1,76 @@
+package bitcask
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	t.Run("empty bitcask", func(t *testing.T) {
+		bc, _ := Open(testBitcaskPath, RWConfig.WithFS(NewMemFS()))
+		defer bc.Close()
+		got := bc.Stats()
+
+		if got.Keys != 0 || got.DataFiles != 1 || got.LiveBytes != 0 || got.PendingWrites != 0 {
+			t.Errorf("expected only an empty active file, got %+v", got)
+		}
+	})
+
+	t.Run("keys, files and pending writes", func(t *testing.T) {
+		bc, _ := Open(testBitcaskPath, RWConfig.WithFS(NewMemFS()))
+		defer bc.Close()
+		for i := 0; i < 100; i++ {
+			bc.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte("value"))
+		}
+		bc.Sync()
+		bc.Put([]byte("key0"), []byte("new value"))
+		bc.Delete([]byte("key1"))
+		got := bc.Stats()
+
+		if got.Keys != 99 {
+			t.Errorf("got %d keys, want 99", got.Keys)
+		}
+		if got.PendingWrites != 1 || got.PendingBytes != int64(len("key0")+len("new value")) {
+			t.Errorf("got %d pending writes of %d bytes, want 1 of %d bytes", got.PendingWrites, got.PendingBytes, len("key0")+len("new value"))
+		}
+		if got.DataFiles != len(got.Files) || got.DataFiles < 2 {
+			t.Errorf("got %d data files and %d file stats", got.DataFiles, len(got.Files))
+		}
+		wantDead := itemSize("key1", len("value")) + itemSize("key1", len(TombStone))
+		if got.DeadBytes != wantDead {
+			t.Errorf("got %d dead bytes, want %d", got.DeadBytes, wantDead)
+		}
+		if got.ActiveFileSize != bc.cursor || got.KeydirMemory == 0 {
+			t.Errorf("got active file size %d and keydir memory %d", got.ActiveFileSize, got.KeydirMemory)
+		}
+	})
+
+	t.Run("last merge", func(t *testing.T) {
+		bc, _ := Open(testBitcaskPath, RWsyncConfig.WithFS(NewMemFS()))
+		defer bc.Close()
+		for i := 0; i < 100; i++ {
+			bc.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte("value"))
+		}
+		bc.Merge()
+		got := bc.Stats()
+
+		if got.LastMerge.IsZero() {
+			t.Errorf("expected last merge time to be set")
+		}
+		if got.DeadBytes != 0 {
+			t.Errorf("got %d dead bytes after merge, want 0", got.DeadBytes)
+		}
+	})
+	t.Run("bucket keys are counted apart", func(t *testing.T) {
+		bc, _ := Open(testBitcaskPath, RWsyncConfig.WithFS(NewMemFS()))
+		defer bc.Close()
+		bc.Put([]byte("key"), []byte("value"))
+		bc.Bucket("users").Put([]byte("key1"), []byte("value"))
+		bc.Bucket("users").Put([]byte("key2"), []byte("value"))
+		got := bc.Stats()
+
+		if got.Keys != 1 || got.BucketKeys != 2 {
+			t.Errorf("got %d keys and %d bucket keys, want 1 and 2", got.Keys, got.BucketKeys)
+		}
+	})
+}
@@ -0,0 +1,205 @@
+package bitcask
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+// Store is the key/value API of a bitcask, implemented by *BitCask and *Bucket.
+type Store interface {
+	Get(key []byte) ([]byte, error)
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	ListKeys() [][]byte
+	Fold(fn func([]byte, []byte, any) any, acc any) any
+}
+
+// Codec converts values of type T to bytes and back.
+type Codec[T any] interface {
+	Encode(value T) ([]byte, error)
+	Decode(data []byte) (T, error)
+}
+
+// JSONCodec encodes values as JSON.
+type JSONCodec[T any] struct{}
+
+// Encode returns the JSON encoding of value.
+func (JSONCodec[T]) Encode(value T) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+// Decode parses the JSON encoding of a value.
+func (JSONCodec[T]) Decode(data []byte) (T, error) {
+	var value T
+	err := json.Unmarshal(data, &value)
+	return value, err
+}
+
+// GobCodec encodes values with encoding/gob, every value carries the
+// description of its type.
+type GobCodec[T any] struct{}
+
+// Encode returns the gob encoding of value.
+func (GobCodec[T]) Encode(value T) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode parses the gob encoding of a value.
+func (GobCodec[T]) Decode(data []byte) (T, error) {
+	var value T
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&value)
+	return value, err
+}
+
+// BytesCodec stores byte slices as they are.
+type BytesCodec struct{}
+
+// Encode returns value.
+func (BytesCodec) Encode(value []byte) ([]byte, error) {
+	return value, nil
+}
+
+// Decode returns data.
+func (BytesCodec) Decode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+// StringCodec stores strings as their bytes.
+type StringCodec struct{}
+
+// Encode returns the bytes of value.
+func (StringCodec) Encode(value string) ([]byte, error) {
+	return []byte(value), nil
+}
+
+// Decode returns data as a string.
+func (StringCodec) Decode(data []byte) (string, error) {
+	return string(data), nil
+}
+
+// Typed stores keys of type K and values of type V in a bitcask or a
+// bucket, converting them with its codecs.
+type Typed[K, V any] struct {
+	store  Store
+	keys   Codec[K]
+	values Codec[V]
+}
+
+// NewTyped returns a Typed that stores its pairs in store, with keys
+// encoded by keys and values encoded by values.
+func NewTyped[K, V any](store Store, keys Codec[K], values Codec[V]) *Typed[K, V] {
+	return &Typed[K, V]{store: store, keys: keys, values: values}
+}
+
+// Get retrieves the value of key.
+// It returns the same errors as BitCask.Get, or the error of a codec.
+func (t *Typed[K, V]) Get(key K) (V, error) {
+	var zero V
+	k, err := t.keys.Encode(key)
+	if err != nil {
+		return zero, err
+	}
+	data, err := t.store.Get(k)
+	if err != nil {
+		return zero, err
+	}
+
+	value, err := t.values.Decode(data)
+	if err != nil {
+		return zero, fmt.Errorf("%q: %w", k, err)
+	}
+	return value, nil
+}
+
+// Put stores value at key.
+// It returns the same errors as BitCask.Put, or the error of a codec.
+func (t *Typed[K, V]) Put(key K, value V) error {
+	k, err := t.keys.Encode(key)
+	if err != nil {
+		return err
+	}
+	v, err := t.values.Encode(value)
+	if err != nil {
+		return err
+	}
+
+	return t.store.Put(k, v)
+}
+
+// Delete deletes key.
+// It returns the same errors as BitCask.Delete, or the error of the key codec.
+func (t *Typed[K, V]) Delete(key K) error {
+	k, err := t.keys.Encode(key)
+	if err != nil {
+		return err
+	}
+
+	return t.store.Delete(k)
+}
+
+// Fold folds over all key/value pairs like BitCask.Fold, skipping the
+// pairs that the codecs can't decode.
+func (t *Typed[K, V]) Fold(fn func(K, V, any) any, acc any) any {
+	return t.store.Fold(func(k, v []byte, acc any) any {
+		key, value, err := t.decode(k, v)
+		if err != nil {
+			return acc
+		}
+		return fn(key, value, acc)
+	}, acc)
+}
+
+// Keys returns all the keys.
+// returns the error of the key codec if a key can't be decoded.
+func (t *Typed[K, V]) Keys() ([]K, error) {
+	encoded := t.store.ListKeys()
+	keys := make([]K, 0, len(encoded))
+	for _, k := range encoded {
+		key, err := t.keys.Decode(k)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", k, err)
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// Each calls fn for every key/value pair until fn returns an error.
+// fn is called without holding the bitcask lock, so it may use the bitcask.
+// returns the error of fn or of a codec.
+func (t *Typed[K, V]) Each(fn func(key K, value V) error) error {
+	var err error
+	t.store.Fold(func(k, v []byte, acc any) any {
+		if err != nil {
+			return acc
+		}
+		var key K
+		var value V
+		if key, value, err = t.decode(k, v); err == nil {
+			err = fn(key, value)
+		}
+		return acc
+	}, nil)
+
+	return err
+}
+
+// decode decodes the key k and the value v.
+func (t *Typed[K, V]) decode(k, v []byte) (K, V, error) {
+	var value V
+	key, err := t.keys.Decode(k)
+	if err != nil {
+		return key, value, fmt.Errorf("%q: %w", k, err)
+	}
+	if value, err = t.values.Decode(v); err != nil {
+		return key, value, fmt.Errorf("%q: %w", k, err)
+	}
+	return key, value, nil
+}
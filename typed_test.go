@@ -0,0 +1,91 @@
+package bitcask
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+)
+
+type testUser struct {
+	Name string
+	Age  int
+	Tags []string
+}
+
+func TestTyped(t *testing.T) {
+	t.Run("codecs round trip", func(t *testing.T) {
+		bc, _ := Open(testBitcaskPath, RWConfig.WithFS(NewMemFS()))
+		user := testUser{Name: "salah", Age: 23, Tags: []string{"a", "b"}}
+
+		jsonUsers := NewTyped[string, testUser](bc.Bucket("json"), StringCodec{}, JSONCodec[testUser]{})
+		gobUsers := NewTyped[int, testUser](bc.Bucket("gob"), JSONCodec[int]{}, GobCodec[testUser]{})
+		raw := NewTyped[[]byte, []byte](bc, BytesCodec{}, BytesCodec{})
+
+		if err := jsonUsers.Put("salah", user); err != nil {
+			t.Fatal(err)
+		}
+		if err := gobUsers.Put(7, user); err != nil {
+			t.Fatal(err)
+		}
+		raw.Put([]byte("key"), []byte("value"))
+
+		got, _ := jsonUsers.Get("salah")
+		assertEqualStrings(t, fmt.Sprintf("%+v", got), fmt.Sprintf("%+v", user))
+		got, _ = gobUsers.Get(7)
+		assertEqualStrings(t, fmt.Sprintf("%+v", got), fmt.Sprintf("%+v", user))
+		value, _ := raw.Get([]byte("key"))
+		assertEqualStrings(t, string(value), "value")
+
+		stored, _ := bc.Bucket("json").Get([]byte("salah"))
+		assertEqualStrings(t, string(stored), `{"Name":"salah","Age":23,"Tags":["a","b"]}`)
+
+		gobUsers.Delete(7)
+		if _, err := gobUsers.Get(7); !errors.Is(err, ErrKeyNotExist) {
+			t.Errorf("got %v, want ErrKeyNotExist", err)
+		}
+		bc.Close()
+	})
+
+	t.Run("fold, keys and each", func(t *testing.T) {
+		bc, _ := Open(testBitcaskPath, RWsyncConfig.WithFS(NewMemFS()))
+		ages := NewTyped[string, int](bc, StringCodec{}, JSONCodec[int]{})
+		for i := 1; i <= 5; i++ {
+			ages.Put(fmt.Sprintf("user%d", i), i*10)
+		}
+		bc.Put([]byte("broken"), []byte("not json"))
+
+		sum := ages.Fold(func(key string, age int, acc any) any {
+			return acc.(int) + age
+		}, 0)
+		if sum != 150 {
+			t.Errorf("got sum %v, want 150", sum)
+		}
+
+		keys, _ := ages.Keys()
+		sort.Strings(keys)
+		assertEqualStrings(t, fmt.Sprint(keys), "[broken user1 user2 user3 user4 user5]")
+
+		bc.Delete([]byte("broken"))
+		seen := 0
+		err := ages.Each(func(key string, age int) error {
+			seen++
+			if key == "user3" {
+				return errors.New("stop")
+			}
+			return nil
+		})
+		if err == nil || err.Error() != "stop" || seen > 5 {
+			t.Errorf("got %v after %d pairs, want the error of fn", err, seen)
+		}
+
+		bc.Put([]byte("broken"), []byte("not json"))
+		if _, err := ages.Get("broken"); err == nil {
+			t.Error("got no error for a value that isn't json")
+		}
+		if err := ages.Each(func(string, int) error { return nil }); err == nil {
+			t.Error("got no error for a value that isn't json")
+		}
+		bc.Close()
+	})
+}
@@ -0,0 +1,184 @@
+package bitcask
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Op is the kind of write an Event reports.
+type Op int
+
+const (
+	// OpPut reports a key stored with a value.
+	OpPut Op = iota + 1
+	// OpDelete reports a deleted key.
+	OpDelete
+)
+
+// Event reports a write to the bitcask, Value is nil for OpDelete.
+// TimeStamp is zero for a Put without sync_on_put, whose timestamp is
+// only given once Sync writes it.
+type Event struct {
+	Op        Op
+	Key       []byte
+	Value     []byte
+	TimeStamp time.Time
+}
+
+// WatchOptions configures how a Watcher buffers events.
+type WatchOptions struct {
+	// BufferSize is the number of events buffered for the watcher.
+	BufferSize int
+	// Block makes writes wait for the watcher to receive their events once
+	// its buffer is full. Otherwise events that don't fit are dropped and
+	// counted, see Watcher.Dropped.
+	Block bool
+}
+
+// Watcher receives the events of the writes to keys starting with a prefix.
+type Watcher struct {
+	bc      *BitCask
+	prefix  []byte
+	options WatchOptions
+	events  chan Event
+	done    chan void
+	once    sync.Once
+	dropped uint64
+}
+
+// Watch returns a Watcher of the writes to the keys starting with prefix
+// made after Watch returns, an empty prefix watches every key. Events
+// are sent in the order of the writes, as soon as the writes are done,
+// a Put without sync_on_put sends its event before Sync writes it.
+// They're sent after the bitcask lock is released, so the receiver may
+// use the bitcask, but a blocking watcher must not write to it while
+// writes wait for it. Only the writes of this process are watched.
+// The watcher is closed with Close or when the bitcask is closed.
+func (bc *BitCask) Watch(prefix []byte, options ...WatchOptions) *Watcher {
+	opts := DefaultWatchOptions
+	if options != nil {
+		opts = options[0]
+	}
+
+	w := &Watcher{
+		bc:      bc,
+		prefix:  append([]byte(nil), prefix...),
+		options: opts,
+		events:  make(chan Event, opts.BufferSize),
+		done:    make(chan void),
+	}
+
+	bc.mu.Lock()
+	bc.watchers = append(bc.watchers, w)
+	bc.mu.Unlock()
+
+	return w
+}
+
+// Events returns the channel the events are sent on, it's closed
+// once the watcher is closed.
+func (w *Watcher) Events() <-chan Event {
+	return w.events
+}
+
+// Dropped returns the number of events dropped since the buffer was full.
+func (w *Watcher) Dropped() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+// Close stops the watcher and closes its events channel.
+func (w *Watcher) Close() {
+	w.once.Do(func() {
+		close(w.done)
+
+		w.bc.mu.Lock()
+		for i, watcher := range w.bc.watchers {
+			if watcher == w {
+				w.bc.watchers = append(w.bc.watchers[:i], w.bc.watchers[i+1:]...)
+				break
+			}
+		}
+		w.bc.mu.Unlock()
+
+		// waits for the events being sent to the watcher.
+		w.bc.publishMu.Lock()
+		close(w.events)
+		w.bc.publishMu.Unlock()
+	})
+}
+
+// send sends event to the watcher if it watches its key.
+func (w *Watcher) send(event Event) {
+	if !bytes.HasPrefix(event.Key, w.prefix) {
+		return
+	}
+
+	if w.options.Block {
+		select {
+		case w.events <- event:
+		case <-w.done:
+		}
+		return
+	}
+
+	select {
+	case w.events <- event:
+	default:
+		atomic.AddUint64(&w.dropped, 1)
+	}
+}
+
+// recordEvent keeps the event of a write until the bitcask lock is released.
+// Only the writes of the default namespace have events.
+func (bc *BitCask) recordEvent(op Op, key, value []byte, tStamp time.Time) {
+	if len(bc.watchers) == 0 {
+		return
+	}
+	bucket, k := splitNamespaceKey(string(key))
+	if bucket != defaultBucket {
+		return
+	}
+
+	event := Event{Op: op, Key: []byte(k), TimeStamp: tStamp}
+	if op == OpPut {
+		event.Value = append([]byte(nil), value...)
+	}
+	bc.events = append(bc.events, event)
+}
+
+// unlock releases the bitcask lock and sends the events of the writes
+// made while holding it to the watchers. Sending holds the publish lock,
+// taken before the bitcask lock is released, so events are sent in the
+// order of the writes.
+func (bc *BitCask) unlock() {
+	events := bc.events
+	if len(events) == 0 {
+		bc.mu.Unlock()
+		return
+	}
+	bc.events = nil
+	watchers := append([]*Watcher(nil), bc.watchers...)
+
+	bc.publishMu.Lock()
+	defer bc.publishMu.Unlock()
+	bc.mu.Unlock()
+
+	for _, event := range events {
+		for _, w := range watchers {
+			w.send(event)
+		}
+	}
+}
+
+// closeWatchers closes every watcher of the bitcask.
+func (bc *BitCask) closeWatchers() {
+	bc.mu.RLock()
+	watchers := append([]*Watcher(nil), bc.watchers...)
+	bc.mu.RUnlock()
+
+	for _, w := range watchers {
+		w.Close()
+	}
+}
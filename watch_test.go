@@ -0,0 +1,133 @@
+package bitcask
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// nextEvent receives the next event of w or fails after a second.
+func nextEvent(t testing.TB, w *Watcher) Event {
+	t.Helper()
+	select {
+	case event := <-w.Events():
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("expected an event")
+	}
+	return Event{}
+}
+
+func TestWatch(t *testing.T) {
+	t.Run("events of watched keys", func(t *testing.T) {
+		bc, _ := Open(testBitcaskPath, RWsyncConfig.WithFS(NewMemFS()))
+		w := bc.Watch([]byte("user:"))
+
+		bc.Put([]byte("order:1"), []byte("ignored"))
+		bc.Put([]byte("user:1"), []byte("salah"))
+		bc.Delete([]byte("user:1"))
+
+		event := nextEvent(t, w)
+		if event.Op != OpPut || string(event.Key) != "user:1" || string(event.Value) != "salah" {
+			t.Errorf("got %+v, want put of user:1", event)
+		}
+		_, tStamp, _ := bc.GetWithTimeStamp([]byte("order:1"))
+		if !event.TimeStamp.After(tStamp) {
+			t.Errorf("got timestamp %v, want after %v", event.TimeStamp, tStamp)
+		}
+		event = nextEvent(t, w)
+		if event.Op != OpDelete || string(event.Key) != "user:1" || event.Value != nil {
+			t.Errorf("got %+v, want delete of user:1", event)
+		}
+
+		bc.Close()
+		if _, ok := <-w.Events(); ok {
+			t.Errorf("expected events channel to be closed with the bitcask")
+		}
+	})
+
+	t.Run("pending writes are sent before sync", func(t *testing.T) {
+		bc, _ := Open(testBitcaskPath, RWConfig.WithFS(NewMemFS()))
+		defer bc.Close()
+		w := bc.Watch(nil)
+
+		bc.Put([]byte("key"), []byte("value"))
+		event := nextEvent(t, w)
+		assertEqualStrings(t, string(event.Value), "value")
+		if !event.TimeStamp.IsZero() {
+			t.Errorf("got timestamp %v for a pending write", event.TimeStamp)
+		}
+
+		bc.Sync()
+		select {
+		case event := <-w.Events():
+			t.Errorf("got %+v again on sync", event)
+		default:
+		}
+
+		w.Close()
+	})
+
+	t.Run("slow watcher drops events", func(t *testing.T) {
+		bc, _ := Open(testBitcaskPath, RWsyncConfig.WithFS(NewMemFS()))
+		defer bc.Close()
+		w := bc.Watch(nil, WatchOptions{BufferSize: 5})
+
+		for i := 0; i < 20; i++ {
+			bc.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte("value"))
+		}
+
+		if w.Dropped() != 15 {
+			t.Errorf("got %d dropped events, want 15", w.Dropped())
+		}
+		for i := 0; i < 5; i++ {
+			assertEqualStrings(t, string(nextEvent(t, w).Key), "key"+fmt.Sprintf("%d", i))
+		}
+	})
+
+	t.Run("blocking watcher receives every event", func(t *testing.T) {
+		bc, _ := Open(testBitcaskPath, RWsyncConfig.WithFS(NewMemFS()))
+		defer bc.Close()
+		w := bc.Watch(nil, WatchOptions{BufferSize: 1, Block: true})
+
+		done := make(chan void)
+		go func() {
+			for i := 0; i < 20; i++ {
+				bc.Put([]byte("key"+fmt.Sprintf("%d", i)), []byte("value"))
+			}
+			close(done)
+		}()
+
+		for i := 0; i < 20; i++ {
+			event := nextEvent(t, w)
+			assertEqualStrings(t, string(event.Key), "key"+fmt.Sprintf("%d", i))
+			// the receiver may read the bitcask while writes wait for it.
+			got, _ := bc.Get(event.Key)
+			assertEqualStrings(t, string(got), "value")
+		}
+		<-done
+		if w.Dropped() != 0 {
+			t.Errorf("got %d dropped events, want 0", w.Dropped())
+		}
+	})
+
+	t.Run("closing a blocking watcher releases writes", func(t *testing.T) {
+		bc, _ := Open(testBitcaskPath, RWsyncConfig.WithFS(NewMemFS()))
+		defer bc.Close()
+		w := bc.Watch(nil, WatchOptions{Block: true})
+
+		done := make(chan void)
+		go func() {
+			bc.Put([]byte("key"), []byte("value"))
+			close(done)
+		}()
+		time.Sleep(10 * time.Millisecond)
+		w.Close()
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("expected put to return once the watcher is closed")
+		}
+	})
+}